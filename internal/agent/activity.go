@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// firstLineMaxLen bounds the length of a line returned by firstLine, in runes.
+const firstLineMaxLen = 200
+
+// activityInputKeys are the tool input fields that best describe a call,
+// tried in order: commands, then paths, then search patterns and queries.
+var activityInputKeys = []string{
+	"command", "cmd",
+	"file_path", "filePath", "absolute_path", "notebook_path", "path",
+	"pattern", "filePattern", "url", "query",
+	"description", "prompt",
+}
+
+// toolActivity describes a tool call for AgentSession.Activity: the tool name
+// and the input field that best describes the call, e.g. "Bash: go test ./...".
+func toolActivity(name string, input json.RawMessage) string {
+	var fields map[string]any
+	if json.Unmarshal(input, &fields) == nil {
+		for _, key := range activityInputKeys {
+			if s := firstLine(activityValue(fields[key])); s != "" {
+				return firstLine(name + ": " + s)
+			}
+		}
+	}
+	return firstLine(name)
+}
+
+// activityValue renders a tool input value: a string, or an argv array.
+func activityValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []any:
+		args := make([]string, 0, len(v))
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				args = append(args, s)
+			}
+		}
+		return strings.Join(args, " ")
+	}
+	return ""
+}
+
+// firstLine reduces text to its first non-blank line, shortened
+// to firstLineMaxLen runes.
+func firstLine(s string) string {
+	for line := range strings.Lines(s) {
+		if line = strings.TrimSpace(line); line != "" {
+			s = line
+			break
+		}
+	}
+	s = strings.TrimSpace(s)
+	if r := []rune(s); len(r) > firstLineMaxLen {
+		return string(r[:firstLineMaxLen-1]) + "…"
+	}
+	return s
+}
@@ -1,11 +1,13 @@
 package agent
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
 	"net/url"
 	"os"
 	"path/filepath"
-	"regexp"
+	"slices"
 	"sort"
 	"strings"
 	"time"
@@ -21,10 +23,20 @@ type ampThreadFile struct {
 	Data    ampThread
 }
 
-// ampThread is the top-level structure of ~/.local/share/amp/threads/*.json.
+// ampThread is what agentstat keeps of ~/.local/share/amp/threads/*.json.
+// Threads are decoded as a stream: messages are folded into this summary one
+// at a time instead of being held in memory.
 type ampThread struct {
-	Env      ampEnv       `json:"env"`
-	Messages []ampMessage `json:"messages"`
+	Trees []ampTree // env.initial.trees
+
+	// LastAssistant is the latest assistant message, and Results the tool
+	// result status of the messages after it, keyed by tool_use ID.
+	LastAssistant *ampMessage
+	Results       map[string]string
+
+	Model   string
+	Usage   model.Usage
+	Context int64 // context size of the latest response
 }
 
 // ampEnv contains the initial environment for an Amp session.
@@ -45,8 +57,32 @@ type ampTree struct {
 
 // ampMessage represents a single message in the Amp thread.
 type ampMessage struct {
-	Role  string   `json:"role"`
-	State ampState `json:"state"`
+	Role    string            `json:"role"`
+	State   ampState          `json:"state"`
+	Content []ampContentBlock `json:"content"`
+	Usage   *ampUsage         `json:"usage"` // assistant messages
+}
+
+// ampUsage is the usage recorded on an assistant message.
+type ampUsage struct {
+	Model                    string `json:"model"`
+	InputTokens              int64  `json:"inputTokens"`
+	OutputTokens             int64  `json:"outputTokens"`
+	CacheCreationInputTokens int64  `json:"cacheCreationInputTokens"`
+	CacheReadInputTokens     int64  `json:"cacheReadInputTokens"`
+}
+
+// ampContentBlock is one block of a message's content. Assistant messages
+// carry tool_use blocks; the user message that follows carries their results.
+type ampContentBlock struct {
+	Type      string          `json:"type"`
+	ID        string          `json:"id"`        // tool_use
+	Name      string          `json:"name"`      // tool_use
+	Input     json.RawMessage `json:"input"`     // tool_use
+	ToolUseID string          `json:"toolUseID"` // tool_result
+	Run       struct {
+		Status string `json:"status"` // "in-progress" | "done" | "blocked-on-user" | ...
+	} `json:"run"`
 }
 
 // ampState holds the assistant message's execution state.
@@ -56,87 +92,186 @@ type ampState struct {
 }
 
 // DiscoverAmp finds all running Amp Code processes and determines their status.
-func DiscoverAmp() []model.AgentSession {
-	pids := findAmpPIDs()
+func DiscoverAmp(snap *platform.Snapshot) []model.AgentSession {
+	pids := findAmpPIDs(snap)
 	if len(pids) == 0 {
 		return nil
 	}
 
-	threads := loadAmpThreads()
-	if len(threads) == 0 {
-		// Processes exist but no thread files — report unknown status.
-		return ConcurrentProbe(pids, func(pid int) *model.AgentSession {
-			cwd := platform.P.ReadProcessCwd(pid)
+	// Load threads once per data directory (XDG_DATA_HOME may differ per process).
+	threadsByPID := make(map[int][]ampThreadFile, len(pids))
+	for dir, group := range groupByDir(snap, pids, (*procEnv).ampDataDir) {
+		if dir == "" {
+			continue
+		}
+		threads := loadAmpThreads(dir, groupCwds(snap, group), earliestStart(snap, group), openFiles(snap, group))
+		for _, pid := range group {
+			threadsByPID[pid] = threads
+		}
+	}
+
+	return withProcessInfo(snap, ConcurrentProbe(pids, func(pid int) *model.AgentSession {
+		threads := threadsByPID[pid]
+		if len(threads) == 0 {
+			// Process exists but no thread files — report unknown status.
+			cwd := snap.Cwd(pid)
 			return &model.AgentSession{
 				Agent:     "amp",
 				Status:    model.StatusUnknown,
 				Directory: cwd,
 				PID:       pid,
 			}
-		})
-	}
-
-	return ConcurrentProbe(pids, func(pid int) *model.AgentSession {
-		return probeAmpPID(pid, threads)
-	})
+		}
+		return probeAmpPID(snap, pid, threads)
+	}))
 }
 
 // findAmpPIDs returns PIDs of Amp Code processes.
 // Amp runs as `node --no-warnings ~/.local/share/pnpm/amp`, so argv[0] is "node".
 // We match any argument ending with /amp or equal to "amp".
-func findAmpPIDs() []int {
-	re := regexp.MustCompile(`(^|/)amp$`)
-	return platform.P.FindPIDsByArgs(re)
+func findAmpPIDs(snap *platform.Snapshot) []int {
+	return filterOwnPIDs(snap, snap.FindByArgs(processRegexp("amp")))
 }
 
-// loadAmpThreads scans ~/.local/share/amp/threads/*.json and parses each file.
-func loadAmpThreads() []ampThreadFile {
-	home, err := os.UserHomeDir()
-	if err != nil {
-		return nil
-	}
-
-	threadsDir := filepath.Join(home, ".local", "share", "amp", "threads")
+// loadAmpThreads scans {dataDir}/threads/*.json and parses the files that can
+// belong to a running process, i.e. whose workspace trees contain one of cwds:
+// those open in one of the processes, and those modified since since. Older
+// files are only opened, newest first, for the cwds none of those covers,
+// until each has its newest thread.
+func loadAmpThreads(dataDir string, cwds []string, since time.Time, open map[string]bool) []ampThreadFile {
+	threadsDir := filepath.Join(dataDir, "threads")
 	entries, err := os.ReadDir(threadsDir)
 	if err != nil {
 		return nil
 	}
 
-	var threads []ampThreadFile
+	var files, older []ampThreadFile
 	for _, e := range entries {
 		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
 			continue
 		}
-
-		path := filepath.Join(threadsDir, e.Name())
 		info, err := e.Info()
 		if err != nil {
 			continue
 		}
+		f := ampThreadFile{Path: filepath.Join(threadsDir, e.Name()), ModTime: info.ModTime()}
+		if open[f.Path] || !f.ModTime.Before(since) {
+			files = append(files, f)
+		} else {
+			older = append(older, f)
+		}
+	}
 
-		data, err := os.ReadFile(path)
-		if err != nil {
-			continue
+	var threads []ampThreadFile
+	for _, f := range files {
+		if thread, err := decodeAmpThread(f.Path, cwds); err == nil {
+			f.Data = *thread
+			threads = append(threads, f)
 		}
+	}
 
-		var thread ampThread
-		if json.Unmarshal(data, &thread) != nil {
+	uncovered := slices.DeleteFunc(slices.Clone(cwds), func(cwd string) bool {
+		return slices.ContainsFunc(threads, func(t ampThreadFile) bool {
+			return ampTreesContainAny(t.Data.Trees, []string{cwd})
+		})
+	})
+	sort.Slice(older, func(i, j int) bool { return older[i].ModTime.After(older[j].ModTime) })
+	for _, f := range older {
+		if len(uncovered) == 0 {
+			break
+		}
+		thread, err := decodeAmpThread(f.Path, uncovered)
+		if err != nil {
 			continue
 		}
-
-		threads = append(threads, ampThreadFile{
-			Path:    path,
-			ModTime: info.ModTime(),
-			Data:    thread,
+		f.Data = *thread
+		threads = append(threads, f)
+		uncovered = slices.DeleteFunc(uncovered, func(cwd string) bool {
+			return ampTreesContainAny(thread.Trees, []string{cwd})
 		})
 	}
-
 	return threads
 }
 
+// errOtherProject stops decoding a thread whose workspace matches no process.
+var errOtherProject = errors.New("thread belongs to another project")
+
+// decodeAmpThread stream-decodes a thread file into its summary. Decoding
+// stops early once env shows that the thread's workspace contains none of cwds.
+func decodeAmpThread(path string, cwds []string) (*ampThread, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t := &ampThread{}
+	dec := json.NewDecoder(bufio.NewReader(f))
+	err = decodeObject(dec, map[string]func(*json.Decoder) error{
+		"env": func(dec *json.Decoder) error {
+			var env ampEnv
+			if err := dec.Decode(&env); err != nil {
+				return err
+			}
+			t.Trees = env.Initial.Trees
+			if !ampTreesContainAny(t.Trees, cwds) {
+				return errOtherProject
+			}
+			return nil
+		},
+		"messages": func(dec *json.Decoder) error {
+			return decodeArray(dec, func(dec *json.Decoder) error {
+				var msg ampMessage
+				if err := dec.Decode(&msg); err != nil {
+					return err
+				}
+				t.add(msg)
+				return nil
+			})
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// add folds the next message of the thread into the summary.
+func (t *ampThread) add(msg ampMessage) {
+	if msg.Role == "assistant" {
+		t.LastAssistant = &msg
+		t.Results = nil
+	} else {
+		for _, b := range msg.Content {
+			if b.Type == "tool_result" {
+				if t.Results == nil {
+					t.Results = make(map[string]string)
+				}
+				t.Results[b.ToolUseID] = b.Run.Status
+			}
+		}
+	}
+
+	u := msg.Usage
+	if u == nil {
+		return
+	}
+	if u.Model != "" {
+		t.Model = u.Model
+	}
+	last := model.Usage{
+		InputTokens:      u.InputTokens,
+		OutputTokens:     u.OutputTokens,
+		CacheReadTokens:  u.CacheReadInputTokens,
+		CacheWriteTokens: u.CacheCreationInputTokens,
+	}
+	t.Usage.Add(last)
+	t.Context = last.Total()
+}
+
 // probeAmpPID examines a single Amp process and returns its session info.
-func probeAmpPID(pid int, threads []ampThreadFile) *model.AgentSession {
-	cwd := platform.P.ReadProcessCwd(pid)
+func probeAmpPID(snap *platform.Snapshot, pid int, threads []ampThreadFile) *model.AgentSession {
+	cwd := snap.Cwd(pid)
 	if cwd == "" || cwd == "-" {
 		return nil
 	}
@@ -152,23 +287,34 @@ func probeAmpPID(pid int, threads []ampThreadFile) *model.AgentSession {
 	}
 
 	status := ampStatusFromThread(&thread.Data)
+	activity := ""
+	if status == model.StatusBusy || status == model.StatusWaitingApproval {
+		activity = ampActivity(&thread.Data)
+	}
 
 	// Use the thread filename (without extension) as session ID.
 	sessionID := strings.TrimSuffix(filepath.Base(thread.Path), ".json")
 
 	// Use the first tree's display name as title, if available.
 	title := "-"
-	if len(thread.Data.Env.Initial.Trees) > 0 {
-		title = thread.Data.Env.Initial.Trees[0].DisplayName
+	if len(thread.Data.Trees) > 0 {
+		title = thread.Data.Trees[0].DisplayName
 	}
 
 	return &model.AgentSession{
-		Agent:     "amp",
-		Status:    status,
-		SessionID: sessionID,
-		Title:     title,
-		Directory: cwd,
-		PID:       pid,
+		Agent:          "amp",
+		Status:         status,
+		Activity:       activity,
+		SessionID:      sessionID,
+		Title:          title,
+		Directory:      cwd,
+		PID:            pid,
+		Path:           thread.Path,
+		LastActivityAt: thread.ModTime,
+		Model:          thread.Data.Model,
+		Usage:          thread.Data.Usage,
+		ContextTokens:  thread.Data.Context,
+		ContextWindow:  contextWindow(thread.Data.Model),
 	}
 }
 
@@ -183,32 +329,77 @@ func matchThreadByCwd(cwd string, threads []ampThreadFile) *ampThreadFile {
 	})
 
 	for i := range sorted {
-		for _, tree := range sorted[i].Data.Env.Initial.Trees {
-			treePath := uriToPath(tree.URI)
-			if treePath == "" {
-				continue
-			}
+		if ampTreesContainAny(sorted[i].Data.Trees, []string{cwd}) {
+			return &sorted[i]
+		}
+	}
+	return nil
+}
+
+// ampTreesContainAny reports whether any of cwds lies inside one of the
+// workspace trees.
+func ampTreesContainAny(trees []ampTree, cwds []string) bool {
+	for _, tree := range trees {
+		treePath := uriToPath(tree.URI)
+		if treePath == "" {
+			continue
+		}
+		for _, cwd := range cwds {
 			// CWD may be inside the workspace tree directory.
 			if cwd == treePath || strings.HasPrefix(cwd, treePath+"/") {
-				return &sorted[i]
+				return true
 			}
 		}
 	}
-	return nil
+	return false
 }
 
 // ampStatusFromThread reads the last assistant message's state to determine status.
+// A tool call that has no result yet, or whose result is blocked on the user,
+// is awaiting approval.
 func ampStatusFromThread(thread *ampThread) string {
-	// Walk messages in reverse to find the last assistant message.
-	for i := len(thread.Messages) - 1; i >= 0; i-- {
-		msg := thread.Messages[i]
-		if msg.Role != "assistant" {
+	msg := thread.LastAssistant
+	if msg == nil {
+		// No assistant message found — session just started or empty.
+		return model.StatusIdle
+	}
+	status := ampStatus(msg.State)
+	if status == model.StatusBusy && msg.State.Type == "complete" && ampAwaitingApproval(msg, thread.Results) {
+		return model.StatusWaitingApproval
+	}
+	return status
+}
+
+// ampAwaitingApproval reports whether any tool_use in msg has a result blocked
+// on the user. A tool_use without a result may just be running, so it leaves
+// the thread busy.
+func ampAwaitingApproval(msg *ampMessage, results map[string]string) bool {
+	for _, b := range msg.Content {
+		if b.Type == "tool_use" && results[b.ID] == "blocked-on-user" {
+			return true
+		}
+	}
+	return false
+}
+
+// ampActivity describes the latest tool call of the last assistant message
+// that has no result yet, or whose result is still in progress or blocked on
+// the user. Returns "" if there is none.
+func ampActivity(thread *ampThread) string {
+	msg := thread.LastAssistant
+	if msg == nil {
+		return ""
+	}
+	for _, b := range slices.Backward(msg.Content) {
+		if b.Type != "tool_use" {
 			continue
 		}
-		return ampStatus(msg.State)
+		switch status, ok := thread.Results[b.ID]; {
+		case !ok, status == "in-progress", status == "blocked-on-user":
+			return toolActivity(b.Name, b.Input)
+		}
 	}
-	// No assistant message found — session just started or empty.
-	return model.StatusIdle
+	return ""
 }
 
 // ampStatus maps an Amp message state to a model status.
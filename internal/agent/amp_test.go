@@ -0,0 +1,34 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/model"
+)
+
+func TestAmpStatusFromThread(t *testing.T) {
+	toolUse := &ampMessage{
+		Role:    "assistant",
+		State:   ampState{Type: "complete", StopReason: "tool_use"},
+		Content: []ampContentBlock{{Type: "tool_use", ID: "t1", Name: "Bash"}, {Type: "tool_use", ID: "t2", Name: "Read"}},
+	}
+	tests := []struct {
+		name    string
+		last    *ampMessage
+		results map[string]string
+		want    string
+	}{
+		{"no assistant message", nil, nil, model.StatusIdle},
+		{"no results yet", toolUse, nil, model.StatusBusy},
+		{"running", toolUse, map[string]string{"t1": "in-progress", "t2": "done"}, model.StatusBusy},
+		{"blocked on user", toolUse, map[string]string{"t1": "blocked-on-user"}, model.StatusWaitingApproval},
+		{"streaming", &ampMessage{State: ampState{Type: "streaming"}}, nil, model.StatusBusy},
+		{"end of turn", &ampMessage{State: ampState{Type: "complete", StopReason: "end_turn"}}, nil, model.StatusIdle},
+	}
+	for _, tt := range tests {
+		thread := &ampThread{LastAssistant: tt.last, Results: tt.results}
+		if got := ampStatusFromThread(thread); got != tt.want {
+			t.Errorf("%s: status %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
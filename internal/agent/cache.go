@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/config"
+)
+
+// cachePath returns the location of the named cache file, or "" if there is
+// no cache directory.
+func cachePath(name string) string {
+	dir := config.CacheDir()
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, name)
+}
+
+// readCacheFile decodes the cache file at path into v, reporting whether it
+// could be read.
+func readCacheFile(path string, v any) bool {
+	if path == "" {
+		return false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
+
+// writeCacheFile writes v to the cache file at path atomically, so concurrent
+// runs never see a partial file. Failures are ignored: caches only save work.
+func writeCacheFile(path string, v any) {
+	if path == "" {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return
+	}
+	_, werr := tmp.Write(data)
+	cerr := tmp.Close()
+	if werr != nil || cerr != nil || os.Rename(tmp.Name(), path) != nil {
+		os.Remove(tmp.Name())
+	}
+}
+
+// fileInode returns the inode number of a file, or 0 if unknown. Together
+// with the size it tells a file appended to from one replaced by another.
+func fileInode(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
+
+// lineCache persists state accumulated line by line from append-only files
+// (session transcripts), so each run only parses the lines appended since the
+// previous one. It holds the files read by the latest run. S must hold values
+// only, no maps, slices or pointers: read returns a copy of the cached state,
+// which is used after the lock is released.
+type lineCache[S any] struct {
+	Version int                           `json:"version"`
+	Files   map[string]*lineCacheEntry[S] `json:"files"` // keyed by file path
+
+	mu    sync.Mutex
+	path  string
+	used  map[string]bool // files read in this run
+	dirty bool
+}
+
+// lineCacheEntry is the cached state of one file.
+type lineCacheEntry[S any] struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Inode   uint64    `json:"inode"`
+	Offset  int64     `json:"offset"` // end of the last complete line read
+	State   S         `json:"state"`
+}
+
+// loadLineCache reads the named cache, returning an empty one if it is
+// missing, unreadable or of another version.
+func loadLineCache[S any](name string, version int) *lineCache[S] {
+	path := cachePath(name)
+	c := &lineCache[S]{}
+	if !readCacheFile(path, c) || c.Version != version || c.Files == nil {
+		c = &lineCache[S]{Version: version, Files: make(map[string]*lineCacheEntry[S])}
+	}
+	c.path = path
+	c.used = make(map[string]bool)
+	return c
+}
+
+// save drops the files not read in this run and writes the cache if it
+// changed (see writeCacheFile).
+func (c *lineCache[S]) save() {
+	for path := range c.Files {
+		if !c.used[path] {
+			delete(c.Files, path)
+			c.dirty = true
+		}
+	}
+	c.flush()
+}
+
+// flush writes the cache if it changed, keeping the files not read in this
+// run: for runs that only read the files of some sessions.
+func (c *lineCache[S]) flush() {
+	if c.dirty {
+		writeCacheFile(c.path, c)
+	}
+}
+
+// read passes the complete lines of the file at path that were appended since
+// the state cached for it to add, and returns the resulting state. A file
+// that shrank or was replaced (another inode) is read from the start, and a
+// partial last line is left for the next run. Reads are serialised, as the
+// same file may be probed for several processes. c may be nil, to read the
+// whole file uncached.
+func (c *lineCache[S]) read(path string, add func(st *S, line []byte)) (S, bool) {
+	var zero S
+	f, err := os.Open(path)
+	if err != nil {
+		return zero, false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return zero, false
+	}
+
+	var e *lineCacheEntry[S]
+	if c != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.used[path] = true
+		e = c.Files[path]
+	}
+	switch {
+	case e == nil || fi.Size() < e.Offset || fileInode(fi) != e.Inode:
+		e = &lineCacheEntry[S]{}
+	case fi.Size() == e.Size && fi.ModTime().Equal(e.ModTime):
+		return e.State, true
+	}
+
+	if _, err := f.Seek(e.Offset, io.SeekStart); err == nil {
+		r := bufio.NewReaderSize(f, 64*1024)
+		for {
+			line, err := r.ReadBytes('\n')
+			if err != nil {
+				break
+			}
+			e.Offset += int64(len(line))
+			add(&e.State, line)
+		}
+	}
+	e.Size, e.ModTime, e.Inode = fi.Size(), fi.ModTime(), fileInode(fi)
+	if c != nil {
+		c.Files[path] = e
+		c.dirty = true
+	}
+	return e.State, true
+}
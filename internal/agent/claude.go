@@ -2,14 +2,11 @@ package agent
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"io"
 	"os"
 	"path/filepath"
-	"regexp"
-	"sort"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/Eric-Song-Nop/agentstat/internal/model"
@@ -27,179 +24,200 @@ type claudeSessionInfo struct {
 
 // claudeJSONLEntry represents the relevant fields from a Claude Code JSONL line.
 type claudeJSONLEntry struct {
-	Type    string `json:"type"`
-	Subtype string `json:"subtype"`
-	Slug    string `json:"slug"`
-	CWD     string `json:"cwd"`
+	Type            string          `json:"type"`
+	Subtype         string          `json:"subtype"`
+	Slug            string          `json:"slug"`
+	CWD             string          `json:"cwd"`
+	Timestamp       string          `json:"timestamp"`
+	IsSidechain     bool            `json:"isSidechain"`
+	PermissionMode  string          `json:"permissionMode"`  // on user entries
+	ToolUseID       string          `json:"toolUseID"`       // on progress entries
+	ParentToolUseID string          `json:"parentToolUseID"` // on progress entries
+	ToolUseResult   json.RawMessage `json:"toolUseResult"`   // on tool_result entries
+	Message         claudeMessage   `json:"message"`
 }
 
-// DiscoverClaude finds all running Claude Code processes and determines their status.
-func DiscoverClaude() []model.AgentSession {
-	pids := findClaudePIDs()
-	if len(pids) == 0 {
-		return nil
-	}
-
-	pidMap := buildPIDSessionMap(pids)
-
-	return ConcurrentProbe(pids, func(pid int) *model.AgentSession {
-		return probeClaudePID(pid, pidMap)
-	})
+// claudeMessage is the API message carried by user and assistant entries.
+type claudeMessage struct {
+	Content    json.RawMessage `json:"content"` // a string or an array of content blocks
+	StopReason string          `json:"stop_reason"`
 }
 
-// findClaudePIDs returns PIDs of processes whose binary is "claude".
-func findClaudePIDs() []int {
-	re := regexp.MustCompile(`(^|/)claude$`)
-	return platform.P.FindPIDsByName(re)
+// claudeUsageEntry is the subset of an assistant entry that carries usage.
+// A response split into several entries repeats the same message ID and usage.
+type claudeUsageEntry struct {
+	Type    string `json:"type"`
+	Subtype string `json:"subtype"`
+	Message struct {
+		ID    string      `json:"id"`
+		Model string      `json:"model"`
+		Usage claudeUsage `json:"usage"`
+	} `json:"message"`
 }
 
-// debugFileInfo pairs a debug log path with its modification time for sorting.
-type debugFileInfo struct {
-	path    string
-	modTime time.Time
+// claudeUsage is the Anthropic API usage object.
+type claudeUsage struct {
+	InputTokens              int64 `json:"input_tokens"`
+	OutputTokens             int64 `json:"output_tokens"`
+	CacheCreationInputTokens int64 `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64 `json:"cache_read_input_tokens"`
 }
 
-// buildPIDSessionMap scans ~/.claude/debug/*.txt to build a PID → SessionID mapping.
-//
-// Each debug log is named {sessionId}.txt. Inside the file, lines contain temporary
-// file references like ".tmp.{PID}." which reveal which PID owns that session.
-// Files are scanned in mtime-descending order (newest first) so active sessions
-// are found quickly. Scanning stops as soon as all target PIDs are mapped.
-func buildPIDSessionMap(pids []int) map[int]string {
-	pidMap := make(map[int]string, len(pids))
-	if len(pids) == 0 {
-		return pidMap
-	}
-
-	// Build target PID set for O(1) lookup.
-	target := make(map[int]bool, len(pids))
-	for _, pid := range pids {
-		target[pid] = true
+// toModel converts API usage to the model representation.
+func (u claudeUsage) toModel() model.Usage {
+	return model.Usage{
+		InputTokens:      u.InputTokens,
+		OutputTokens:     u.OutputTokens,
+		CacheReadTokens:  u.CacheReadInputTokens,
+		CacheWriteTokens: u.CacheCreationInputTokens,
 	}
+}
 
-	home, err := os.UserHomeDir()
-	if err != nil {
-		return pidMap
-	}
+// claudeContentBlock is one element of a message content array.
+type claudeContentBlock struct {
+	Type      string          `json:"type"`        // "text" | "thinking" | "tool_use" | "tool_result" | ...
+	ID        string          `json:"id"`          // tool_use
+	Name      string          `json:"name"`        // tool_use
+	Input     json.RawMessage `json:"input"`       // tool_use
+	ToolUseID string          `json:"tool_use_id"` // tool_result
+}
 
-	debugDir := filepath.Join(home, ".claude", "debug")
-	entries, err := os.ReadDir(debugDir)
-	if err != nil {
-		return pidMap
+// blocks decodes the message content; a plain string content has no blocks.
+func (m claudeMessage) blocks() []claudeContentBlock {
+	if len(m.Content) == 0 || m.Content[0] != '[' {
+		return nil
 	}
-
-	// Collect .txt files with their modification times.
-	var files []debugFileInfo
-	for _, e := range entries {
-		if e.IsDir() || !strings.HasSuffix(e.Name(), ".txt") {
-			continue
-		}
-		info, err := e.Info()
-		if err != nil {
-			continue
-		}
-		files = append(files, debugFileInfo{
-			path:    filepath.Join(debugDir, e.Name()),
-			modTime: info.ModTime(),
-		})
+	var blocks []claudeContentBlock
+	if json.Unmarshal(m.Content, &blocks) != nil {
+		return nil
 	}
+	return blocks
+}
 
-	// Sort by mtime descending — newest files first.
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].modTime.After(files[j].modTime)
-	})
-
-	re := regexp.MustCompile(`\.tmp\.(\d+)\.`)
-	remaining := len(target)
-
-	for _, df := range files {
-		if remaining == 0 {
-			break
-		}
+// claudePendingTool is a tool_use in the current turn with no tool_result yet.
+type claudePendingTool struct {
+	Name     string
+	Input    json.RawMessage
+	Activity string // see toolActivity
+	Started  time.Time
+	Order    int  // position among the turn's tool calls
+	Running  bool // a progress entry shows the tool executing
+}
 
-		pid := extractPIDFromDebugLog(df.path, re, target, pidMap)
-		if pid != 0 {
-			// Derive sessionID from filename: {sessionId}.txt → {sessionId}
-			base := filepath.Base(df.path)
-			sessionID := strings.TrimSuffix(base, ".txt")
-			pidMap[pid] = sessionID
-			remaining--
-		}
-	}
+// claudeStatusInfo is the state readClaudeStatus extracts from a session JSONL.
+type claudeStatusInfo struct {
+	Status     string
+	Slug       string
+	CWD        string
+	Since      time.Time // when the current status began; zero if unknown
+	Compacting bool
+	Activity   string            // the latest pending tool call, or the one awaiting approval
+	Subagents  []*claudeSubagent // started in the current turn, or still running in the background
+}
 
-	return pidMap
+// claudeUsageInfo is the state readClaudeUsage extracts from a session JSONL.
+type claudeUsageInfo struct {
+	Model       string
+	Usage       model.Usage
+	Context     int64 // context size of the latest response; 0 if unknown
+	Compactions int
 }
 
-// extractPIDFromDebugLog reads a debug log line-by-line looking for a .tmp.{PID}. pattern.
-// Returns the matched PID if it's in the target set and not yet mapped, otherwise 0.
-func extractPIDFromDebugLog(path string, re *regexp.Regexp, target map[int]bool, mapped map[int]string) int {
-	f, err := os.Open(path)
-	if err != nil {
-		return 0
+// DiscoverClaude finds all running Claude Code processes and determines their status.
+func DiscoverClaude(snap *platform.Snapshot) []model.AgentSession {
+	pids := findClaudePIDs(snap)
+	if len(pids) == 0 {
+		return nil
 	}
-	defer f.Close()
-
-	scanner := bufio.NewScanner(f)
-	scanner.Buffer(make([]byte, 0, 64*1024), 256*1024)
 
-	for scanner.Scan() {
-		matches := re.FindStringSubmatch(scanner.Text())
-		if len(matches) < 2 {
+	// Each process may use a different config directory (CLAUDE_CONFIG_DIR).
+	pidMap := make(map[int]claudeMatch, len(pids))
+	pidDir := make(map[int]string, len(pids))
+	for dir, group := range groupByDir(snap, pids, (*procEnv).claudeDir) {
+		if dir == "" {
 			continue
 		}
-		pid, err := strconv.Atoi(matches[1])
-		if err != nil {
-			continue
+		for pid, m := range matchClaudeSessions(snap, dir, group) {
+			pidMap[pid] = m
 		}
-		if target[pid] && mapped[pid] == "" {
-			return pid
+		for _, pid := range group {
+			pidDir[pid] = dir
 		}
 	}
-	return 0
+
+	usage := loadClaudeUsageCache()
+	sessions := withProcessInfo(snap, ConcurrentProbe(pids, func(pid int) *model.AgentSession {
+		if pidDir[pid] == "" {
+			// No config directory to look in — report unknown status.
+			return &model.AgentSession{
+				Agent:     "claude",
+				Status:    model.StatusUnknown,
+				Directory: snap.Cwd(pid),
+				PID:       pid,
+			}
+		}
+		return probeClaudePID(snap, pid, pidDir[pid], pidMap, usage)
+	}))
+	usage.save()
+	return sessions
+}
+
+// findClaudePIDs returns PIDs of processes whose binary is "claude".
+func findClaudePIDs(snap *platform.Snapshot) []int {
+	return filterOwnPIDs(snap, snap.FindByName(processRegexp("claude")))
 }
 
 // probeClaudePID examines a single Claude Code process and returns its session info.
-func probeClaudePID(pid int, pidMap map[int]string) *model.AgentSession {
-	sessionID, ok := pidMap[pid]
-	if !ok || sessionID == "" {
+func probeClaudePID(snap *platform.Snapshot, pid int, claudeDir string, pidMap map[int]claudeMatch, usageCache *lineCache[claudeUsageState]) *model.AgentSession {
+	match, ok := pidMap[pid]
+	if !ok {
 		return nil
 	}
 
-	info := resolveClaudeSession(sessionID)
+	info := resolveClaudeSession(claudeDir, match.SessionID)
 	if info == nil {
 		return nil
 	}
 
-	status, slug, cwd := readClaudeStatus(info.JSONLPath)
+	st := readClaudeStatus(info.JSONLPath, platform.P.ReadProcessRoot(pid), descendantStarts(snap, pid))
+	usage := readClaudeUsage(info.JSONLPath, usageCache)
 
-	title := slug
+	title := st.Slug
 	if title == "" {
 		title = "-"
 	}
 
-	dir := cwd
+	dir := st.CWD
 	if dir == "" {
-		dir = platform.P.ReadProcessCwd(pid)
+		dir = snap.Cwd(pid)
 	}
 
 	return &model.AgentSession{
-		Agent:     "claude",
-		Status:    status,
-		SessionID: info.SessionID,
-		Title:     title,
-		Directory: dir,
-		PID:       pid,
+		Agent:           "claude",
+		Status:          st.Status,
+		SessionID:       info.SessionID,
+		Title:           title,
+		Directory:       dir,
+		PID:             pid,
+		MatchMethod:     match.Method,
+		MatchConfidence: match.Confidence,
+		Path:            info.JSONLPath,
+		LastActivityAt:  info.ModTime,
+		StatusSince:     st.Since,
+		Activity:        st.Activity,
+		Model:           usage.Model,
+		Usage:           usage.Usage,
+		ContextTokens:   usage.Context,
+		ContextWindow:   contextWindow(usage.Model),
+		Compacting:      st.Compacting,
+		Compactions:     usage.Compactions,
+		Children:        claudeSubagentSessions(info.JSONLPath, st.Subagents, pid, dir),
 	}
 }
 
-// resolveClaudeSession finds the JSONL file for a session ID under ~/.claude/projects/.
-func resolveClaudeSession(sessionID string) *claudeSessionInfo {
-	home, err := os.UserHomeDir()
-	if err != nil {
-		return nil
-	}
-
-	projectsDir := filepath.Join(home, ".claude", "projects")
+// resolveClaudeSession finds the JSONL file for a session ID under {claudeDir}/projects/.
+func resolveClaudeSession(claudeDir, sessionID string) *claudeSessionInfo {
+	projectsDir := filepath.Join(claudeDir, "projects")
 	pattern := filepath.Join(projectsDir, "*", sessionID+".jsonl")
 	matches, err := filepath.Glob(pattern)
 	if err != nil || len(matches) == 0 {
@@ -225,95 +243,267 @@ func resolveClaudeSession(sessionID string) *claudeSessionInfo {
 }
 
 // readClaudeStatus reads a Claude Code session JSONL and extracts the current status,
-// slug (title), and working directory.
+// slug (title), working directory, and when the status began.
 //
 // Deterministic rule (based on Claude Code JSONL protocol):
 //   - Each turn ends with a system/turn_duration entry
 //   - assistant entries only appear within a turn
 //   - Therefore: last turn_duration after last assistant → idle; otherwise → busy
 //
-// Performance: for files > 128KB, only the trailing 128KB is scanned.
-func readClaudeStatus(jsonlPath string) (status, slug, cwd string) {
+// Within a busy turn, a tool_use with no matching tool_result is awaiting
+// permission (waiting) only if the permission mode and the permissions.allow
+// rules of the user and project settings would prompt for it (see
+// claudePermissions), it has been pending for claudeApprovalDelay, no
+// progress entry shows it running, and the processes Claude Code started
+// (spawned) show that it has not run (see claudePromptShown). Otherwise the
+// session stays busy. The call awaiting approval, or else the latest pending
+// call, is the session's activity. root is the host prefix of a containerized
+// process's filesystem (see procEnv), through which the project settings are
+// read.
+//
+// Performance: the file is read backwards only as far as the start of the
+// current turn, or the launch of the earliest background subagent still
+// running, bounded by claudeStatusMaxScan bytes.
+func readClaudeStatus(jsonlPath, root string, spawned []time.Time) claudeStatusInfo {
+	unknown := claudeStatusInfo{Status: model.StatusUnknown}
+
 	f, err := os.Open(jsonlPath)
 	if err != nil {
-		return model.StatusUnknown, "", ""
+		return unknown
 	}
 	defer f.Close()
 
-	// Performance optimization: seek to tail for large files.
-	const tailSize = 128 * 1024
 	fi, err := f.Stat()
 	if err != nil {
-		return model.StatusUnknown, "", ""
+		return unknown
 	}
-	if fi.Size() > tailSize {
-		if _, err := f.Seek(fi.Size()-tailSize, io.SeekStart); err != nil {
-			return model.StatusUnknown, "", ""
+
+	// Find where the forward scan must start: the last turn_duration (the
+	// previous turn's end), once the working directory is known too, and
+	// before any running subagent started.
+	running, earliest := claudeRunningSidechains(jsonlPath)
+	var start, scanned int64
+	var sawBoundary, sawEarliest bool
+	var cwd string
+	err = scanJSONLBackward(f, fi.Size(), func(line []byte, offset int64) bool {
+		start = offset
+		scanned += int64(len(line))
+		var entry struct {
+			Type      string `json:"type"`
+			Subtype   string `json:"subtype"`
+			CWD       string `json:"cwd"`
+			Timestamp string `json:"timestamp"`
 		}
-		// Discard the first (potentially truncated) line after seeking.
-		r := bufio.NewReader(f)
-		if _, err := r.ReadBytes('\n'); err != nil {
-			return model.StatusUnknown, "", ""
+		if json.Unmarshal(line, &entry) == nil {
+			sawBoundary = sawBoundary || (entry.Type == "system" && entry.Subtype == "turn_duration")
+			if cwd == "" {
+				cwd = entry.CWD
+			}
+			if ts := parseTimestamp(entry.Timestamp); !ts.IsZero() && ts.Before(earliest) {
+				sawEarliest = true
+			}
 		}
-		// Continue scanning from the buffered reader via a new scanner.
-		return scanClaudeJSONL(r)
+		done := sawBoundary && cwd != "" && (earliest.IsZero() || sawEarliest)
+		return !done && scanned < claudeStatusMaxScan
+	})
+	if err != nil {
+		return unknown
 	}
 
-	return scanClaudeJSONL(f)
+	// A turn longer than the scan bound is seen only in part; its prompt, which
+	// records the permission mode, is then taken from the head of the file.
+	truncated := start > 0 && !sawBoundary
+	var perms claudePermissions
+	if truncated {
+		perms.Mode = claudeHeadPermissionMode(f)
+	}
+	// Transcripts live in {claudeDir}/projects/{project}/{session}.jsonl.
+	claudeDir := filepath.Dir(filepath.Dir(filepath.Dir(jsonlPath)))
+	if cwd != "" && root != "" {
+		cwd = filepath.Join(root, cwd)
+	}
+	perms.Allow = loadClaudeAllowRules(claudeDir, cwd)
+	return scanClaudeJSONL(io.NewSectionReader(f, start, fi.Size()-start), truncated, perms, running, spawned)
+}
+
+// claudeStatusMaxScan bounds how far back readClaudeStatus reads.
+const claudeStatusMaxScan = 8 << 20
+
+// claudeHeadPermissionMode returns the last permission mode recorded in the
+// first 64KB of a session file, or "" if none is.
+func claudeHeadPermissionMode(f *os.File) string {
+	var mode string
+	scanner := bufio.NewScanner(io.NewSectionReader(f, 0, 64*1024))
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024)
+	for scanner.Scan() {
+		var entry claudeJSONLEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil && entry.PermissionMode != "" {
+			mode = entry.PermissionMode
+		}
+	}
+	return mode
 }
 
 // scanClaudeJSONL performs a forward scan over a reader, tracking the last line
 // positions of turn_duration and assistant entries to determine session status.
-func scanClaudeJSONL(r io.Reader) (status, slug, cwd string) {
-	scanner := bufio.NewScanner(r)
-	scanner.Buffer(make([]byte, 0, 256*1024), 1024*1024)
-
-	var lastTurnDuration, lastAssistant int = -1, -1
+// truncated reports that r starts mid-turn, so a turn with no turn_duration in
+// view may have started earlier than the first entry seen. perms.Mode is the
+// permission mode in effect before r, overridden by any prompt entry in r.
+// running holds the agent IDs of the subagents still running (see
+// claudeRunningSidechains), and spawned the start times of the processes under
+// Claude Code (see claudePromptShown). Lines may be of any length.
+func scanClaudeJSONL(r io.Reader, truncated bool, perms claudePermissions, running map[string]bool, spawned []time.Time) claudeStatusInfo {
+	br := bufio.NewReaderSize(r, 64*1024)
+
+	var st claudeStatusInfo
+	var lastTurnDuration, lastAssistant, lastCompact int = -1, -1, -1
+	// Timestamps of the last turn_duration and of the first entry after it.
+	var turnEnded, turnStarted time.Time
+	// Tool calls of the current turn still awaiting a result, by tool_use ID.
+	pending := make(map[string]*claudePendingTool)
+	toolCalls := 0
+	subagents := claudeSubagents{running: running}
 	lineNum := 0
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.TrimSpace(line) == "" {
-			lineNum++
-			continue
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && len(line) == 0 {
+			break
 		}
 
 		var entry claudeJSONLEntry
-		if json.Unmarshal([]byte(line), &entry) != nil {
+		if len(bytes.TrimSpace(line)) == 0 || json.Unmarshal(line, &entry) != nil {
 			lineNum++
 			continue
 		}
 
 		// Continuously update slug and cwd to their latest values.
 		if entry.Slug != "" {
-			slug = entry.Slug
+			st.Slug = entry.Slug
 		}
 		if entry.CWD != "" {
-			cwd = entry.CWD
+			st.CWD = entry.CWD
+		}
+
+		ts := parseTimestamp(entry.Timestamp)
+		if turnStarted.IsZero() && (entry.Type == "user" || entry.Type == "assistant") {
+			turnStarted = ts
 		}
 
 		switch entry.Type {
 		case "system":
-			if entry.Subtype == "turn_duration" {
+			switch entry.Subtype {
+			case "turn_duration":
 				lastTurnDuration = lineNum
+				turnEnded, turnStarted = ts, time.Time{}
+				clear(pending)
+				subagents.endTurn()
+			case "compact_boundary":
+				lastCompact = lineNum
 			}
 		case "assistant":
 			lastAssistant = lineNum
+			if !entry.IsSidechain {
+				for _, b := range entry.Message.blocks() {
+					if b.Type == "tool_use" {
+						pending[b.ID] = &claudePendingTool{
+							Name:     b.Name,
+							Input:    b.Input,
+							Activity: toolActivity(b.Name, b.Input),
+							Started:  ts,
+							Order:    toolCalls,
+						}
+						toolCalls++
+						subagents.start(b, ts)
+					}
+				}
+			}
+		case "user":
+			if entry.PermissionMode != "" {
+				perms.Mode = entry.PermissionMode
+			}
+			for _, b := range entry.Message.blocks() {
+				if b.Type == "tool_result" {
+					delete(pending, b.ToolUseID)
+					subagents.finish(b.ToolUseID, entry.ToolUseResult, ts)
+				}
+			}
+		case "progress":
+			for _, id := range []string{entry.ToolUseID, entry.ParentToolUseID} {
+				if p := pending[id]; p != nil {
+					p.Running = true
+				}
+			}
 		}
 
 		lineNum++
 	}
 
+	st.Subagents = subagents.list
+
 	// Deterministic status: compare last positions of the two markers.
 	switch {
 	case lastTurnDuration > lastAssistant:
-		status = model.StatusIdle // Last turn has ended.
+		st.Status = model.StatusIdle // Last turn has ended.
+		st.Since = turnEnded
 	case lastAssistant > lastTurnDuration:
-		status = model.StatusBusy // Currently within a turn.
+		st.Status = model.StatusBusy // Currently within a turn.
+		if lastTurnDuration >= 0 || !truncated {
+			st.Since = turnStarted
+		}
+		if p := latestPending(pending); p != nil {
+			st.Activity = p.Activity
+		}
+		if p := awaitingApproval(pending, perms, spawned, time.Now()); p != nil {
+			st.Status = model.StatusWaitingApproval
+			st.Since = p.Started
+			st.Activity = p.Activity
+		}
+		// A compaction inside a turn that has not produced a response since
+		// is still rebuilding the context.
+		st.Compacting = lastCompact > lastAssistant
 	default:
 		// Both -1 (no turn records) → new session waiting for input.
-		status = model.StatusIdle
+		st.Status = model.StatusIdle
 	}
 
-	return status, slug, cwd
+	return st
+}
+
+// parseTimestamp parses an RFC 3339 timestamp as written in agent transcripts,
+// returning the zero time if it is empty or malformed.
+func parseTimestamp(s string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// latestPending returns the most recently started pending tool call, or nil
+// if there is none.
+func latestPending(pending map[string]*claudePendingTool) *claudePendingTool {
+	var latest *claudePendingTool
+	for _, p := range pending {
+		if latest == nil || p.Started.After(latest.Started) ||
+			(p.Started.Equal(latest.Started) && p.Order > latest.Order) {
+			latest = p
+		}
+	}
+	return latest
+}
+
+// awaitingApproval returns the earliest pending tool call that is blocked on a
+// permission prompt at now, or nil if none is.
+func awaitingApproval(pending map[string]*claudePendingTool, perms claudePermissions, spawned []time.Time, now time.Time) *claudePendingTool {
+	var waiting *claudePendingTool
+	for _, p := range pending {
+		if p.Running || perms.allows(p.Name, p.Input) || now.Sub(p.Started) < claudeApprovalDelay || !claudePromptShown(p, spawned) {
+			continue
+		}
+		if waiting == nil || p.Started.Before(waiting.Started) {
+			waiting = p
+		}
+	}
+	return waiting
 }
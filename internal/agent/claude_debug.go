@@ -0,0 +1,233 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/platform"
+)
+
+// debugLogCacheVersion is bumped whenever the cache layout or the meaning of
+// its fields changes; a cache with another version is discarded.
+const debugLogCacheVersion = 2
+
+// debugLogCache persists what has been read from Claude Code debug logs, so
+// each run only reads bytes appended since the previous one.
+type debugLogCache struct {
+	Version int                       `json:"version"`
+	Files   map[string]*debugLogEntry `json:"files"` // keyed by debug log path
+
+	dirty bool // changed since it was loaded
+}
+
+// debugLogEntry is the cached state of one debug log.
+type debugLogEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Inode   uint64    `json:"inode"`
+	Offset  int64     `json:"offset"` // end of the last complete line read
+	// PIDs maps each PID referenced in the log to the file's mtime when the
+	// reference was last read: an upper bound on when it was written.
+	PIDs map[int]time.Time `json:"pids,omitempty"`
+}
+
+// debugLogFile is a debug log found in a directory listing.
+type debugLogFile struct {
+	path string
+	info os.FileInfo
+}
+
+// debugTmpRe matches the .tmp.{PID}. temp file references in debug logs.
+var debugTmpRe = regexp.MustCompile(`\.tmp\.(\d+)\.`)
+
+// buildPIDSessionMap maps PIDs to session IDs from {claudeDir}/debug/*.txt.
+//
+// Each debug log is named {sessionId}.txt. Inside the file, lines contain temporary
+// file references like ".tmp.{PID}." which reveal which PID owns that session.
+// Logs are read incrementally: the cache under $XDG_CACHE_HOME/agentstat records
+// how far each file was read and the PIDs seen in it. A reference only counts if
+// it was read after the process started, which rules out reused PIDs; when
+// several logs qualify, the most recently modified wins. Logs are visited newest
+// first, so once every PID is mapped the older ones are left unread (and
+// uncached). PIDs that are no longer running and logs that no longer exist are
+// pruned from the cache, which is only written when it changed.
+//
+// A process writes its PID as seen in its own PID namespace, so a
+// containerized process is looked up by its innermost PID (NSpid).
+func buildPIDSessionMap(snap *platform.Snapshot, claudeDir string, pids []int) map[int]string {
+	pidMap := make(map[int]string, len(pids))
+	if len(pids) == 0 {
+		return pidMap
+	}
+
+	debugDir := filepath.Join(claudeDir, "debug")
+	entries, err := os.ReadDir(debugDir)
+	if err != nil {
+		return pidMap
+	}
+
+	var logs []debugLogFile
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".txt") {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			logs = append(logs, debugLogFile{filepath.Join(debugDir, e.Name()), info})
+		}
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].info.ModTime().After(logs[j].info.ModTime())
+	})
+
+	cachePath := debugLogCachePath()
+	cache := loadDebugLogCache(cachePath)
+	cache.prune(snap, debugDir, logs)
+
+	for _, l := range logs {
+		if len(pidMap) == len(pids) {
+			break
+		}
+		entry := cache.Files[l.path]
+		if entry == nil || l.info.Size() < entry.Offset || fileInode(l.info) != entry.Inode {
+			// New file, or truncated/replaced since the last read.
+			entry = &debugLogEntry{Inode: fileInode(l.info)}
+			cache.Files[l.path] = entry
+			cache.dirty = true
+		}
+		if l.info.Size() != entry.Size || !l.info.ModTime().Equal(entry.ModTime) {
+			readDebugLog(l.path, entry, l.info.ModTime())
+			entry.Size, entry.ModTime = l.info.Size(), l.info.ModTime()
+			cache.dirty = true
+		}
+
+		// Logs come newest first, so the first qualifying one wins.
+		for _, pid := range pids {
+			if _, ok := pidMap[pid]; ok {
+				continue
+			}
+			if seen, ok := entry.PIDs[snap.NSPID(pid)]; ok && !seen.Before(startTime(snap, pid)) {
+				pidMap[pid] = strings.TrimSuffix(filepath.Base(l.path), ".txt")
+			}
+		}
+	}
+
+	if cache.dirty {
+		saveDebugLogCache(cachePath, cache)
+	}
+	return pidMap
+}
+
+// prune drops PIDs that are no longer running and the entries of logs that no
+// longer exist: those of debugDir missing from logs, and those of other
+// directories whose file is gone.
+func (c *debugLogCache) prune(snap *platform.Snapshot, debugDir string, logs []debugLogFile) {
+	// PIDs referenced by some running process, in its own namespace.
+	live := make(map[int]bool)
+	for _, pid := range snap.PIDs() {
+		live[snap.NSPID(pid)] = true
+	}
+	listed := make(map[string]bool, len(logs))
+	for _, l := range logs {
+		listed[l.path] = true
+	}
+
+	for path, entry := range c.Files {
+		var gone bool
+		if filepath.Dir(path) == debugDir {
+			gone = !listed[path]
+		} else {
+			_, err := os.Stat(path)
+			gone = errors.Is(err, fs.ErrNotExist)
+		}
+		if gone {
+			delete(c.Files, path)
+			c.dirty = true
+			continue
+		}
+		for pid := range entry.PIDs {
+			if !live[pid] {
+				delete(entry.PIDs, pid)
+				c.dirty = true
+			}
+		}
+	}
+}
+
+// readDebugLog reads the complete lines appended to a debug log since
+// entry.Offset and records the PIDs they reference as seen at modTime.
+func readDebugLog(path string, entry *debugLogEntry, modTime time.Time) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(entry.Offset, io.SeekStart); err != nil {
+		return
+	}
+
+	r := bufio.NewReaderSize(f, 64*1024)
+	for {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Overlong line: consume the rest of it. A reference split at the
+			// buffer boundary is missed, which is acceptable for log noise.
+			entry.recordPIDs(line, modTime)
+			entry.Offset += int64(len(line))
+			continue
+		}
+		if err != nil {
+			// Partial last line: leave it for the next run.
+			return
+		}
+		entry.recordPIDs(line, modTime)
+		entry.Offset += int64(len(line))
+	}
+}
+
+// recordPIDs records every .tmp.{PID}. reference in line.
+func (e *debugLogEntry) recordPIDs(line []byte, seen time.Time) {
+	if !bytes.Contains(line, []byte(".tmp.")) {
+		return
+	}
+	for _, m := range debugTmpRe.FindAllSubmatch(line, -1) {
+		pid, err := strconv.Atoi(string(m[1]))
+		if err != nil {
+			continue
+		}
+		if e.PIDs == nil {
+			e.PIDs = make(map[int]time.Time)
+		}
+		e.PIDs[pid] = seen
+	}
+}
+
+// debugLogCachePath returns the cache file location, or "" if there is no
+// cache directory.
+func debugLogCachePath() string {
+	return cachePath("claude-debug.json")
+}
+
+// loadDebugLogCache reads the cache, returning an empty one if it is missing,
+// unreadable or of another version.
+func loadDebugLogCache(path string) *debugLogCache {
+	var cache debugLogCache
+	if !readCacheFile(path, &cache) || cache.Version != debugLogCacheVersion || cache.Files == nil {
+		return &debugLogCache{Version: debugLogCacheVersion, Files: make(map[string]*debugLogEntry)}
+	}
+	return &cache
+}
+
+// saveDebugLogCache writes the cache (see writeCacheFile).
+func saveDebugLogCache(path string, cache *debugLogCache) {
+	writeCacheFile(path, cache)
+}
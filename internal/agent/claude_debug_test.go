@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/platform"
+)
+
+func TestBuildPIDSessionMap(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	claudeDir := t.TempDir()
+	debugDir := filepath.Join(claudeDir, "debug")
+	t0 := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(min int) time.Time { return t0.Add(time.Duration(min) * time.Minute) }
+	log := func(id string) string { return filepath.Join(debugDir, id+".txt") }
+	appendLog := func(id, content string, mtime int) {
+		t.Helper()
+		f, err := os.OpenFile(log(id), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(content)
+		f.Close()
+		os.Chtimes(log(id), at(mtime), at(mtime))
+	}
+	os.MkdirAll(debugDir, 0o755)
+
+	snap := platform.NewSnapshot([]*platform.Process{
+		fakeProcess(10, 1, "/src", at(0), "claude"),
+		fakeProcess(20, 1, "/src", at(0), "claude"),
+	})
+	run := func() map[int]string {
+		t.Helper()
+		return buildPIDSessionMap(snap, claudeDir, []int{10, 20})
+	}
+	cached := func() *debugLogCache {
+		t.Helper()
+		return loadDebugLogCache(debugLogCachePath())
+	}
+
+	// A partial last line is left for the next run.
+	appendLog("a", "write .claude.json.tmp.10.1\nwrite .claude.json.tmp.20", 5)
+	if got := run(); got[10] != "a" || len(got) != 1 {
+		t.Errorf("first run: %v, want 10 -> a only", got)
+	}
+	appendLog("a", ".2\n", 6)
+	if got := run(); got[10] != "a" || got[20] != "a" {
+		t.Errorf("completed line: %v, want 10 and 20 -> a", got)
+	}
+
+	// Newer logs win, and once every PID is mapped older ones are not read.
+	appendLog("b", "write .claude.json.tmp.10.3\nwrite .claude.json.tmp.20.3\n", 10)
+	appendLog("c", "write .claude.json.tmp.10.4\n", 1)
+	if got := run(); got[10] != "b" || got[20] != "b" {
+		t.Errorf("newer log: %v, want 10 and 20 -> b", got)
+	}
+	if c := cached(); c.Files[log("c")] != nil || c.Files[log("b")] == nil {
+		t.Errorf("cached logs %v, want b but not the unread c", c.Files)
+	}
+
+	// A log that shrank is read again from the start.
+	os.Remove(log("b"))
+	appendLog("b", "write .claude.json.tmp.20.5\n", 11)
+	if got := run(); got[10] != "a" || got[20] != "b" {
+		t.Errorf("shrunk log: %v, want 10 -> a and 20 -> b", got)
+	}
+	if e := cached().Files[log("b")]; e == nil || e.PIDs[10] != (time.Time{}) {
+		t.Errorf("shrunk log cached as %+v, want no reference to 10", e)
+	}
+
+	// A log replaced by another file of the same size is read again.
+	replaced := "write .claude.json.tmp.10.5\n"
+	os.WriteFile(log("b")+".new", []byte(replaced), 0o644)
+	os.Rename(log("b")+".new", log("b"))
+	os.Chtimes(log("b"), at(11), at(11))
+	if got := run(); got[10] != "b" {
+		t.Errorf("replaced log: %v, want 10 -> b", got)
+	}
+
+	// Deleted logs and exited PIDs are pruned.
+	os.Remove(log("a"))
+	snap = platform.NewSnapshot([]*platform.Process{fakeProcess(10, 1, "/src", at(0), "claude")})
+	run()
+	c := cached()
+	if c.Files[log("a")] != nil {
+		t.Error("deleted log still cached")
+	}
+	for path, e := range c.Files {
+		if _, ok := e.PIDs[20]; ok {
+			t.Errorf("%s: exited PID 20 still cached", path)
+		}
+	}
+}
+
+func TestBuildPIDSessionMapStartTime(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	claudeDir := t.TempDir()
+	started := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	// A reference read before the process started was written by an earlier
+	// process with the same PID.
+	writeClaudeTestFile(t, filepath.Join(claudeDir, "debug", "old.txt"), "write .claude.json.tmp.10.1\n", started.Add(-time.Hour))
+	// A containerized process writes its PID in its own namespace.
+	writeClaudeTestFile(t, filepath.Join(claudeDir, "debug", "ns.txt"), "write .claude.json.tmp.7.1\n", started.Add(time.Minute))
+
+	p := fakeProcess(20, 1, "/src", started, "claude")
+	p.NSPID = 7
+	snap := platform.NewSnapshot([]*platform.Process{fakeProcess(10, 1, "/src", started, "claude"), p})
+	got := buildPIDSessionMap(snap, claudeDir, []int{10, 20})
+	if len(got) != 1 || got[20] != "ns" {
+		t.Errorf("got %v, want 20 -> ns only", got)
+	}
+}
@@ -0,0 +1,236 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/model"
+	"github.com/Eric-Song-Nop/agentstat/internal/platform"
+)
+
+// claudeMatch records which session a Claude Code process was mapped to and how.
+type claudeMatch struct {
+	SessionID  string
+	Method     string // one of the claudeMatchStrategies names
+	Confidence string // model.Confidence*
+}
+
+// claudeMatchStrategy maps some of pids to sessions. Sessions in claimed are
+// already taken by other processes and must not be returned.
+type claudeMatchStrategy struct {
+	Name  string
+	Match func(snap *platform.Snapshot, claudeDir string, pids []int, claimed map[string]bool) map[int]claudeMatch
+}
+
+// claudeMatchStrategies are tried in order; each only sees the PIDs that the
+// earlier ones left unmapped.
+var claudeMatchStrategies = []claudeMatchStrategy{
+	{"sessions-file", matchClaudeBySessionsFile},
+	{"argv", matchClaudeByArgv},
+	{"open-file", matchClaudeByOpenFiles},
+	{"debug-log", matchClaudeByDebugLog},
+	{"cwd", matchClaudeByCwd},
+}
+
+// matchClaudeSessions maps Claude Code PIDs sharing one config directory to
+// session IDs. A mapping is kept only if the session's JSONL exists.
+func matchClaudeSessions(snap *platform.Snapshot, claudeDir string, pids []int) map[int]claudeMatch {
+	matches := make(map[int]claudeMatch, len(pids))
+	claimed := make(map[string]bool)
+	remaining := pids
+
+	for _, s := range claudeMatchStrategies {
+		if len(remaining) == 0 {
+			break
+		}
+		for pid, m := range s.Match(snap, claudeDir, remaining, claimed) {
+			if claimed[m.SessionID] || resolveClaudeSession(claudeDir, m.SessionID) == nil {
+				continue
+			}
+			m.Method = s.Name
+			matches[pid] = m
+			claimed[m.SessionID] = true
+		}
+
+		var next []int
+		for _, pid := range remaining {
+			if _, ok := matches[pid]; !ok {
+				next = append(next, pid)
+			}
+		}
+		remaining = next
+	}
+	return matches
+}
+
+// claudeSessionsFile is {claudeDir}/sessions/{pid}.json, which Claude Code
+// writes for each running interactive process.
+type claudeSessionsFile struct {
+	PID       int    `json:"pid"`
+	SessionID string `json:"sessionId"`
+	StartedAt int64  `json:"startedAt"` // Unix milliseconds
+}
+
+// matchClaudeBySessionsFile reads {claudeDir}/sessions/{pid}.json. The file
+// outlives a crashed process, so it is only trusted when its start time
+// agrees with the process's.
+func matchClaudeBySessionsFile(snap *platform.Snapshot, claudeDir string, pids []int, _ map[string]bool) map[int]claudeMatch {
+	found := make(map[int]claudeMatch)
+	for _, pid := range pids {
+		data, err := os.ReadFile(filepath.Join(claudeDir, "sessions", strconv.Itoa(pid)+".json"))
+		if err != nil {
+			continue
+		}
+		var f claudeSessionsFile
+		if json.Unmarshal(data, &f) != nil || f.PID != pid || f.SessionID == "" {
+			continue
+		}
+		if p := snap.Get(pid); p != nil && !p.StartTime.IsZero() && f.StartedAt > 0 {
+			if d := time.UnixMilli(f.StartedAt).Sub(p.StartTime); d < -time.Minute || d > time.Minute {
+				continue
+			}
+		}
+		found[pid] = claudeMatch{SessionID: f.SessionID, Confidence: model.ConfidenceHigh}
+	}
+	return found
+}
+
+// matchClaudeByArgv reads --session-id and --resume from the command line.
+// --session-id names the session outright; a resumed session may have been
+// switched since with /resume, and --fork-session starts a new one.
+func matchClaudeByArgv(snap *platform.Snapshot, _ string, pids []int, _ map[string]bool) map[int]claudeMatch {
+	found := make(map[int]claudeMatch)
+	for _, pid := range pids {
+		p := snap.Get(pid)
+		if p == nil {
+			continue
+		}
+		var sessionID, resumeID string
+		fork := false
+		for i := 1; i < len(p.Argv); i++ {
+			arg := p.Argv[i]
+			name, value, hasValue := strings.Cut(arg, "=")
+			if !hasValue && i+1 < len(p.Argv) {
+				value = p.Argv[i+1]
+			}
+			switch name {
+			case "--session-id":
+				sessionID = value
+			case "--resume", "-r":
+				resumeID = value
+			case "--fork-session":
+				fork = true
+			}
+		}
+		switch {
+		case uuidRe.MatchString(sessionID):
+			found[pid] = claudeMatch{SessionID: sessionID, Confidence: model.ConfidenceHigh}
+		case uuidRe.MatchString(resumeID) && !fork:
+			found[pid] = claudeMatch{SessionID: resumeID, Confidence: model.ConfidenceMedium}
+		}
+	}
+	return found
+}
+
+// uuidRe matches a bare session UUID.
+var uuidRe = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// claudeOpenFileRe matches open files that name the session: its JSONL under
+// projects/, or its per-session temp directory /tmp/claude-{uid}/{cwd}/{id}/.
+var claudeOpenFileRe = regexp.MustCompile(`(?:/projects/[^/]+/|/claude-\d+/[^/]+/)([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})(?:\.jsonl$|/|$)`)
+
+// matchClaudeByOpenFiles looks for a session JSONL or session temp directory
+// among the process's open files.
+func matchClaudeByOpenFiles(_ *platform.Snapshot, _ string, pids []int, _ map[string]bool) map[int]claudeMatch {
+	found := make(map[int]claudeMatch)
+	for _, pid := range pids {
+		for _, f := range platform.P.ListOpenFiles(pid) {
+			if m := claudeOpenFileRe.FindStringSubmatch(f); m != nil {
+				found[pid] = claudeMatch{SessionID: m[1], Confidence: model.ConfidenceHigh}
+				break
+			}
+		}
+	}
+	return found
+}
+
+// matchClaudeByDebugLog finds .tmp.{PID}. references in debug logs (see
+// buildPIDSessionMap). Debug logging may be off or the log rotated away.
+func matchClaudeByDebugLog(snap *platform.Snapshot, claudeDir string, pids []int, _ map[string]bool) map[int]claudeMatch {
+	found := make(map[int]claudeMatch)
+	for pid, sessionID := range buildPIDSessionMap(snap, claudeDir, pids) {
+		found[pid] = claudeMatch{SessionID: sessionID, Confidence: model.ConfidenceMedium}
+	}
+	return found
+}
+
+// claudeProjectDirRe matches the characters Claude Code replaces with "-"
+// when naming a project directory after its working directory.
+var claudeProjectDirRe = regexp.MustCompile(`[^a-zA-Z0-9]`)
+
+// matchClaudeByCwd pairs processes with the newest unclaimed session JSONLs
+// in {claudeDir}/projects/{encoded cwd}/. Within one directory the most
+// recently started process gets the most recently written session. This is a
+// guess: the newest file may belong to an exited process.
+func matchClaudeByCwd(snap *platform.Snapshot, claudeDir string, pids []int, claimed map[string]bool) map[int]claudeMatch {
+	byCwd := make(map[string][]int)
+	for _, pid := range pids {
+		if cwd := snap.Cwd(pid); cwd != "-" {
+			byCwd[cwd] = append(byCwd[cwd], pid)
+		}
+	}
+
+	found := make(map[int]claudeMatch)
+	for cwd, group := range byCwd {
+		dir := filepath.Join(claudeDir, "projects", claudeProjectDirRe.ReplaceAllString(cwd, "-"))
+		sessions := newestJSONLs(dir, claimed)
+
+		sort.Slice(group, func(i, j int) bool {
+			return startTime(snap, group[i]).After(startTime(snap, group[j]))
+		})
+		for i, pid := range group {
+			if i >= len(sessions) {
+				break
+			}
+			found[pid] = claudeMatch{SessionID: sessions[i], Confidence: model.ConfidenceLow}
+		}
+	}
+	return found
+}
+
+// newestJSONLs returns the session IDs of the JSONL files in dir, newest
+// first, skipping claimed ones.
+func newestJSONLs(dir string, claimed map[string]bool) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	type session struct {
+		id      string
+		modTime time.Time
+	}
+	var sessions []session
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".jsonl")
+		if e.IsDir() || !ok || claimed[id] {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			sessions = append(sessions, session{id, info.ModTime()})
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].modTime.After(sessions[j].modTime)
+	})
+	ids := make([]string, len(sessions))
+	for i, s := range sessions {
+		ids[i] = s.id
+	}
+	return ids
+}
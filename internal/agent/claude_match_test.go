@@ -0,0 +1,209 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/model"
+	"github.com/Eric-Song-Nop/agentstat/internal/platform"
+)
+
+// claudeTestID returns the session UUID numbered n.
+func claudeTestID(n int) string {
+	return fmt.Sprintf("00000000-0000-0000-0000-%012d", n)
+}
+
+// writeClaudeTestFile writes a file, creating its directory, and sets its
+// modification time.
+func writeClaudeTestFile(t *testing.T, path, content string, mtime time.Time) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMatchClaudeSessions(t *testing.T) {
+	t0 := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(min int) time.Time { return t0.Add(time.Duration(min) * time.Minute) }
+	id := claudeTestID
+
+	type want struct {
+		session    int // claudeTestID number; 0 if unmatched
+		method     string
+		confidence string
+	}
+	tests := []struct {
+		name     string
+		procs    []*platform.Process
+		sessions map[int]int // session number -> JSONL mtime in minutes after t0
+		// files under the config directory, with their mtime in minutes
+		files map[string]struct {
+			content string
+			mtime   int
+		}
+		open map[int][]string
+		want map[int]want
+	}{
+		{
+			name:     "sessions file",
+			procs:    []*platform.Process{fakeProcess(10, 1, "/src", at(0), "claude")},
+			sessions: map[int]int{1: 5, 2: 10},
+			files: map[string]struct {
+				content string
+				mtime   int
+			}{
+				"sessions/10.json": {fmt.Sprintf(`{"pid":10,"sessionId":%q,"startedAt":%d}`, id(1), at(0).UnixMilli()), 0},
+			},
+			want: map[int]want{10: {1, "sessions-file", model.ConfidenceHigh}},
+		},
+		{
+			name:     "stale sessions file of an earlier process",
+			procs:    []*platform.Process{fakeProcess(10, 1, "/src", at(0), "claude")},
+			sessions: map[int]int{1: -100, 2: 10},
+			files: map[string]struct {
+				content string
+				mtime   int
+			}{
+				"sessions/10.json": {fmt.Sprintf(`{"pid":10,"sessionId":%q,"startedAt":%d}`, id(1), at(-120).UnixMilli()), -120},
+			},
+			want: map[int]want{10: {2, "cwd", model.ConfidenceLow}},
+		},
+		{
+			name: "argv",
+			procs: []*platform.Process{
+				fakeProcess(10, 1, "/src", at(0), "claude", "--session-id", id(1)),
+				fakeProcess(20, 1, "/src", at(1), "claude", "--resume="+id(2)),
+				fakeProcess(30, 1, "/src", at(2), "claude", "-r", id(3), "--fork-session"),
+			},
+			sessions: map[int]int{1: 5, 2: 6, 3: 7, 4: 8},
+			want: map[int]want{
+				10: {1, "argv", model.ConfidenceHigh},
+				20: {2, "argv", model.ConfidenceMedium},
+				// A fork writes a new session, the newest one left.
+				30: {4, "cwd", model.ConfidenceLow},
+			},
+		},
+		{
+			name:     "argv naming a session without a JSONL",
+			procs:    []*platform.Process{fakeProcess(10, 1, "/src", at(0), "claude", "--resume", id(9))},
+			sessions: map[int]int{1: 5},
+			want:     map[int]want{10: {1, "cwd", model.ConfidenceLow}},
+		},
+		{
+			name: "open file",
+			procs: []*platform.Process{
+				fakeProcess(10, 1, "/src", at(0), "claude"),
+				fakeProcess(20, 1, "/src", at(1), "claude"),
+			},
+			sessions: map[int]int{1: 5, 2: 6},
+			open: map[int][]string{
+				10: {"/dev/null", "/claude/projects/-src/" + id(2) + ".jsonl"},
+				20: {"/tmp/claude-1000/-src/" + id(1) + "/tasks/out"},
+			},
+			want: map[int]want{
+				10: {2, "open-file", model.ConfidenceHigh},
+				20: {1, "open-file", model.ConfidenceHigh},
+			},
+		},
+		{
+			name: "debug log written since the start",
+			procs: []*platform.Process{
+				fakeProcess(10, 1, "/src", at(0), "claude"),
+				fakeProcess(20, 1, "/src", at(0), "claude"),
+			},
+			sessions: map[int]int{1: 5, 2: 30, 3: 40},
+			files: map[string]struct {
+				content string
+				mtime   int
+			}{
+				"debug/" + id(1) + ".txt": {"write /src/.claude.json.tmp.10.1700000000\n", 5},
+				// Written by an earlier process with the PID now reused.
+				"debug/" + id(2) + ".txt": {"write /src/.claude.json.tmp.20.1700000000\n", -60},
+			},
+			want: map[int]want{
+				10: {1, "debug-log", model.ConfidenceMedium},
+				20: {3, "cwd", model.ConfidenceLow},
+			},
+		},
+		{
+			name: "cwd, newest process to newest session",
+			procs: []*platform.Process{
+				fakeProcess(10, 1, "/src", at(0), "claude"),
+				fakeProcess(20, 1, "/src", at(10), "claude"),
+				fakeProcess(30, 1, "/src", at(20), "claude", "--session-id", id(3)),
+				fakeProcess(40, 1, "/other", at(0), "claude"),
+			},
+			sessions: map[int]int{1: 15, 2: 25, 3: 30},
+			want: map[int]want{
+				10: {1, "cwd", model.ConfidenceLow},
+				20: {2, "cwd", model.ConfidenceLow},
+				30: {3, "argv", model.ConfidenceHigh},
+				40: {},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_CACHE_HOME", t.TempDir())
+			claudeDir := t.TempDir()
+			useFakePlatform(t, fakePlatform{open: tt.open})
+			for n, mtime := range tt.sessions {
+				writeClaudeTestFile(t, filepath.Join(claudeDir, "projects", "-src", id(n)+".jsonl"), "{}\n", at(mtime))
+			}
+			for name, f := range tt.files {
+				writeClaudeTestFile(t, filepath.Join(claudeDir, name), f.content, at(f.mtime))
+			}
+			var pids []int
+			for _, p := range tt.procs {
+				pids = append(pids, p.PID)
+			}
+
+			matches := matchClaudeSessions(platform.NewSnapshot(tt.procs), claudeDir, pids)
+			for pid, w := range tt.want {
+				m, ok := matches[pid]
+				if w.session == 0 {
+					if ok {
+						t.Errorf("PID %d: matched %s by %s, want no match", pid, m.SessionID, m.Method)
+					}
+					continue
+				}
+				if want := (claudeMatch{id(w.session), w.method, w.confidence}); m != want {
+					t.Errorf("PID %d: got %+v, want %+v", pid, m, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMatchClaudeBySessionsFileFields(t *testing.T) {
+	claudeDir := t.TempDir()
+	started := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	snap := platform.NewSnapshot([]*platform.Process{
+		fakeProcess(10, 1, "/src", started, "claude"),
+		fakeProcess(20, 1, "/src", time.Time{}, "claude"),
+		fakeProcess(30, 1, "/src", started, "claude"),
+	})
+	write := func(pid int, content string) {
+		writeClaudeTestFile(t, filepath.Join(claudeDir, "sessions", strconv.Itoa(pid)+".json"), content, started)
+	}
+	// The start time is only checked when both are known.
+	write(10, fmt.Sprintf(`{"pid":10,"sessionId":%q}`, claudeTestID(1)))
+	write(20, fmt.Sprintf(`{"pid":20,"sessionId":%q,"startedAt":1}`, claudeTestID(2)))
+	// A file naming another PID is ignored.
+	write(30, fmt.Sprintf(`{"pid":31,"sessionId":%q}`, claudeTestID(3)))
+
+	got := matchClaudeBySessionsFile(snap, claudeDir, []int{10, 20, 30}, nil)
+	if len(got) != 2 || got[10].SessionID != claudeTestID(1) || got[20].SessionID != claudeTestID(2) {
+		t.Errorf("got %+v, want PIDs 10 and 20 only", got)
+	}
+}
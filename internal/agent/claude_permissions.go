@@ -0,0 +1,168 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// claudeApprovalDelay is how long a tool call that would prompt must be
+// pending before it can be taken to be awaiting approval: an approved call
+// needs a moment to start its command or write its result.
+const claudeApprovalDelay = 3 * time.Second
+
+// claudeSpawnSlack allows for the clock resolution of process start times
+// when comparing them with transcript timestamps.
+const claudeSpawnSlack = time.Second
+
+// claudeAutoApprovedTools never prompt for permission, so a pending call to
+// one of them means the tool is running rather than awaiting approval.
+var claudeAutoApprovedTools = map[string]bool{
+	"Read": true, "Glob": true, "Grep": true, "LS": true, "NotebookRead": true,
+	"TodoWrite": true, "TodoRead": true, "Task": true, "Agent": true,
+	"ExitPlanMode": true, "BashOutput": true, "KillShell": true,
+}
+
+// claudeEditTools are the tools the acceptEdits permission mode approves
+// without a prompt.
+var claudeEditTools = map[string]bool{
+	"Edit": true, "Write": true, "MultiEdit": true, "NotebookEdit": true,
+}
+
+// claudePermissions is what decides whether a tool call prompts for approval:
+// the session's permission mode and the permissions.allow rules of its
+// settings files.
+type claudePermissions struct {
+	Mode  string
+	Allow []string // e.g. "Bash(npm run test:*)", "WebFetch(domain:go.dev)", "mcp__github"
+}
+
+// loadClaudeAllowRules reads permissions.allow from the user settings in
+// claudeDir and the project settings in projectDir: settings.json and
+// settings.local.json of each. Unreadable files are skipped.
+func loadClaudeAllowRules(claudeDir, projectDir string) []string {
+	var paths []string
+	if claudeDir != "" {
+		paths = append(paths, filepath.Join(claudeDir, "settings.json"), filepath.Join(claudeDir, "settings.local.json"))
+	}
+	if projectDir != "" {
+		dir := filepath.Join(projectDir, ".claude")
+		paths = append(paths, filepath.Join(dir, "settings.json"), filepath.Join(dir, "settings.local.json"))
+	}
+
+	var rules []string
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var settings struct {
+			Permissions struct {
+				Allow []string `json:"allow"`
+			} `json:"permissions"`
+		}
+		if json.Unmarshal(data, &settings) == nil {
+			rules = append(rules, settings.Permissions.Allow...)
+		}
+	}
+	return rules
+}
+
+// allows reports whether a call to tool name with the given input runs
+// without a permission prompt.
+func (p claudePermissions) allows(name string, input json.RawMessage) bool {
+	switch {
+	case p.Mode == "bypassPermissions", claudeAutoApprovedTools[name]:
+		return true
+	case p.Mode == "acceptEdits" && claudeEditTools[name]:
+		return true
+	}
+	for _, rule := range p.Allow {
+		if claudeRuleAllows(rule, name, input) {
+			return true
+		}
+	}
+	return false
+}
+
+// claudeRuleAllows reports whether a permissions.allow rule covers a call.
+// A bare rule names a tool, or an MCP server ("mcp__server") whose tools it
+// all allows. Of the rules with a specifier, Bash command prefixes ("cmd:*")
+// and wildcards, and WebFetch domains ("domain:host") are understood; others
+// are not matched, so the call is taken to prompt.
+func claudeRuleAllows(rule, name string, input json.RawMessage) bool {
+	tool, spec, hasSpec := strings.Cut(rule, "(")
+	if !hasSpec {
+		return tool == name || (strings.HasPrefix(tool, "mcp__") && strings.HasPrefix(name, tool+"__"))
+	}
+	spec, ok := strings.CutSuffix(spec, ")")
+	if !ok || tool != name {
+		return false
+	}
+
+	var in struct {
+		Command string `json:"command"`
+		URL     string `json:"url"`
+	}
+	if json.Unmarshal(input, &in) != nil {
+		return false
+	}
+	switch name {
+	case "Bash":
+		// Compound commands are checked part by part by Claude Code; rather
+		// than parse them, leave them to the delay.
+		if in.Command == "" || strings.ContainsAny(in.Command, ";&|\n`") || strings.Contains(in.Command, "$(") {
+			return false
+		}
+		if prefix, ok := strings.CutSuffix(spec, ":*"); ok {
+			return strings.HasPrefix(in.Command, prefix)
+		}
+		return wildcardRegexp(spec).MatchString(in.Command)
+	case "WebFetch":
+		domain, ok := strings.CutPrefix(spec, "domain:")
+		if !ok {
+			return false
+		}
+		u, err := url.Parse(in.URL)
+		return err == nil && u.Hostname() != "" && u.Hostname() == domain
+	}
+	return false
+}
+
+// claudePromptShown reports whether there is positive evidence that a pending
+// call is held by a permission prompt rather than running. Claude Code writes
+// nothing to the transcript while a prompt is shown, nor progress for most
+// running tools, so the evidence is what an approved call would have done by
+// now: a Bash call starts its command as a process of Claude Code, so a call
+// is waiting while no such process has started since it (spawned holds the
+// start times of the processes under Claude Code); an edit completes at once.
+// Any other tool may run for long without a trace, so it is taken to be
+// running.
+func claudePromptShown(p *claudePendingTool, spawned []time.Time) bool {
+	switch {
+	case p.Name == "Bash":
+		for _, t := range spawned {
+			if !t.Before(p.Started.Add(-claudeSpawnSlack)) {
+				return false
+			}
+		}
+		return true
+	case claudeEditTools[p.Name]:
+		return true
+	}
+	return false
+}
+
+// wildcardRegexp compiles a pattern in which * matches any run of characters
+// and everything else is literal.
+func wildcardRegexp(pattern string) *regexp.Regexp {
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+}
@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestClaudeRuleAllows(t *testing.T) {
+	bash := func(cmd string) json.RawMessage {
+		in, _ := json.Marshal(map[string]string{"command": cmd})
+		return in
+	}
+	fetch := json.RawMessage(`{"url":"https://go.dev/doc/"}`)
+
+	tests := []struct {
+		rule, name string
+		input      json.RawMessage
+		want       bool
+	}{
+		{"Bash", "Bash", bash("rm -rf /"), true},
+		{"Bash(npm run test:*)", "Bash", bash("npm run test:unit"), true},
+		{"Bash(npm run test:*)", "Bash", bash("npm run build"), false},
+		{"Bash(npm run test:*)", "Bash", bash("npm run test && rm -rf /"), false},
+		{"Bash(npm run test:*)", "Bash", bash("npm run test; rm -rf /"), false},
+		{"Bash(npm run test:*)", "Bash", bash("npm run test $(rm -rf /)"), false},
+		{"Bash(git status)", "Bash", bash("git status"), true},
+		{"Bash(git status)", "Bash", bash("git status --short"), false},
+		{"Bash(go * ./...)", "Bash", bash("go test ./..."), true},
+		{"Bash(go * ./...)", "Bash", bash("go test ./internal"), false},
+		{"Bash(npm run test:*)", "Write", bash("npm run test"), false},
+		{"WebFetch(domain:go.dev)", "WebFetch", fetch, true},
+		{"WebFetch(domain:golang.org)", "WebFetch", fetch, false},
+		{"WebFetch(domain:go.dev)", "WebFetch", json.RawMessage(`{"url":"not a url"}`), false},
+		{"WebFetch", "WebFetch", fetch, true},
+		{"mcp__github", "mcp__github__create_issue", nil, true},
+		{"mcp__github", "mcp__gitlab__create_issue", nil, false},
+		{"mcp__github__create_issue", "mcp__github__create_issue", nil, true},
+		{"mcp__github__create_issue", "mcp__github__delete_repo", nil, false},
+		{"Read(./secrets/**)", "Read", json.RawMessage(`{"file_path":"x"}`), false},
+		{"Bash(npm run test:*", "Bash", bash("npm run test"), false},
+	}
+	for _, tt := range tests {
+		if got := claudeRuleAllows(tt.rule, tt.name, tt.input); got != tt.want {
+			t.Errorf("claudeRuleAllows(%q, %q, %s) = %v, want %v", tt.rule, tt.name, tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestClaudePermissionsAllows(t *testing.T) {
+	edit := json.RawMessage(`{"file_path":"main.go"}`)
+	tests := []struct {
+		mode, name string
+		want       bool
+	}{
+		{"default", "Read", true},
+		{"default", "Edit", false},
+		{"default", "Bash", false},
+		{"acceptEdits", "Edit", true},
+		{"acceptEdits", "NotebookEdit", true},
+		{"acceptEdits", "Bash", false},
+		{"bypassPermissions", "Bash", true},
+		{"plan", "Edit", false},
+	}
+	for _, tt := range tests {
+		p := claudePermissions{Mode: tt.mode}
+		if got := p.allows(tt.name, edit); got != tt.want {
+			t.Errorf("mode %s: allows(%s) = %v, want %v", tt.mode, tt.name, got, tt.want)
+		}
+	}
+
+	p := claudePermissions{Mode: "default", Allow: []string{"Edit", "Bash(make:*)"}}
+	if !p.allows("Edit", edit) || !p.allows("Bash", json.RawMessage(`{"command":"make test"}`)) {
+		t.Error("allow rules not applied")
+	}
+}
+
+func TestAwaitingApproval(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	call := func(name string, input string, running bool) *claudePendingTool {
+		return &claudePendingTool{Name: name, Input: json.RawMessage(input), Started: start, Running: running}
+	}
+	bash := `{"command":"make deploy"}`
+	// A shell started by Claude Code before the call, e.g. for an earlier
+	// one, and one started by the call.
+	before, after := []time.Time{start.Add(-time.Minute)}, []time.Time{start.Add(-time.Minute), start.Add(100 * time.Millisecond)}
+
+	tests := []struct {
+		name    string
+		call    *claudePendingTool
+		perms   claudePermissions
+		spawned []time.Time
+		now     time.Time
+		waiting bool
+	}{
+		{"bash not started", call("Bash", bash, false), claudePermissions{}, before, start.Add(claudeApprovalDelay), true},
+		{"bash before the delay", call("Bash", bash, false), claudePermissions{}, before, start.Add(claudeApprovalDelay - time.Millisecond), false},
+		{"bash running", call("Bash", bash, false), claudePermissions{}, after, start.Add(time.Minute), false},
+		{"bash without processes", call("Bash", bash, false), claudePermissions{}, nil, start.Add(time.Minute), true},
+		{"bash allowed", call("Bash", bash, false), claudePermissions{Allow: []string{"Bash(make:*)"}}, nil, start.Add(time.Minute), false},
+		{"bash bypassed", call("Bash", bash, false), claudePermissions{Mode: "bypassPermissions"}, nil, start.Add(time.Minute), false},
+		{"progress", call("Bash", bash, true), claudePermissions{}, nil, start.Add(time.Minute), false},
+		{"edit", call("Edit", `{"file_path":"main.go"}`, false), claudePermissions{}, nil, start.Add(claudeApprovalDelay), true},
+		{"edit accepted", call("Edit", `{"file_path":"main.go"}`, false), claudePermissions{Mode: "acceptEdits"}, nil, start.Add(time.Minute), false},
+		{"web fetch", call("WebFetch", `{"url":"https://go.dev/"}`, false), claudePermissions{}, nil, start.Add(time.Minute), false},
+		{"mcp tool", call("mcp__github__create_issue", `{}`, false), claudePermissions{}, nil, start.Add(time.Minute), false},
+		{"read", call("Read", `{"file_path":"main.go"}`, false), claudePermissions{}, nil, start.Add(time.Minute), false},
+	}
+	for _, tt := range tests {
+		got := awaitingApproval(map[string]*claudePendingTool{"t1": tt.call}, tt.perms, tt.spawned, tt.now)
+		if (got != nil) != tt.waiting {
+			t.Errorf("%s: waiting = %v, want %v", tt.name, got != nil, tt.waiting)
+		}
+	}
+}
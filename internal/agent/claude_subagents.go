@@ -0,0 +1,214 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/model"
+)
+
+// claudeSubagentTools are the tools that spawn a subagent. Older releases
+// call it Task, newer ones Agent.
+var claudeSubagentTools = map[string]bool{"Task": true, "Agent": true}
+
+// claudeSubagent is one subagent invocation seen in the parent's transcript.
+type claudeSubagent struct {
+	ToolUseID   string
+	Description string
+	Type        string // subagent_type; "general-purpose" when not given
+	AgentID     string // from the tool result; names the sidechain transcript
+	Started     time.Time
+	Finished    time.Time // zero while running
+	Background  bool      // launched with run_in_background; its result only confirms the launch
+}
+
+// claudeSubagentInput is the input of a Task/Agent tool_use.
+type claudeSubagentInput struct {
+	Description  string `json:"description"`
+	SubagentType string `json:"subagent_type"`
+}
+
+// claudeSubagentResult is the toolUseResult of a Task/Agent tool_result.
+type claudeSubagentResult struct {
+	Status  string `json:"status"` // "completed" | "async_launched" | ...
+	AgentID string `json:"agentId"`
+}
+
+// claudeSubagents tracks subagent invocations in scan order.
+type claudeSubagents struct {
+	list []*claudeSubagent
+	byID map[string]*claudeSubagent
+	// running holds the agent IDs whose sidechain transcripts have not ended
+	// (see claudeRunningSidechains); nil if there are no transcripts.
+	running map[string]bool
+}
+
+// start records a subagent if b is a call to a subagent tool.
+func (s *claudeSubagents) start(b claudeContentBlock, ts time.Time) {
+	if !claudeSubagentTools[b.Name] {
+		return
+	}
+	var in claudeSubagentInput
+	json.Unmarshal(b.Input, &in)
+	if in.SubagentType == "" {
+		in.SubagentType = "general-purpose"
+	}
+	sa := &claudeSubagent{
+		ToolUseID:   b.ID,
+		Description: in.Description,
+		Type:        in.SubagentType,
+		Started:     ts,
+	}
+	if s.byID == nil {
+		s.byID = make(map[string]*claudeSubagent)
+	}
+	s.byID[b.ID] = sa
+	s.list = append(s.list, sa)
+}
+
+// finish records the tool result of a subagent call. A background launch
+// stays running; its transcript tells when it ends.
+func (s *claudeSubagents) finish(toolUseID string, raw json.RawMessage, ts time.Time) {
+	sa := s.byID[toolUseID]
+	if sa == nil {
+		return
+	}
+	var res claudeSubagentResult
+	json.Unmarshal(raw, &res) // toolUseResult may also be a plain string
+	sa.AgentID = res.AgentID
+	if res.Status == "async_launched" {
+		sa.Background = true
+		return
+	}
+	sa.Finished = ts
+}
+
+// endTurn forgets subagents that finished in the turn that just ended,
+// including background ones whose transcript has ended.
+func (s *claudeSubagents) endTurn() {
+	kept := s.list[:0]
+	for _, sa := range s.list {
+		done := !sa.Finished.IsZero() || (sa.Background && s.running != nil && !s.running[sa.AgentID])
+		if !done {
+			kept = append(kept, sa)
+		} else {
+			delete(s.byID, sa.ToolUseID)
+		}
+	}
+	clear(s.list[len(kept):])
+	s.list = kept
+}
+
+// claudeSubagentSessions converts the subagents of a session into child
+// sessions of the process pid. Background subagents are checked against
+// their sidechain transcript, {session}/subagents/agent-{agentId}.jsonl,
+// which newer releases write next to the session JSONL.
+func claudeSubagentSessions(jsonlPath string, subagents []*claudeSubagent, pid int, dir string) []model.AgentSession {
+	var children []model.AgentSession
+	for _, sa := range subagents {
+		child := model.AgentSession{
+			Agent:        "claude",
+			Status:       model.StatusBusy,
+			SessionID:    sa.AgentID,
+			Title:        sa.Description,
+			Directory:    dir,
+			PID:          pid,
+			StartedAt:    sa.Started,
+			StatusSince:  sa.Started,
+			SubagentType: sa.Type,
+		}
+		if sa.AgentID != "" {
+			transcript := filepath.Join(strings.TrimSuffix(jsonlPath, ".jsonl"), "subagents", "agent-"+sa.AgentID+".jsonl")
+			if fi, err := os.Stat(transcript); err == nil {
+				child.LastActivityAt = fi.ModTime()
+				if sa.Background && claudeSidechainDone(transcript) {
+					sa.Finished = fi.ModTime()
+				}
+			}
+		}
+		if !sa.Finished.IsZero() {
+			child.Status = model.StatusIdle
+			child.StatusSince = sa.Finished
+		}
+		children = append(children, child)
+	}
+	return children
+}
+
+// claudeRunningSidechains returns the agent IDs of the subagent transcripts
+// of a session that have not ended, and when the earliest of them started
+// (its first entry's timestamp). A background subagent may have been launched
+// in an earlier turn, so readClaudeStatus reads back to that time.
+func claudeRunningSidechains(jsonlPath string) (map[string]bool, time.Time) {
+	dir := filepath.Join(strings.TrimSuffix(jsonlPath, ".jsonl"), "subagents")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, time.Time{}
+	}
+	running := make(map[string]bool)
+	var earliest time.Time
+	for _, e := range entries {
+		name, ok := strings.CutPrefix(e.Name(), "agent-")
+		if !ok || e.IsDir() {
+			continue
+		}
+		id, ok := strings.CutSuffix(name, ".jsonl")
+		if !ok {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		if claudeSidechainDone(path) {
+			continue
+		}
+		running[id] = true
+		if t := claudeFirstTimestamp(path); !t.IsZero() && (earliest.IsZero() || t.Before(earliest)) {
+			earliest = t
+		}
+	}
+	return running, earliest
+}
+
+// claudeFirstTimestamp returns the timestamp of the first entry of a JSONL,
+// or the zero time if it has none.
+func claudeFirstTimestamp(path string) time.Time {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}
+	}
+	defer f.Close()
+	var entry struct {
+		Timestamp string `json:"timestamp"`
+	}
+	if json.NewDecoder(f).Decode(&entry) != nil {
+		return time.Time{}
+	}
+	return parseTimestamp(entry.Timestamp)
+}
+
+// claudeSidechainDone reports whether a subagent transcript ends with a final
+// answer: an assistant entry that stopped with end_turn.
+func claudeSidechainDone(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	var last claudeJSONLEntry
+	scanJSONLBackward(f, fi.Size(), func(line []byte, _ int64) bool {
+		var entry claudeJSONLEntry
+		if json.Unmarshal(line, &entry) == nil && (entry.Type == "assistant" || entry.Type == "user") {
+			last = entry
+			return false
+		}
+		return true
+	})
+	return last.Type == "assistant" && last.Message.StopReason == "end_turn"
+}
@@ -0,0 +1,200 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/model"
+)
+
+// claudeLine renders one session JSONL entry at the given second after a
+// fixed start.
+func claudeLine(sec int, typ, rest string) string {
+	ts := time.Date(2026, 3, 1, 12, 0, sec, 0, time.UTC).Format(time.RFC3339)
+	if rest != "" {
+		rest = "," + rest
+	}
+	return fmt.Sprintf(`{"type":%q,"timestamp":%q%s}`, typ, ts, rest)
+}
+
+// claudeTaskCall is an assistant entry calling the Task tool.
+func claudeTaskCall(sec int, id, description string) string {
+	return claudeLine(sec, "assistant", fmt.Sprintf(`"message":{"content":[{"type":"tool_use","id":%q,"name":"Task","input":{"description":%q}}]}`, id, description))
+}
+
+// claudeTaskResult is the user entry carrying the result of a Task call.
+func claudeTaskResult(sec int, id, result string) string {
+	return claudeLine(sec, "user", fmt.Sprintf(`"message":{"content":[{"type":"tool_result","tool_use_id":%q}]},"toolUseResult":%s`, id, result))
+}
+
+// claudeTurnEnd is the turn_duration entry that ends a turn.
+func claudeTurnEnd(sec int) string {
+	return claudeLine(sec, "system", `"subtype":"turn_duration"`)
+}
+
+func TestClaudeSubagentsScan(t *testing.T) {
+	at := func(sec int) time.Time { return time.Date(2026, 3, 1, 12, 0, sec, 0, time.UTC) }
+	launched := `{"status":"async_launched","agentId":"bg1"}`
+	tests := []struct {
+		name    string
+		lines   []string
+		running map[string]bool
+		want    []claudeSubagent
+	}{
+		{"running", []string{
+			claudeTaskCall(1, "t1", "explore"),
+		}, nil, []claudeSubagent{{ToolUseID: "t1", Description: "explore", Type: "general-purpose", Started: at(1)}}},
+		{"finished within the turn", []string{
+			claudeTaskCall(1, "t1", "explore"),
+			claudeTaskResult(5, "t1", `{"status":"completed","agentId":"a1"}`),
+			claudeLine(6, "assistant", `"message":{"content":[{"type":"text","text":"done"}]}`),
+		}, nil, []claudeSubagent{{ToolUseID: "t1", Description: "explore", Type: "general-purpose", AgentID: "a1", Started: at(1), Finished: at(5)}}},
+		{"pruned at turn end", []string{
+			claudeTaskCall(1, "t1", "explore"),
+			claudeTaskResult(5, "t1", `"plain text result"`),
+			claudeTurnEnd(6),
+		}, nil, nil},
+		{"background subagent still running", []string{
+			claudeTaskCall(1, "t1", "watch"),
+			claudeTaskResult(2, "t1", launched),
+			claudeTurnEnd(3),
+		}, map[string]bool{"bg1": true}, []claudeSubagent{{ToolUseID: "t1", Description: "watch", Type: "general-purpose", AgentID: "bg1", Started: at(1), Background: true}}},
+		{"background subagent ended", []string{
+			claudeTaskCall(1, "t1", "watch"),
+			claudeTaskResult(2, "t1", launched),
+			claudeTurnEnd(3),
+		}, map[string]bool{"other": true}, nil},
+		// Without transcripts to check against, it is kept.
+		{"background subagent without transcripts", []string{
+			claudeTaskCall(1, "t1", "watch"),
+			claudeTaskResult(2, "t1", launched),
+			claudeTurnEnd(3),
+		}, nil, []claudeSubagent{{ToolUseID: "t1", Description: "watch", Type: "general-purpose", AgentID: "bg1", Started: at(1), Background: true}}},
+		{"sidechain entries are not calls of the session", []string{
+			claudeLine(1, "assistant", `"isSidechain":true,"message":{"content":[{"type":"tool_use","id":"t1","name":"Task","input":{}}]}`),
+		}, nil, nil},
+		{"subagent type", []string{
+			claudeLine(1, "assistant", `"message":{"content":[{"type":"tool_use","id":"t1","name":"Agent","input":{"description":"review","subagent_type":"code-reviewer"}}]}`),
+		}, nil, []claudeSubagent{{ToolUseID: "t1", Description: "review", Type: "code-reviewer", Started: at(1)}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := strings.NewReader(strings.Join(tt.lines, "\n") + "\n")
+			st := scanClaudeJSONL(r, false, claudePermissions{}, tt.running, nil)
+			if len(st.Subagents) != len(tt.want) {
+				t.Fatalf("got %d subagents, want %d", len(st.Subagents), len(tt.want))
+			}
+			for i, sa := range st.Subagents {
+				if *sa != tt.want[i] {
+					t.Errorf("subagent %d: got %+v, want %+v", i, *sa, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestClaudeSubagentSessions(t *testing.T) {
+	at := func(sec int) time.Time { return time.Date(2026, 3, 1, 12, 0, sec, 0, time.UTC) }
+	dir := t.TempDir()
+	jsonlPath := filepath.Join(dir, "session.jsonl")
+	transcript := func(agentID string, mtime time.Time, lines ...string) {
+		writeClaudeTestFile(t, filepath.Join(dir, "session", "subagents", "agent-"+agentID+".jsonl"), strings.Join(lines, "\n")+"\n", mtime)
+	}
+	transcript("fg", at(30), claudeLine(1, "user", `"message":{"content":"go"}`))
+	transcript("bg-done", at(40), claudeLine(1, "assistant", `"message":{"content":"done","stop_reason":"end_turn"}`))
+	transcript("bg-busy", at(50), claudeLine(1, "assistant", `"message":{"content":[],"stop_reason":"tool_use"}`))
+
+	subagents := []*claudeSubagent{
+		{ToolUseID: "t1", Description: "explore", Type: "general-purpose", AgentID: "fg", Started: at(1), Finished: at(35)},
+		{ToolUseID: "t2", Description: "watch", Type: "general-purpose", AgentID: "bg-done", Started: at(2), Background: true},
+		{ToolUseID: "t3", Description: "build", Type: "general-purpose", AgentID: "bg-busy", Started: at(3), Background: true},
+		{ToolUseID: "t4", Description: "plan", Type: "Plan", Started: at(4)},
+	}
+	children := claudeSubagentSessions(jsonlPath, subagents, 42, "/src")
+
+	type want struct {
+		status       string
+		since, last  time.Time
+		subagentType string
+	}
+	wants := []want{
+		{model.StatusIdle, at(35), at(30), "general-purpose"},
+		{model.StatusIdle, at(40), at(40), "general-purpose"},
+		{model.StatusBusy, at(3), at(50), "general-purpose"},
+		{model.StatusBusy, at(4), time.Time{}, "Plan"},
+	}
+	if len(children) != len(wants) {
+		t.Fatalf("got %d children, want %d", len(children), len(wants))
+	}
+	for i, c := range children {
+		w := wants[i]
+		if c.Status != w.status || !c.StatusSince.Equal(w.since) || !c.LastActivityAt.Equal(w.last) || c.SubagentType != w.subagentType {
+			t.Errorf("child %d: status %q since %v last activity %v type %q, want %+v", i, c.Status, c.StatusSince, c.LastActivityAt, c.SubagentType, w)
+		}
+		if c.PID != 42 || c.Directory != "/src" || c.Title != subagents[i].Description || c.SessionID != subagents[i].AgentID {
+			t.Errorf("child %d: %+v", i, c)
+		}
+	}
+}
+
+func TestClaudeRunningSidechains(t *testing.T) {
+	at := func(sec int) time.Time { return time.Date(2026, 3, 1, 12, 0, sec, 0, time.UTC) }
+	dir := t.TempDir()
+	jsonlPath := filepath.Join(dir, "session.jsonl")
+	sub := filepath.Join(dir, "session", "subagents")
+	write := func(name string, lines ...string) {
+		writeClaudeTestFile(t, filepath.Join(sub, name), strings.Join(lines, "\n")+"\n", at(60))
+	}
+	write("agent-done.jsonl", claudeLine(1, "user", `"message":{"content":"go"}`),
+		claudeLine(2, "assistant", `"message":{"content":"ok","stop_reason":"end_turn"}`))
+	write("agent-late.jsonl", claudeLine(20, "user", `"message":{"content":"go"}`))
+	write("agent-early.jsonl", claudeLine(10, "user", `"message":{"content":"go"}`),
+		claudeLine(11, "assistant", `"message":{"content":[],"stop_reason":"tool_use"}`))
+	write("notes.txt", "not a transcript")
+
+	running, earliest := claudeRunningSidechains(jsonlPath)
+	if len(running) != 2 || !running["late"] || !running["early"] {
+		t.Errorf("running %v, want late and early", running)
+	}
+	if !earliest.Equal(at(10)) {
+		t.Errorf("earliest %v, want %v", earliest, at(10))
+	}
+
+	if running, _ := claudeRunningSidechains(filepath.Join(dir, "other.jsonl")); running != nil {
+		t.Errorf("running %v for a session without transcripts, want nil", running)
+	}
+}
+
+// TestReadClaudeStatusBackgroundSubagent checks that a background subagent
+// launched in an earlier turn is still reported while its transcript runs.
+func TestReadClaudeStatusBackgroundSubagent(t *testing.T) {
+	dir := t.TempDir()
+	jsonlPath := filepath.Join(dir, "projects", "-src", "session.jsonl")
+	lines := []string{
+		claudeLine(1, "user", `"cwd":"/src","message":{"content":"start"}`),
+		claudeTaskCall(2, "t1", "watch"),
+		claudeTaskResult(3, "t1", `{"status":"async_launched","agentId":"bg1"}`),
+		claudeTurnEnd(4),
+		claudeLine(5, "user", `"cwd":"/src","message":{"content":"next"}`),
+		claudeLine(6, "assistant", `"message":{"content":"ok","stop_reason":"end_turn"}`),
+		claudeTurnEnd(7),
+	}
+	writeClaudeTestFile(t, jsonlPath, strings.Join(lines, "\n")+"\n", time.Now())
+	transcript := filepath.Join(dir, "projects", "-src", "session", "subagents", "agent-bg1.jsonl")
+	writeClaudeTestFile(t, transcript, claudeLine(3, "user", `"message":{"content":"watch"}`)+"\n", time.Now())
+
+	st := readClaudeStatus(jsonlPath, "", nil)
+	if st.Status != model.StatusIdle || len(st.Subagents) != 1 || st.Subagents[0].AgentID != "bg1" {
+		t.Fatalf("status %q subagents %+v, want idle with bg1", st.Status, st.Subagents)
+	}
+
+	// Once its transcript ends, it is no longer reported.
+	os.WriteFile(transcript, []byte(claudeLine(8, "assistant", `"message":{"content":"done","stop_reason":"end_turn"}`)+"\n"), 0o644)
+	if st := readClaudeStatus(jsonlPath, "", nil); len(st.Subagents) != 0 {
+		t.Errorf("subagents %+v after the transcript ended, want none", st.Subagents)
+	}
+}
@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/model"
+)
+
+// claudeUsageCacheVersion is bumped whenever the layout or meaning of
+// claudeUsageState changes; a cache with another version is discarded.
+const claudeUsageCacheVersion = 2
+
+// claudeUsageState is the usage read so far from a session JSONL, kept in a
+// lineCache so that each run only parses appended entries. A response split
+// over several entries repeats its message ID in consecutive entries, the last
+// of which holds its usage, so only the latest response is kept apart from the
+// total.
+type claudeUsageState struct {
+	Model       string      `json:"model,omitempty"`
+	Context     int64       `json:"context,omitempty"`
+	Compactions int         `json:"compactions,omitempty"`
+	Usage       model.Usage `json:"usage"`             // responses before the latest
+	LastID      string      `json:"last_id,omitempty"` // message ID of the latest response
+	Last        model.Usage `json:"last"`              // usage of the latest response
+}
+
+// loadClaudeUsageCache reads the usage cache, claude-usage.json.
+func loadClaudeUsageCache() *lineCache[claudeUsageState] {
+	return loadLineCache[claudeUsageState]("claude-usage.json", claudeUsageCacheVersion)
+}
+
+// readClaudeUsage sums the usage of the assistant responses of a session
+// JSONL, counting each message ID once. It also returns the model and context
+// size of the latest response, and counts compactions. A compaction after the
+// latest response leaves the context size unknown. Only the entries appended
+// since the state cached for the file are parsed; cache may be nil.
+func readClaudeUsage(jsonlPath string, cache *lineCache[claudeUsageState]) claudeUsageInfo {
+	st, _ := cache.read(jsonlPath, (*claudeUsageState).add)
+	return st.info()
+}
+
+// add accounts for one line of a session JSONL.
+func (st *claudeUsageState) add(line []byte) {
+	if !bytes.Contains(line, []byte(`"usage"`)) && !bytes.Contains(line, []byte(`"compact_boundary"`)) {
+		return
+	}
+	var entry claudeUsageEntry
+	if json.Unmarshal(line, &entry) != nil {
+		return
+	}
+	switch {
+	case entry.Type == "assistant" && entry.Message.ID != "":
+		u := entry.Message.Usage.toModel()
+		if entry.Message.ID != st.LastID {
+			st.Usage.Add(st.Last)
+			st.LastID = entry.Message.ID
+		}
+		st.Last = u
+		st.Context = u.Total()
+		// Synthetic entries (local errors, interrupts) name no real model.
+		if m := entry.Message.Model; m != "" && m != "<synthetic>" {
+			st.Model = m
+		}
+	case entry.Type == "system" && entry.Subtype == "compact_boundary":
+		st.Compactions++
+		st.Context = 0
+	}
+}
+
+// info returns the usage summed over the responses read so far.
+func (st *claudeUsageState) info() claudeUsageInfo {
+	info := claudeUsageInfo{Model: st.Model, Context: st.Context, Compactions: st.Compactions, Usage: st.Usage}
+	info.Usage.Add(st.Last)
+	return info
+}
@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/model"
+)
+
+func TestReadClaudeUsage(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	path := filepath.Join(t.TempDir(), "session.jsonl")
+	write := func(lines ...string) {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range lines {
+			f.WriteString(l + "\n")
+		}
+		f.Close()
+	}
+	cache := loadClaudeUsageCache()
+
+	// A response split over two entries, a tool result and another response.
+	write(
+		`{"type":"assistant","message":{"id":"m1","model":"claude-a","usage":{"input_tokens":10,"output_tokens":1}}}`,
+		`{"type":"assistant","message":{"id":"m1","model":"claude-a","usage":{"input_tokens":10,"output_tokens":5}}}`,
+		`{"type":"user","message":{"content":[{"type":"tool_result"}]}}`,
+		`{"type":"assistant","message":{"id":"m2","model":"claude-a","usage":{"input_tokens":20,"output_tokens":2,"cache_read_input_tokens":100}}}`,
+	)
+	got := readClaudeUsage(path, cache)
+	want := claudeUsageInfo{
+		Model:   "claude-a",
+		Context: 122,
+		Usage:   model.Usage{InputTokens: 30, OutputTokens: 7, CacheReadTokens: 100},
+	}
+	if got != want {
+		t.Fatalf("first read: got %+v, want %+v", got, want)
+	}
+
+	// The latest response continues in appended entries, then a compaction
+	// and a synthetic entry follow.
+	write(
+		`{"type":"assistant","message":{"id":"m2","model":"claude-a","usage":{"input_tokens":20,"output_tokens":4,"cache_read_input_tokens":100}}}`,
+		`{"type":"system","subtype":"compact_boundary"}`,
+		`{"type":"assistant","message":{"id":"m3","model":"<synthetic>","usage":{}}}`,
+	)
+	got = readClaudeUsage(path, cache)
+	want = claudeUsageInfo{
+		Model:       "claude-a",
+		Compactions: 1,
+		Usage:       model.Usage{InputTokens: 30, OutputTokens: 9, CacheReadTokens: 100},
+	}
+	if got != want {
+		t.Fatalf("appended read: got %+v, want %+v", got, want)
+	}
+
+	// A saved cache gives the same totals; a fresh read of the whole file too.
+	cache.save()
+	if got := readClaudeUsage(path, loadClaudeUsageCache()); got != want {
+		t.Errorf("cached read: got %+v, want %+v", got, want)
+	}
+	if got := readClaudeUsage(path, nil); got != want {
+		t.Errorf("uncached read: got %+v, want %+v", got, want)
+	}
+}
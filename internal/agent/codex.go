@@ -1,152 +1,491 @@
 package agent
 
 import (
-	"bufio"
-	"database/sql"
+	"bytes"
 	"encoding/json"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/Eric-Song-Nop/agentstat/internal/model"
 	"github.com/Eric-Song-Nop/agentstat/internal/platform"
-
-	_ "modernc.org/sqlite"
 )
 
 // rolloutPayload represents the relevant fields from a rollout JSONL line.
 type rolloutPayload struct {
-	Payload struct {
-		Type string `json:"type"`
+	Timestamp string `json:"timestamp"`
+	Type      string `json:"type"` // "session_meta" | "turn_context" | "event_msg" | "response_item" | ...
+	Payload   struct {
+		Type  string          `json:"type"`
+		Model string          `json:"model"` // turn_context
+		Info  *codexTokenInfo `json:"info"`  // event_msg token_count; null before the first response
+
+		// Tool calls and their results, paired by CallID.
+		CallID    string          `json:"call_id"`
+		Command   json.RawMessage `json:"command"`   // exec_command_begin, exec_approval_request: argv
+		Name      string          `json:"name"`      // response_item function_call, custom_tool_call
+		Arguments string          `json:"arguments"` // response_item function_call: a JSON object
+		Action    *struct {
+			Command json.RawMessage `json:"command"`
+		} `json:"action"` // response_item local_shell_call
+		Invocation *struct {
+			Server string `json:"server"`
+			Tool   string `json:"tool"`
+		} `json:"invocation"` // mcp_tool_call_begin
 	} `json:"payload"`
 }
 
-// codexThreadInfo holds metadata fetched from the Codex SQLite database.
-type codexThreadInfo struct {
-	Title       string
-	RolloutPath string
-	CWD         string
+// codexTokenInfo is the info of a token_count event.
+type codexTokenInfo struct {
+	TotalTokenUsage    codexTokenUsage `json:"total_token_usage"`
+	LastTokenUsage     codexTokenUsage `json:"last_token_usage"`
+	ModelContextWindow int64           `json:"model_context_window"`
+}
+
+// codexTokenUsage counts tokens as the OpenAI API does: input includes cached
+// input, and output includes reasoning.
+type codexTokenUsage struct {
+	InputTokens       int64 `json:"input_tokens"`
+	CachedInputTokens int64 `json:"cached_input_tokens"`
+	OutputTokens      int64 `json:"output_tokens"`
+	TotalTokens       int64 `json:"total_tokens"`
+}
+
+// toModel converts Codex token counts to the model representation.
+func (u codexTokenUsage) toModel() model.Usage {
+	return model.Usage{
+		InputTokens:     u.InputTokens - u.CachedInputTokens,
+		OutputTokens:    u.OutputTokens,
+		CacheReadTokens: u.CachedInputTokens,
+	}
+}
+
+// rolloutInfo is the state readRolloutStatus extracts from a rollout file.
+type rolloutInfo struct {
+	Status        string
+	Since         time.Time // when the current status began; zero if unknown
+	Model         string
+	Usage         model.Usage
+	Context       int64 // context size of the latest response; 0 if unknown
+	ContextWindow int64 // as reported by Codex; 0 if not reported
+	Compacting    bool
+	Activity      string // the tool call in progress, if any
 }
 
 // DiscoverCodex finds all running Codex processes and determines their status.
-func DiscoverCodex() []model.AgentSession {
-	pids := findCodexPIDs()
+// A process yields one session per rollout file it has open: the TUI has one,
+// an app-server can have one per thread.
+func DiscoverCodex(snap *platform.Snapshot) []model.AgentSession {
+	pids := findCodexPIDs(snap)
 	if len(pids) == 0 {
 		return nil
 	}
-	return ConcurrentProbe(pids, probeCodexPID)
+	// Open each Codex home's state database once for all its processes.
+	dbs := make(map[int]*codexStateDB, len(pids))
+	for home, group := range groupByDir(snap, pids, (*procEnv).codexHome) {
+		db := openCodexStateDB(home)
+		defer db.close()
+		for _, pid := range group {
+			dbs[pid] = db
+		}
+	}
+
+	compactions := loadCodexCompactionsCache()
+	sessions := withProcessInfo(snap, ConcurrentProbeAll(pids, func(pid int) []model.AgentSession {
+		return probeCodexPID(snap, pid, dbs[pid], compactions)
+	}))
+	compactions.save()
+	return sessions
+}
+
+// loadCodexCompactionsCache reads the cache of the compactions counted in
+// each rollout, codex-compactions.json.
+func loadCodexCompactionsCache() *lineCache[int] {
+	return loadLineCache[int]("codex-compactions.json", 1)
 }
 
-// findCodexPIDs returns PIDs of processes whose binary path ends with "codex/codex".
-func findCodexPIDs() []int {
-	re := regexp.MustCompile(`codex/codex$`)
-	return platform.P.FindPIDsByName(re)
+// findCodexPIDs returns PIDs of processes whose binary is "codex". This is
+// the native binary: npm installs start it from a node wrapper whose argv[0]
+// is "node", and the wrapper itself never opens a rollout.
+func findCodexPIDs(snap *platform.Snapshot) []int {
+	return filterOwnPIDs(snap, snap.FindByName(processRegexp("codex")))
 }
 
-// probeCodexPID examines a single Codex process and returns its session info.
-// Strategy: find open rollout file via platform API, then enrich with DB metadata.
-func probeCodexPID(pid int) *model.AgentSession {
-	rolloutPath, threadID := findRolloutFile(pid)
-	if rolloutPath == "" {
+// codexValueFlags are the global Codex options that take a separate value,
+// which must be skipped when looking for the subcommand.
+var codexValueFlags = map[string]bool{
+	"-c": true, "--config": true,
+	"-m": true, "--model": true,
+	"-p": true, "--profile": true,
+	"-C": true, "--cd": true,
+	"-i": true, "--image": true,
+	"-s": true, "--sandbox": true,
+	"-a": true, "--ask-for-approval": true,
+	"--enable": true, "--disable": true,
+	"--add-dir": true, "--local-provider": true,
+}
+
+// codexMode derives how a Codex process runs from its subcommand. Without
+// one, or with a prompt or resume/fork, it is the interactive TUI.
+func codexMode(argv []string) string {
+	for i := 1; i < len(argv); i++ {
+		arg := argv[i]
+		if strings.HasPrefix(arg, "-") {
+			if codexValueFlags[arg] {
+				i++
+			}
+			continue
+		}
+		switch arg {
+		case "exec", "e":
+			return model.ModeExec
+		case "app-server":
+			return model.ModeAppServer
+		case "mcp-server":
+			return model.ModeMCPServer
+		}
+		return model.ModeTUI
+	}
+	return model.ModeTUI
+}
+
+// probeCodexPID examines a single Codex process and returns one session per
+// open rollout, most recently active first.
+// Strategy: find open rollout files via platform API, then enrich with DB metadata.
+func probeCodexPID(snap *platform.Snapshot, pid int, db *codexStateDB, compactions *lineCache[int]) []model.AgentSession {
+	rollouts := findRolloutFiles(pid)
+	if len(rollouts) == 0 {
 		return nil
 	}
 
-	status := readRolloutStatus(rolloutPath)
-	cwd := platform.P.ReadProcessCwd(pid)
-	title := "-"
+	// Open file paths are as seen by the process (inside its container, if any).
+	pe := newProcEnv(snap, pid)
+	mode := model.ModeTUI
+	if p := snap.Get(pid); p != nil {
+		mode = codexMode(p.Argv)
+	}
+
+	sessions := make([]model.AgentSession, 0, len(rollouts))
+	for _, r := range rollouts {
+		s := probeCodexRollout(snap, pe, pid, r, db, compactions)
+		s.Mode = mode
+		sessions = append(sessions, s)
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].LastActivityAt.After(sessions[j].LastActivityAt)
+	})
+	return sessions
+}
+
+// probeCodexRollout reads the session of one rollout file of pid.
+func probeCodexRollout(snap *platform.Snapshot, pe *procEnv, pid int, r codexRollout, db *codexStateDB, compactions *lineCache[int]) model.AgentSession {
+	s := model.AgentSession{
+		Agent:     "codex",
+		SessionID: r.ThreadID,
+		Title:     "-",
+		Directory: snap.Cwd(pid),
+		PID:       pid,
+	}
+	if !readCodexRollout(&s, pe.hostPath(r.Path), compactions) {
+		s.Status = model.StatusUnknown
+	}
 
 	// Enrich from DB — title and cwd (DB cwd is the original launch dir).
-	if info := lookupCodexThread(threadID); info != nil {
-		title = info.Title
+	if info := db.lookup(r.ThreadID); info != nil {
+		if info.Title != "" {
+			s.Title = info.Title
+		}
 		if info.CWD != "" {
-			cwd = info.CWD
+			s.Directory = info.CWD
+		}
+		if s.Model == "" {
+			s.Model = info.Model
+		}
+		s.Branch = info.GitBranch
+		s.Archived = info.Archived
+		s.CreatedAt = info.CreatedAt
+		if info.UpdatedAt.After(s.LastActivityAt) {
+			s.LastActivityAt = info.UpdatedAt
 		}
 	}
 
-	return &model.AgentSession{
-		Agent:     "codex",
-		Status:    status,
-		SessionID: threadID,
-		Title:     title,
-		Directory: cwd,
-		PID:       pid,
+	if s.ContextWindow == 0 {
+		s.ContextWindow = contextWindow(s.Model)
 	}
+	return s
 }
 
-// findRolloutFile inspects open files of a process for a rollout JSONL file.
-// Returns the file path and extracted thread ID (UUID).
-func findRolloutFile(pid int) (path string, threadID string) {
-	files := platform.P.ListOpenFiles(pid)
+// readCodexRollout fills in the fields of s recorded in its rollout file, at
+// host path: status, activity, usage and context. It reports false if the
+// file cannot be read. The model and context window are only set if the
+// rollout records them, and LastActivityAt only moves forward.
+func readCodexRollout(s *model.AgentSession, path string, compactions *lineCache[int]) bool {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	ro := readRolloutStatus(path)
+	compacted, _ := compactions.read(path, countCompacted)
 
-	// Filename: rollout-2026-02-26T23-51-07-019c9aa5-8f55-7833-b235-d00a5faa09d0.jsonl
-	// Extract the trailing UUID (8-4-4-4-12 hex).
-	re := regexp.MustCompile(`rollout.*?([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})\.jsonl$`)
+	s.Path = path
+	s.Status = ro.Status
+	s.Activity = ro.Activity
+	s.StatusSince = ro.Since
+	s.Usage = ro.Usage
+	s.ContextTokens = ro.Context
+	s.Compacting = ro.Compacting
+	s.Compactions = compacted
+	if ro.Model != "" {
+		s.Model = ro.Model
+	}
+	if ro.ContextWindow != 0 {
+		s.ContextWindow = ro.ContextWindow
+	}
+	if fi.ModTime().After(s.LastActivityAt) {
+		s.LastActivityAt = fi.ModTime()
+	}
+	return true
+}
+
+// codexRollout is a rollout file open in a Codex process.
+type codexRollout struct {
+	Path     string // as seen by the process
+	ThreadID string // UUID
+}
 
-	for _, f := range files {
-		matches := re.FindStringSubmatch(f)
-		if len(matches) >= 2 {
-			return f, matches[1]
+// rolloutFileRe matches a rollout file name and captures its thread ID, e.g.
+// rollout-2026-02-26T23-51-07-019c9aa5-8f55-7833-b235-d00a5faa09d0.jsonl.
+var rolloutFileRe = regexp.MustCompile(`rollout.*?([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})\.jsonl$`)
+
+// findRolloutFiles inspects open files of a process for rollout JSONL files,
+// one per thread.
+func findRolloutFiles(pid int) []codexRollout {
+	var rollouts []codexRollout
+	seen := make(map[string]bool)
+	for _, f := range platform.P.ListOpenFiles(pid) {
+		if m := rolloutFileRe.FindStringSubmatch(f); m != nil && !seen[m[1]] {
+			seen[m[1]] = true
+			rollouts = append(rollouts, codexRollout{Path: f, ThreadID: m[1]})
 		}
 	}
-	return "", ""
+	return rollouts
 }
 
-// readRolloutStatus reads the last line of a rollout JSONL file and extracts the status.
-func readRolloutStatus(path string) string {
+// rolloutMetaWindow is how far from the end of a rollout readRolloutStatus
+// looks for the model and usage once the status is known.
+const rolloutMetaWindow = 1 << 20
+
+// readRolloutStatus reads a rollout JSONL file backwards and extracts the
+// status of the session from the latest event that decides it:
+//
+//   - task_complete, turn_aborted and shutdown_complete: idle;
+//   - error: error;
+//   - an approval request whose call has no result yet: waiting;
+//   - task_started or user_message: busy, since then.
+//
+// Other entries (messages, reasoning, token counts) leave the status as it
+// was. Reaching the session_meta at the start of the rollout without any of
+// these, as in a new session, means idle. While busy, the latest tool call that has begun but
+// has no result yet is the activity; while waiting, the call to approve.
+//
+// Model comes from the latest turn_context and usage from the latest
+// token_count event, whose totals are cumulative for the session. Both are
+// written every turn, so once the status is found they are only looked for in
+// the last rolloutMetaWindow bytes: a rollout without them is not read back
+// to its start on every run. A compacted item after the latest token_count
+// leaves the context size unknown.
+func readRolloutStatus(path string) rolloutInfo {
+	unknown := rolloutInfo{Status: model.StatusUnknown}
 	f, err := os.Open(path)
 	if err != nil {
-		return model.StatusUnknown
+		return unknown
 	}
 	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return unknown
+	}
 
-	var lastLine string
-	scanner := bufio.NewScanner(f)
-	scanner.Buffer(make([]byte, 0, 256*1024), 1024*1024)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.TrimSpace(line) != "" {
-			lastLine = line
+	var info rolloutInfo
+	var last *rolloutPayload
+	var haveUsage, compactedSince bool
+	calls := make(map[string]string) // call ID -> state after the current line: "begun" or "finished"
+	err = scanJSONLBackward(f, fi.Size(), func(line []byte, offset int64) bool {
+		var payload rolloutPayload
+		if err := json.Unmarshal(line, &payload); err != nil {
+			// An unparsable last line leaves the status unknown.
+			return last != nil
+		}
+		if last == nil {
+			last = &payload
 		}
+
+		switch {
+		case payload.Type == "turn_context" && payload.Payload.Model != "" && info.Model == "":
+			info.Model = payload.Payload.Model
+		case payload.Payload.Type == "token_count" && payload.Payload.Info != nil && !haveUsage:
+			tokens := payload.Payload.Info
+			haveUsage = true
+			info.Usage = tokens.TotalTokenUsage.toModel()
+			info.ContextWindow = tokens.ModelContextWindow
+			if !compactedSince {
+				info.Context = tokens.LastTokenUsage.TotalTokens
+			}
+		case payload.Type == "compacted" && !haveUsage:
+			compactedSince = true
+		}
+		if info.Status == "" {
+			applyRolloutEvent(&info, &payload, calls)
+		}
+		if info.Status == "" {
+			return true
+		}
+		return (info.Model == "" || !haveUsage) && fi.Size()-offset <= rolloutMetaWindow
+	})
+	if err != nil || last == nil {
+		return unknown
 	}
 
-	if lastLine == "" {
-		return model.StatusUnknown
+	switch info.Status {
+	case "":
+		// No turn was started, or the events that tell were not recorded:
+		// a tool call without a result still shows one is running.
+		info.Status = model.StatusIdle
+		if info.Activity != "" {
+			info.Status = model.StatusBusy
+		}
+	case model.StatusBusy:
+		info.Compacting = last.Type == "compacted" || last.Payload.Type == "context_compacted"
+	case model.StatusIdle, model.StatusError:
+		info.Activity = ""
 	}
+	info.Activity = firstLine(info.Activity)
+	return info
+}
 
-	var payload rolloutPayload
-	if err := json.Unmarshal([]byte(lastLine), &payload); err != nil {
-		return model.StatusUnknown
+// countCompacted counts a rollout line that is a compacted item, the history
+// summary Codex writes when it compacts the context. Compactions are counted
+// over the whole rollout, which readRolloutStatus does not read, so they are
+// kept in a lineCache and only appended lines are looked at.
+func countCompacted(n *int, line []byte) {
+	if !bytes.Contains(line, []byte(`"compacted"`)) {
+		return
+	}
+	var e struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(line, &e) == nil && e.Type == "compacted" {
+		*n++
 	}
+}
 
-	if payload.Payload.Type == "task_complete" {
-		return model.StatusIdle
+// applyRolloutEvent advances the backward scan of readRolloutStatus by one
+// entry, setting info.Status (and Since) once an entry decides it. calls
+// holds the state of the tool calls seen so far, i.e. after e: an approved
+// call has begun, a call with a result has finished.
+func applyRolloutEvent(info *rolloutInfo, e *rolloutPayload, calls map[string]string) {
+	p := &e.Payload
+	switch e.Type {
+	case "session_meta":
+		// The start of the rollout: no turn since.
+		info.Status, info.Since = model.StatusIdle, parseTimestamp(e.Timestamp)
+		if info.Activity != "" {
+			info.Status = model.StatusBusy
+		}
+	case "event_msg":
+		switch p.Type {
+		case "task_complete", "turn_aborted", "shutdown_complete":
+			info.Status, info.Since = model.StatusIdle, parseTimestamp(e.Timestamp)
+		case "error":
+			info.Status, info.Since = model.StatusError, parseTimestamp(e.Timestamp)
+		case "exec_approval_request", "apply_patch_approval_request":
+			if calls[p.CallID] == "" {
+				info.Status, info.Since = model.StatusWaitingApproval, parseTimestamp(e.Timestamp)
+				info.Activity = "apply_patch"
+				if p.Type == "exec_approval_request" {
+					info.Activity = codexCommand(p.Command)
+				}
+			}
+		case "task_started", "user_message":
+			info.Status, info.Since = model.StatusBusy, parseTimestamp(e.Timestamp)
+		case "exec_command_end", "patch_apply_end", "mcp_tool_call_end":
+			calls[p.CallID] = "finished"
+		case "exec_command_begin":
+			beginRolloutCall(info, p.CallID, codexCommand(p.Command), calls)
+		case "patch_apply_begin":
+			beginRolloutCall(info, p.CallID, "apply_patch", calls)
+		case "mcp_tool_call_begin":
+			if p.Invocation != nil {
+				beginRolloutCall(info, p.CallID, p.Invocation.Server+"."+p.Invocation.Tool, calls)
+			}
+		}
+	case "response_item":
+		switch p.Type {
+		case "function_call_output", "custom_tool_call_output", "local_shell_call_output":
+			calls[p.CallID] = "finished"
+		case "function_call":
+			beginRolloutCall(info, p.CallID, codexFunctionCall(p.Name, p.Arguments), calls)
+		case "custom_tool_call":
+			beginRolloutCall(info, p.CallID, p.Name, calls)
+		case "local_shell_call":
+			if p.Action != nil {
+				beginRolloutCall(info, p.CallID, codexCommand(p.Action.Command), calls)
+			}
+		}
 	}
-	return model.StatusBusy
 }
 
-// lookupCodexThread queries the Codex SQLite database for thread metadata.
-// The threads table stores title, rollout_path, and cwd per thread.
-func lookupCodexThread(threadID string) *codexThreadInfo {
-	home, err := os.UserHomeDir()
-	if err != nil {
-		return nil
+// beginRolloutCall records that a tool call has begun, and makes it the
+// activity unless it has finished or a later call is the activity already.
+// Codex logs a shell command both as a function call and as its exec events,
+// under one call ID.
+func beginRolloutCall(info *rolloutInfo, callID, activity string, calls map[string]string) {
+	if calls[callID] == "finished" {
+		return
+	}
+	calls[callID] = "begun"
+	if info.Activity == "" {
+		info.Activity = activity
 	}
+}
 
-	dbPath := filepath.Join(home, ".codex", "state_5.sqlite")
-	db, err := sql.Open("sqlite", dbPath+"?mode=ro&_journal_mode=WAL")
-	if err != nil {
-		return nil
+// codexFunctionCall describes a function call: the command of a shell tool,
+// otherwise the tool name.
+func codexFunctionCall(name, arguments string) string {
+	var args struct {
+		Command json.RawMessage `json:"command"` // shell: argv; shell_command: a script
+		Cmd     string          `json:"cmd"`     // exec_command
 	}
-	defer db.Close()
+	if json.Unmarshal([]byte(arguments), &args) == nil {
+		if args.Cmd != "" {
+			return args.Cmd
+		}
+		if cmd := codexCommand(args.Command); cmd != "" {
+			return cmd
+		}
+	}
+	return name
+}
 
-	var info codexThreadInfo
-	err = db.QueryRow(
-		"SELECT title, rollout_path, cwd FROM threads WHERE id = ?",
-		threadID,
-	).Scan(&info.Title, &info.RolloutPath, &info.CWD)
-	if err != nil {
-		return nil
+// codexCommand renders a command given as argv or as a script. A script run
+// through a shell (bash -lc SCRIPT) is shown as the script.
+func codexCommand(raw json.RawMessage) string {
+	var script string
+	if json.Unmarshal(raw, &script) == nil {
+		return script
+	}
+	var argv []string
+	if json.Unmarshal(raw, &argv) != nil || len(argv) == 0 {
+		return ""
+	}
+	if len(argv) == 3 && strings.HasPrefix(argv[1], "-") && strings.HasSuffix(argv[1], "c") {
+		switch filepath.Base(argv[0]) {
+		case "bash", "sh", "zsh":
+			return argv[2]
+		}
 	}
-	return &info
+	return strings.Join(argv, " ")
 }
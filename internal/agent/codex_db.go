@@ -0,0 +1,263 @@
+package agent
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// codexThreadInfo holds metadata fetched from the Codex SQLite database.
+// Fields whose column the database lacks stay zero.
+type codexThreadInfo struct {
+	Title       string
+	RolloutPath string
+	CWD         string
+	Model       string
+	GitBranch   string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Archived    bool
+}
+
+// codexThreadTables are the table names the thread metadata has been stored
+// under, tried in order.
+var codexThreadTables = []string{"threads", "thread"}
+
+// codexThreadColumns maps each codexThreadInfo field to the column names it
+// has been stored under, tried in order.
+var codexThreadColumns = []struct {
+	names []string
+	set   func(info *codexThreadInfo, v any)
+}{
+	{[]string{"title"}, func(i *codexThreadInfo, v any) { i.Title = sqlString(v) }},
+	{[]string{"rollout_path"}, func(i *codexThreadInfo, v any) { i.RolloutPath = sqlString(v) }},
+	{[]string{"cwd"}, func(i *codexThreadInfo, v any) { i.CWD = sqlString(v) }},
+	{[]string{"model", "model_slug"}, func(i *codexThreadInfo, v any) { i.Model = sqlString(v) }},
+	{[]string{"git_branch", "branch"}, func(i *codexThreadInfo, v any) { i.GitBranch = sqlString(v) }},
+	{[]string{"created_at", "created"}, func(i *codexThreadInfo, v any) { i.CreatedAt = sqlTime(v) }},
+	{[]string{"updated_at", "updated"}, func(i *codexThreadInfo, v any) { i.UpdatedAt = sqlTime(v) }},
+	{[]string{"archived", "archived_at"}, func(i *codexThreadInfo, v any) { i.Archived = sqlTruthy(v) }},
+}
+
+// codexStateDB is the newest state database of one Codex home, opened once
+// per discovery run and shared by its processes.
+type codexStateDB struct {
+	db    *sql.DB
+	path  string
+	query string                        // selects the known columns by thread ID
+	sets  []func(*codexThreadInfo, any) // one per selected column
+}
+
+// codexStateFileRe matches a state database name and captures its version.
+var codexStateFileRe = regexp.MustCompile(`^state_(\d+)\.sqlite$`)
+
+// openCodexStateDB opens the newest {home}/state_{N}.sqlite read-only and
+// works out from PRAGMA table_info which thread columns it has. Returns nil
+// if there is no database, if it cannot be read (e.g. it is locked), or if
+// it has no threads table with an id column. The latter two are reported on
+// stderr, as is a threads table without a title column, since titles then
+// silently disappear.
+func openCodexStateDB(home string) *codexStateDB {
+	if home == "" {
+		return nil
+	}
+	dbPath := newestCodexStateFile(home)
+	if dbPath == "" {
+		return nil
+	}
+
+	busy := conf.Agent("codex").Timeout.Milliseconds()
+	db, err := sql.Open("sqlite", fmt.Sprintf("%s?mode=ro&_journal_mode=WAL&_pragma=busy_timeout(%d)", dbPath, busy))
+	if err != nil {
+		warnOnce("cannot open Codex database %s: %v; thread titles unavailable", dbPath, err)
+		return nil
+	}
+
+	for _, table := range codexThreadTables {
+		cols, err := sqliteColumns(db, table)
+		if err != nil {
+			db.Close()
+			warnOnce("cannot read Codex database %s: %v; thread titles unavailable", dbPath, err)
+			return nil
+		}
+		if !cols["id"] {
+			continue
+		}
+		if !cols["title"] {
+			warnOnce("no title column in table %s of Codex database %s; thread titles unavailable", table, dbPath)
+		}
+		var selected []string
+		var sets []func(*codexThreadInfo, any)
+		for _, c := range codexThreadColumns {
+			for _, name := range c.names {
+				if cols[name] {
+					selected = append(selected, sqliteIdent(name))
+					sets = append(sets, c.set)
+					break
+				}
+			}
+		}
+		if len(selected) == 0 {
+			break
+		}
+		return &codexStateDB{
+			db:    db,
+			path:  dbPath,
+			query: fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", strings.Join(selected, ", "), sqliteIdent(table)),
+			sets:  sets,
+		}
+	}
+
+	db.Close()
+	warnOnce("unrecognised Codex database schema in %s: no %s table with an id column; thread titles unavailable",
+		dbPath, strings.Join(codexThreadTables, " or "))
+	return nil
+}
+
+// newestCodexStateFile returns the state_{N}.sqlite in home with the highest
+// version, or "" if there is none.
+func newestCodexStateFile(home string) string {
+	entries, err := os.ReadDir(home)
+	if err != nil {
+		return ""
+	}
+	best, bestVersion := "", -1
+	for _, e := range entries {
+		m := codexStateFileRe.FindStringSubmatch(e.Name())
+		if m == nil || e.IsDir() {
+			continue
+		}
+		if v, err := strconv.Atoi(m[1]); err == nil && v > bestVersion {
+			best, bestVersion = filepath.Join(home, e.Name()), v
+		}
+	}
+	return best
+}
+
+// sqliteColumns returns the column names of table, none if it does not
+// exist. It fails if the database cannot be read.
+func sqliteColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", sqliteIdent(table)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt any
+		if rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk) == nil {
+			cols[name] = true
+		}
+	}
+	return cols, rows.Err()
+}
+
+// sqliteIdent quotes an SQL identifier: in double quotes, with double quotes
+// in it doubled.
+func sqliteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// lookup returns the metadata of a thread, or nil if it is not in the
+// database. A nil database finds nothing.
+func (d *codexStateDB) lookup(threadID string) *codexThreadInfo {
+	if d == nil {
+		return nil
+	}
+	values := make([]any, len(d.sets))
+	dest := make([]any, len(d.sets))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := d.db.QueryRow(d.query, threadID).Scan(dest...); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			warnOnce("cannot read Codex database %s: %v; thread titles unavailable", d.path, err)
+		}
+		return nil
+	}
+	var info codexThreadInfo
+	for i, set := range d.sets {
+		set(&info, values[i])
+	}
+	return &info
+}
+
+// close closes the database; a nil database is a no-op.
+func (d *codexStateDB) close() {
+	if d != nil {
+		d.db.Close()
+	}
+}
+
+// sqlString converts a column value to a string; NULL becomes "".
+func sqlString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// sqlTime converts a timestamp column to a time: Unix seconds or
+// milliseconds, or an RFC 3339 string. Anything else is the zero time.
+func sqlTime(v any) time.Time {
+	switch v := v.(type) {
+	case int64:
+		return unixSecondsOrMillis(v)
+	case float64:
+		return unixSecondsOrMillis(int64(v))
+	case string, []byte:
+		s := sqlString(v)
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return unixSecondsOrMillis(n)
+		}
+		return parseTimestamp(s)
+	case time.Time:
+		return v
+	}
+	return time.Time{}
+}
+
+// unixSecondsOrMillis interprets n as Unix milliseconds if it is too large
+// to be seconds of this era.
+func unixSecondsOrMillis(n int64) time.Time {
+	switch {
+	case n <= 0:
+		return time.Time{}
+	case n > 1e11:
+		return time.UnixMilli(n)
+	}
+	return time.Unix(n, 0)
+}
+
+// sqlTruthy reports whether a flag or timestamp column is set: non-NULL,
+// non-zero and non-empty.
+func sqlTruthy(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case int64:
+		return v != 0
+	case float64:
+		return v != 0
+	case bool:
+		return v
+	}
+	s := sqlString(v)
+	return s != "" && s != "0" && s != "false"
+}
@@ -0,0 +1,152 @@
+package agent
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCodexStateDB creates {home}/{name} with the given schema statements.
+func writeCodexStateDB(t *testing.T, home, name string, stmts ...string) {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(home, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOpenCodexStateDB(t *testing.T) {
+	created := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		stmts []string
+		want  *codexThreadInfo // of thread t1; nil if the database is not used
+	}{
+		{
+			name: "current schema",
+			stmts: []string{
+				`CREATE TABLE threads (id TEXT PRIMARY KEY, title TEXT, rollout_path TEXT, cwd TEXT, model TEXT, git_branch TEXT, created_at INTEGER, updated_at INTEGER, archived INTEGER)`,
+				`INSERT INTO threads VALUES ('t1', 'Fix tests', '/r.jsonl', '/src', 'gpt-5', 'main', 1772366400, 1772366400000, 0)`,
+			},
+			want: &codexThreadInfo{Title: "Fix tests", RolloutPath: "/r.jsonl", CWD: "/src", Model: "gpt-5", GitBranch: "main", CreatedAt: created, UpdatedAt: created},
+		},
+		{
+			name: "alternate table and column names",
+			stmts: []string{
+				`CREATE TABLE thread (id TEXT, title TEXT, model_slug TEXT, branch TEXT, created TEXT, archived_at TEXT)`,
+				`INSERT INTO thread VALUES ('t1', 'Fix tests', 'o3', 'dev', '2026-03-01T12:00:00Z', '2026-03-02T00:00:00Z')`,
+			},
+			want: &codexThreadInfo{Title: "Fix tests", Model: "o3", GitBranch: "dev", CreatedAt: created, Archived: true},
+		},
+		{
+			name: "missing title",
+			stmts: []string{
+				`CREATE TABLE threads (id TEXT, cwd TEXT, archived_at INTEGER)`,
+				`INSERT INTO threads VALUES ('t1', '/src', NULL)`,
+			},
+			want: &codexThreadInfo{CWD: "/src"},
+		},
+		{
+			name:  "no threads table",
+			stmts: []string{`CREATE TABLE sessions (id TEXT, title TEXT)`},
+		},
+		{
+			name:  "threads table without an id column",
+			stmts: []string{`CREATE TABLE threads (thread_id TEXT, title TEXT)`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := t.TempDir()
+			writeCodexStateDB(t, home, "state_5.sqlite", tt.stmts...)
+			db := openCodexStateDB(home)
+			defer db.close()
+			if tt.want == nil {
+				if db != nil {
+					t.Fatalf("opened %s, want nil", db.path)
+				}
+				return
+			}
+			if db == nil {
+				t.Fatal("got nil database")
+			}
+			got := db.lookup("t1")
+			if got == nil || !got.CreatedAt.Equal(tt.want.CreatedAt) || !got.UpdatedAt.Equal(tt.want.UpdatedAt) {
+				t.Fatalf("lookup t1 = %+v, want %+v", got, tt.want)
+			}
+			got.CreatedAt, got.UpdatedAt = tt.want.CreatedAt, tt.want.UpdatedAt
+			if *got != *tt.want {
+				t.Errorf("lookup t1 = %+v, want %+v", *got, *tt.want)
+			}
+			if info := db.lookup("t2"); info != nil {
+				t.Errorf("lookup of a missing thread = %+v, want nil", info)
+			}
+		})
+	}
+}
+
+func TestNewestCodexStateFile(t *testing.T) {
+	home := t.TempDir()
+	if got := openCodexStateDB(home); got != nil {
+		t.Errorf("opened %s in an empty home", got.path)
+	}
+	// Versions compare as numbers, not strings.
+	schema := `CREATE TABLE threads (id TEXT, title TEXT)`
+	writeCodexStateDB(t, home, "state_9.sqlite", schema)
+	writeCodexStateDB(t, home, "state_10.sqlite", schema)
+	writeCodexStateDB(t, home, "state_11.sqlite-wal", schema)
+	if got, want := newestCodexStateFile(home), filepath.Join(home, "state_10.sqlite"); got != want {
+		t.Errorf("newest state file %s, want %s", got, want)
+	}
+}
+
+func TestSQLValues(t *testing.T) {
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	times := []struct {
+		v    any
+		want time.Time
+	}{
+		{int64(1772366400), at},
+		{int64(1772366400000), at},
+		{float64(1772366400), at},
+		{"1772366400", at},
+		{[]byte("2026-03-01T12:00:00Z"), at},
+		{at, at},
+		{int64(0), time.Time{}},
+		{nil, time.Time{}},
+		{"soon", time.Time{}},
+	}
+	for _, tt := range times {
+		if got := sqlTime(tt.v); !got.Equal(tt.want) {
+			t.Errorf("sqlTime(%#v) = %v, want %v", tt.v, got, tt.want)
+		}
+	}
+
+	flags := []struct {
+		v    any
+		want bool
+	}{
+		{nil, false},
+		{int64(0), false},
+		{int64(1), true},
+		{float64(0), false},
+		{true, true},
+		{"", false},
+		{"0", false},
+		{"false", false},
+		{"2026-03-01", true},
+		{[]byte("1"), true},
+	}
+	for _, tt := range flags {
+		if got := sqlTruthy(tt.v); got != tt.want {
+			t.Errorf("sqlTruthy(%#v) = %v, want %v", tt.v, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/model"
+)
+
+// rolloutLine renders one rollout entry with the given timestamp offset in
+// seconds from a fixed start.
+func rolloutLine(sec int, typ, payload string) string {
+	ts := time.Date(2026, 3, 1, 12, 0, sec, 0, time.UTC).Format(time.RFC3339)
+	return `{"timestamp":"` + ts + `","type":"` + typ + `","payload":` + payload + `}`
+}
+
+func TestReadRolloutStatus(t *testing.T) {
+	meta := rolloutLine(0, "session_meta", `{"id":"019c9aa5-8f55-7833-b235-d00a5faa09d0"}`)
+	started := rolloutLine(1, "event_msg", `{"type":"task_started"}`)
+	at := func(sec int) time.Time { return time.Date(2026, 3, 1, 12, 0, sec, 0, time.UTC) }
+
+	tests := []struct {
+		name     string
+		lines    []string
+		status   string
+		since    time.Time
+		activity string
+	}{
+		{"session_meta only", []string{meta}, model.StatusIdle, at(0), ""},
+		{"turn started", []string{meta, started,
+			rolloutLine(2, "event_msg", `{"type":"user_message","message":"hi"}`),
+		}, model.StatusBusy, at(2), ""},
+		{"tool call running", []string{meta, started,
+			rolloutLine(2, "response_item", `{"type":"function_call","name":"exec_command","call_id":"c1","arguments":"{\"cmd\":\"go test ./...\"}"}`),
+		}, model.StatusBusy, at(1), "go test ./..."},
+		{"tool call finished", []string{meta, started,
+			rolloutLine(2, "response_item", `{"type":"function_call","name":"exec_command","call_id":"c1","arguments":"{\"cmd\":\"go test ./...\"}"}`),
+			rolloutLine(3, "response_item", `{"type":"function_call_output","call_id":"c1","output":"ok"}`),
+		}, model.StatusBusy, at(1), ""},
+		{"pending approval", []string{meta, started,
+			rolloutLine(2, "response_item", `{"type":"function_call","name":"shell","call_id":"c1","arguments":"{\"command\":[\"bash\",\"-lc\",\"rm -rf build\"]}"}`),
+			rolloutLine(3, "event_msg", `{"type":"exec_approval_request","call_id":"c1","command":["bash","-lc","rm -rf build"]}`),
+		}, model.StatusWaitingApproval, at(3), "rm -rf build"},
+		{"approved", []string{meta, started,
+			rolloutLine(2, "event_msg", `{"type":"exec_approval_request","call_id":"c1","command":["bash","-lc","rm -rf build"]}`),
+			rolloutLine(3, "event_msg", `{"type":"exec_command_begin","call_id":"c1","command":["bash","-lc","rm -rf build"]}`),
+		}, model.StatusBusy, at(1), "rm -rf build"},
+		{"patch approval", []string{meta, started,
+			rolloutLine(2, "event_msg", `{"type":"apply_patch_approval_request","call_id":"c2"}`),
+		}, model.StatusWaitingApproval, at(2), "apply_patch"},
+		{"aborted", []string{meta, started,
+			rolloutLine(2, "event_msg", `{"type":"exec_approval_request","call_id":"c1","command":["ls"]}`),
+			rolloutLine(3, "event_msg", `{"type":"turn_aborted","reason":"interrupted"}`),
+		}, model.StatusIdle, at(3), ""},
+		{"error", []string{meta, started,
+			rolloutLine(2, "response_item", `{"type":"function_call","name":"exec_command","call_id":"c1","arguments":"{\"cmd\":\"make\"}"}`),
+			rolloutLine(3, "event_msg", `{"type":"error","message":"stream disconnected"}`),
+		}, model.StatusError, at(3), ""},
+		{"complete", []string{meta, started,
+			rolloutLine(2, "event_msg", `{"type":"task_complete"}`),
+			rolloutLine(3, "event_msg", `{"type":"token_count","info":null}`),
+		}, model.StatusIdle, at(2), ""},
+		{"call without task_started", []string{meta,
+			rolloutLine(1, "response_item", `{"type":"local_shell_call","call_id":"c1","action":{"command":["git","status"]}}`),
+		}, model.StatusBusy, at(0), "git status"},
+		{"unparsable last line", []string{meta, started, `{"timestamp":`}, model.StatusUnknown, time.Time{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rollout.jsonl")
+			if err := os.WriteFile(path, []byte(strings.Join(tt.lines, "\n")+"\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			info := readRolloutStatus(path)
+			if info.Status != tt.status || !info.Since.Equal(tt.since) || info.Activity != tt.activity {
+				t.Errorf("got status %q since %v activity %q, want %q since %v activity %q",
+					info.Status, info.Since, info.Activity, tt.status, tt.since, tt.activity)
+			}
+		})
+	}
+}
+
+func TestReadRolloutStatusUsage(t *testing.T) {
+	lines := []string{
+		rolloutLine(0, "session_meta", `{}`),
+		rolloutLine(1, "turn_context", `{"model":"gpt-5-codex"}`),
+		rolloutLine(2, "event_msg", `{"type":"task_started"}`),
+		rolloutLine(3, "event_msg", `{"type":"token_count","info":{"total_token_usage":{"input_tokens":1000,"cached_input_tokens":400,"output_tokens":50,"total_tokens":1050},"last_token_usage":{"total_tokens":700},"model_context_window":272000}}`),
+		rolloutLine(4, "compacted", `{"message":"summary"}`),
+	}
+	path := filepath.Join(t.TempDir(), "rollout.jsonl")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	info := readRolloutStatus(path)
+	want := model.Usage{InputTokens: 600, OutputTokens: 50, CacheReadTokens: 400}
+	if info.Model != "gpt-5-codex" || info.Usage != want || info.ContextWindow != 272000 {
+		t.Errorf("got model %q usage %+v window %d", info.Model, info.Usage, info.ContextWindow)
+	}
+	// The compaction after the token count leaves the context size unknown.
+	if info.Context != 0 || !info.Compacting {
+		t.Errorf("got context %d compacting %v, want 0 and compacting", info.Context, info.Compacting)
+	}
+}
+
+// TestReadRolloutStatusMetaWindow checks that the model is not looked for
+// further back than rolloutMetaWindow once the status is known, and is found
+// within it.
+func TestReadRolloutStatusMetaWindow(t *testing.T) {
+	filler := rolloutLine(2, "response_item", `{"type":"message","content":"`+strings.Repeat("x", 1000)+`"}`)
+	for _, tt := range []struct {
+		name   string
+		filler int // bytes of entries between the turn_context and the end
+		model  string
+	}{
+		{"within the window", rolloutMetaWindow / 2, "gpt-5-codex"},
+		{"beyond the window", rolloutMetaWindow * 2, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := []string{
+				rolloutLine(0, "session_meta", `{}`),
+				rolloutLine(1, "turn_context", `{"model":"gpt-5-codex"}`),
+			}
+			for n := 0; n < tt.filler; n += len(filler) + 1 {
+				lines = append(lines, filler)
+			}
+			lines = append(lines, rolloutLine(3, "event_msg", `{"type":"task_complete"}`))
+			path := filepath.Join(t.TempDir(), "rollout.jsonl")
+			if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			info := readRolloutStatus(path)
+			if info.Status != model.StatusIdle || info.Model != tt.model {
+				t.Errorf("got status %q model %q, want idle and %q", info.Status, info.Model, tt.model)
+			}
+		})
+	}
+}
+
+func TestCodexCommand(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{`"ls -la"`, "ls -la"},
+		{`["bash","-lc","go test ./..."]`, "go test ./..."},
+		{`["/bin/zsh","-c","echo hi"]`, "echo hi"},
+		{`["git","status"]`, "git status"},
+		{`["python3","-c","print(1)"]`, "python3 -c print(1)"},
+		{`["bash","-lc","a","b"]`, "bash -lc a b"},
+		{`[]`, ""},
+		{`42`, ""},
+		{``, ""},
+	}
+	for _, tt := range tests {
+		if got := codexCommand(json.RawMessage(tt.raw)); got != tt.want {
+			t.Errorf("codexCommand(%s) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestCodexFunctionCall(t *testing.T) {
+	tests := []struct {
+		name, arguments, want string
+	}{
+		{"exec_command", `{"cmd":"make build"}`, "make build"},
+		{"shell", `{"command":["bash","-lc","npm test"]}`, "npm test"},
+		{"shell_command", `{"command":"cargo check"}`, "cargo check"},
+		{"update_plan", `{"plan":[]}`, "update_plan"},
+		{"view_image", `not json`, "view_image"},
+	}
+	for _, tt := range tests {
+		if got := codexFunctionCall(tt.name, tt.arguments); got != tt.want {
+			t.Errorf("codexFunctionCall(%q, %s) = %q, want %q", tt.name, tt.arguments, got, tt.want)
+		}
+	}
+}
+
+func TestCodexMode(t *testing.T) {
+	tests := []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"codex"}, model.ModeTUI},
+		{[]string{"codex", "fix the tests"}, model.ModeTUI},
+		{[]string{"codex", "resume", "--last"}, model.ModeTUI},
+		{[]string{"codex", "exec", "fix the tests"}, model.ModeExec},
+		{[]string{"codex", "e", "fix the tests"}, model.ModeExec},
+		{[]string{"codex", "--full-auto", "exec", "fix"}, model.ModeExec},
+		{[]string{"codex", "-m", "gpt-5", "-c", "k=v", "app-server"}, model.ModeAppServer},
+		{[]string{"codex", "--cd", "/src", "mcp-server"}, model.ModeMCPServer},
+		// A flag value is not a subcommand.
+		{[]string{"codex", "-p", "exec"}, model.ModeTUI},
+		{[]string{"codex", "--profile=exec"}, model.ModeTUI},
+		// Only the first positional argument is the subcommand.
+		{[]string{"codex", "say", "exec"}, model.ModeTUI},
+	}
+	for _, tt := range tests {
+		if got := codexMode(tt.argv); got != tt.want {
+			t.Errorf("codexMode(%q) = %q, want %q", tt.argv, got, tt.want)
+		}
+	}
+}
@@ -1,13 +1,28 @@
 package agent
 
 import (
+	"fmt"
+	"os"
 	"sync"
 
 	"github.com/Eric-Song-Nop/agentstat/internal/model"
+	"github.com/Eric-Song-Nop/agentstat/internal/platform"
 )
 
 // ConcurrentProbe runs probe concurrently on each item and collects non-nil results.
 func ConcurrentProbe[T any](items []T, probe func(T) *model.AgentSession) []model.AgentSession {
+	return ConcurrentProbeAll(items, func(it T) []model.AgentSession {
+		if session := probe(it); session != nil {
+			return []model.AgentSession{*session}
+		}
+		return nil
+	})
+}
+
+// ConcurrentProbeAll runs probe concurrently on each item and collects all
+// results, for items that may yield several sessions. The sessions of one item
+// stay together and in order.
+func ConcurrentProbeAll[T any](items []T, probe func(T) []model.AgentSession) []model.AgentSession {
 	var mu sync.Mutex
 	var results []model.AgentSession
 	var wg sync.WaitGroup
@@ -16,9 +31,9 @@ func ConcurrentProbe[T any](items []T, probe func(T) *model.AgentSession) []mode
 		wg.Add(1)
 		go func(it T) {
 			defer wg.Done()
-			if session := probe(it); session != nil {
+			if sessions := probe(it); len(sessions) > 0 {
 				mu.Lock()
-				results = append(results, *session)
+				results = append(results, sessions...)
 				mu.Unlock()
 			}
 		}(item)
@@ -27,3 +42,57 @@ func ConcurrentProbe[T any](items []T, probe func(T) *model.AgentSession) []mode
 	wg.Wait()
 	return results
 }
+
+// filterOwnPIDs keeps only PIDs owned by the current user, unless the config
+// enables all-users mode. PIDs whose owner could not be read (UID -1) are
+// kept, as they were before ownership was checked.
+func filterOwnPIDs(snap *platform.Snapshot, pids []int) []int {
+	if conf.AllUsers {
+		return pids
+	}
+	uid := os.Getuid()
+	var own []int
+	for _, pid := range pids {
+		if u := snap.UID(pid); u == uid || u < 0 {
+			own = append(own, pid)
+		}
+	}
+	return own
+}
+
+// withProcessInfo fills in the User, Container and StartedAt fields of each
+// session from its process, and estimates Cost from the pricing config where
+// the agent does not report one.
+func withProcessInfo(snap *platform.Snapshot, sessions []model.AgentSession) []model.AgentSession {
+	names := make(map[int]string)
+	for i := range sessions {
+		uid := snap.UID(sessions[i].PID)
+		name, ok := names[uid]
+		if !ok {
+			name = platform.UserNameForUID(uid)
+			names[uid] = name
+		}
+		sessions[i].User = name
+		sessions[i].Container = platform.P.ReadProcessContainer(sessions[i].PID)
+		if p := snap.Get(sessions[i].PID); p != nil {
+			sessions[i].StartedAt = p.StartTime
+		}
+		if sessions[i].Cost == 0 {
+			sessions[i].Cost = estimateCost(sessions[i].Model, sessions[i].Usage)
+		}
+	}
+	return sessions
+}
+
+// warned records the warnings given so far, so that watch mode gives each
+// once.
+var warned sync.Map
+
+// warnOnce writes a warning to stderr, unless the same warning was given
+// before.
+func warnOnce(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if _, dup := warned.LoadOrStore(msg, true); !dup {
+		fmt.Fprintln(os.Stderr, "warning: "+msg)
+	}
+}
@@ -1,11 +1,15 @@
 package agent
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"io/fs"
+	"maps"
 	"os"
 	"path/filepath"
-	"regexp"
-	"sort"
+	"slices"
 	"strings"
 	"time"
 
@@ -15,115 +19,173 @@ import (
 
 // geminiSessionFile holds a parsed Gemini session JSON file with its mtime.
 type geminiSessionFile struct {
-	Path       string
-	ModTime    time.Time
-	ProjectDir string // parent of "chats" directory, e.g. ~/.gemini/tmp/{project}
-	Data       geminiSession
+	Path        string
+	ModTime     time.Time
+	ProjectDir  string // parent of "chats" directory, e.g. ~/.gemini/tmp/{project}
+	ProjectRoot string // the working directory the project directory belongs to
+	Data        geminiSession
 }
 
-// geminiSession is the top-level structure of ~/.gemini/tmp/{project}/chats/session-*.json.
+// geminiSession is what agentstat keeps of ~/.gemini/tmp/{project}/chats/session-*.json.
+// Sessions are decoded as a stream: messages are folded into this summary one
+// at a time instead of being held in memory.
 type geminiSession struct {
-	SessionID   string          `json:"sessionId"`
-	StartTime   string          `json:"startTime"`
-	LastUpdated string          `json:"lastUpdated"`
-	Messages    []geminiMessage `json:"messages"`
+	SessionID   string
+	StartTime   string
+	LastUpdated string
+
+	Messages    int           // number of messages
+	LastMessage geminiMessage // zero if there are none
+	FirstPrompt string        // text of the first user message
+
+	Model   string
+	Usage   model.Usage
+	Context int64 // context size of the latest response
 }
 
 // geminiMessage represents a single message in the Gemini session.
 type geminiMessage struct {
-	Type      string `json:"type"`      // "user" | "gemini" | "error" | "info"
-	Timestamp string `json:"timestamp"`
+	Type      string           `json:"type"` // "user" | "gemini" | "error" | "info"
+	Timestamp string           `json:"timestamp"`
+	Content   json.RawMessage  `json:"content"`   // a string, or parts with text
+	Model     string           `json:"model"`     // gemini messages
+	Tokens    *geminiTokens    `json:"tokens"`    // gemini messages
+	ToolCalls []geminiToolCall `json:"toolCalls"` // gemini messages
+}
+
+// geminiToolCall is a function call requested by a model response, recorded
+// with the status of its execution.
+type geminiToolCall struct {
+	Name   string          `json:"name"`
+	Args   json.RawMessage `json:"args"`
+	Status string          `json:"status"` // "validating" | "scheduled" | "awaiting_approval" | "executing" | "success" | "error" | "cancelled"
+}
+
+// geminiPendingToolStatus maps the status of a tool call that has not
+// finished to the session status it implies.
+var geminiPendingToolStatus = map[string]string{
+	"validating":        model.StatusBusy,
+	"scheduled":         model.StatusBusy,
+	"executing":         model.StatusBusy,
+	"awaiting_approval": model.StatusWaitingApproval,
+}
+
+// geminiTokens is the token summary of one model response. Input includes
+// cached tokens; thoughts are billed as output.
+type geminiTokens struct {
+	Input    int64 `json:"input"`
+	Output   int64 `json:"output"`
+	Cached   int64 `json:"cached"`
+	Thoughts int64 `json:"thoughts"`
+	Total    int64 `json:"total"`
 }
 
 // DiscoverGemini finds all running Gemini CLI processes and determines their status.
 //
 // Gemini spawns a child node process with identical argv for each session. We filter
-// children by checking PPID membership in the PID set, then group parent PIDs by CWD
-// and pair them with matching session files ordered by startTime.
-func DiscoverGemini() []model.AgentSession {
-	pids := findGeminiPIDs()
+// children by checking PPID membership in the PID set, then map each parent PID to
+// a session file of its project (see matchGeminiSessions).
+func DiscoverGemini(snap *platform.Snapshot) []model.AgentSession {
+	pids := findGeminiPIDs(snap)
 	if len(pids) == 0 {
 		return nil
 	}
 
 	// Filter out child processes whose PPID is also a Gemini PID.
-	parentPIDs := filterGeminiParents(pids)
+	parentPIDs := filterGeminiParents(snap, pids)
+	families := make(map[int][]int, len(parentPIDs))
+	for _, pid := range parentPIDs {
+		families[pid] = []int{pid}
+	}
+	for _, pid := range pids {
+		if ppid := snap.PPID(pid); families[ppid] != nil {
+			families[ppid] = append(families[ppid], pid)
+		}
+	}
+
+	// Each Gemini data directory is matched independently.
+	var results []model.AgentSession
+	for dir, group := range groupByDir(snap, parentPIDs, (*procEnv).geminiDir) {
+		results = append(results, discoverGeminiInDir(snap, dir, group, families)...)
+	}
+	return withProcessInfo(snap, results)
+}
 
-	sessions := loadGeminiSessions()
-	if len(sessions) == 0 {
-		// Processes running but no session files — report unknown.
-		var results []model.AgentSession
+// discoverGeminiInDir matches parent PIDs sharing one Gemini data directory
+// to the session files stored there. Processes without a session are
+// reported with status unknown, as are all of them if geminiDir is "".
+func discoverGeminiInDir(snap *platform.Snapshot, geminiDir string, parentPIDs []int, families map[int][]int) []model.AgentSession {
+	var sessions []geminiSessionFile
+	if geminiDir != "" {
+		var members []int
 		for _, pid := range parentPIDs {
-			cwd := platform.P.ReadProcessCwd(pid)
+			members = append(members, families[pid]...)
+		}
+		sessions = loadGeminiSessions(geminiDir, groupCwds(snap, parentPIDs), earliestStart(snap, parentPIDs), openFiles(snap, members))
+	}
+	matches := matchGeminiSessions(snap, families, parentPIDs, sessions)
+	checkpoints := make(map[string][]geminiCheckpoint)
+
+	results := make([]model.AgentSession, 0, len(parentPIDs))
+	for _, pid := range parentPIDs {
+		m, ok := matches[pid]
+		if !ok {
 			results = append(results, model.AgentSession{
 				Agent:     "gemini",
 				Status:    model.StatusUnknown,
-				Directory: cwd,
+				Directory: snap.Cwd(pid),
 				PID:       pid,
 			})
+			continue
 		}
-		return results
-	}
 
-	// Group parent PIDs by CWD, then pair each group with matching sessions.
-	type pidCwd struct {
-		PID int
-		CWD string
-	}
-	var entries []pidCwd
-	for _, pid := range parentPIDs {
-		cwd := platform.P.ReadProcessCwd(pid)
-		if cwd == "" || cwd == "-" {
-			continue
+		sess := &sessions[m.Session]
+		s := model.AgentSession{
+			Agent:           "gemini",
+			SessionID:       sess.Data.SessionID,
+			Title:           geminiTitle(sess, checkpoints),
+			Directory:       snap.Cwd(pid),
+			PID:             pid,
+			MatchMethod:     m.Method,
+			MatchConfidence: m.Confidence,
+			CreatedAt:       parseTimestamp(sess.Data.StartTime),
 		}
-		entries = append(entries, pidCwd{PID: pid, CWD: cwd})
+		setGeminiState(&s, sess)
+		results = append(results, s)
 	}
+	return results
+}
 
-	cwdToPIDs := make(map[string][]int)
-	for _, e := range entries {
-		cwdToPIDs[e.CWD] = append(cwdToPIDs[e.CWD], e.PID)
+// geminiTitle names a session after the checkpoint saved from it, or else
+// its first prompt. cache is passed to geminiCheckpointTag.
+func geminiTitle(sess *geminiSessionFile, cache map[string][]geminiCheckpoint) string {
+	title := geminiCheckpointTag(sess.ProjectDir, sess.Data.FirstPrompt, cache)
+	if title == "" {
+		title = firstLine(sess.Data.FirstPrompt)
 	}
-
-	var results []model.AgentSession
-	for cwd, pidsInCwd := range cwdToPIDs {
-		matching := matchAllGeminiSessionsByCwd(cwd, sessions)
-
-		// Sort PIDs ascending (lower PID = earlier process).
-		sort.Ints(pidsInCwd)
-		// Sort sessions by startTime ascending (earlier session first).
-		sort.Slice(matching, func(i, j int) bool {
-			return matching[i].Data.StartTime < matching[j].Data.StartTime
-		})
-
-		// Pair PIDs with sessions 1:1.
-		for i, pid := range pidsInCwd {
-			if i < len(matching) {
-				sess := &matching[i]
-				status := geminiStatusFromSession(&sess.Data)
-				results = append(results, model.AgentSession{
-					Agent:     "gemini",
-					Status:    status,
-					SessionID: sess.Data.SessionID,
-					Directory: cwd,
-					PID:       pid,
-				})
-			} else {
-				// More PIDs than sessions — unknown status.
-				results = append(results, model.AgentSession{
-					Agent:     "gemini",
-					Status:    model.StatusUnknown,
-					Directory: cwd,
-					PID:       pid,
-				})
-			}
-		}
+	if title == "" {
+		title = "-"
 	}
-	return results
+	return title
+}
+
+// setGeminiState fills in the fields of s that change as the session goes
+// on: status, activity, usage and context.
+func setGeminiState(s *model.AgentSession, sess *geminiSessionFile) {
+	s.Path = sess.Path
+	s.Status = geminiStatusFromSession(&sess.Data)
+	s.Activity = geminiActivity(&sess.Data)
+	s.LastActivityAt = sess.ModTime
+	s.StatusSince = geminiStatusSince(&sess.Data)
+	s.Model = sess.Data.Model
+	s.Usage = sess.Data.Usage
+	s.ContextTokens = sess.Data.Context
+	s.ContextWindow = contextWindow(sess.Data.Model)
 }
 
 // filterGeminiParents removes child processes from the PID list.
 // A PID is a child if its PPID is also in the set (the parent node process).
-func filterGeminiParents(pids []int) []int {
+func filterGeminiParents(snap *platform.Snapshot, pids []int) []int {
 	pidSet := make(map[int]struct{}, len(pids))
 	for _, pid := range pids {
 		pidSet[pid] = struct{}{}
@@ -131,7 +193,7 @@ func filterGeminiParents(pids []int) []int {
 
 	var parents []int
 	for _, pid := range pids {
-		ppid := platform.P.ReadProcessPPID(pid)
+		ppid := snap.PPID(pid)
 		if _, isChild := pidSet[ppid]; !isChild {
 			parents = append(parents, pid)
 		}
@@ -142,31 +204,21 @@ func filterGeminiParents(pids []int) []int {
 // findGeminiPIDs returns PIDs of Gemini CLI processes.
 // Gemini runs as a Node.js program, so argv[0] is "node".
 // We match any argument ending with /gemini or equal to "gemini".
-func findGeminiPIDs() []int {
-	re := regexp.MustCompile(`(^|/)gemini$`)
-	return platform.P.FindPIDsByArgs(re)
+func findGeminiPIDs(snap *platform.Snapshot) []int {
+	return filterOwnPIDs(snap, snap.FindByArgs(processRegexp("gemini")))
 }
 
-// loadGeminiSessions scans ~/.gemini/tmp/*/chats/session-*.json and parses each file.
-func loadGeminiSessions() []geminiSessionFile {
-	home, err := os.UserHomeDir()
-	if err != nil {
-		return nil
-	}
-
-	tmpDir := filepath.Join(home, ".gemini", "tmp")
-	projectDirs, err := os.ReadDir(tmpDir)
-	if err != nil {
-		return nil
-	}
+// loadGeminiSessions parses the {geminiDir}/tmp/{project}/chats/session-*.json
+// files that can belong to a running process: those in the project directory
+// of one of cwds (see geminiProjectDirs) that are open in one of the
+// processes or were modified since since. Other files are skipped without
+// being opened: no matching strategy takes a session that was not written
+// since its process started.
+func loadGeminiSessions(geminiDir string, cwds []string, since time.Time, open map[string]bool) []geminiSessionFile {
+	projectDirs := geminiProjectDirs(geminiDir, cwds)
 
 	var sessions []geminiSessionFile
-	for _, pd := range projectDirs {
-		if !pd.IsDir() {
-			continue
-		}
-
-		projectPath := filepath.Join(tmpDir, pd.Name())
+	for _, projectPath := range slices.Sorted(maps.Keys(projectDirs)) {
 		chatsDir := filepath.Join(projectPath, "chats")
 		entries, err := os.ReadDir(chatsDir)
 		if err != nil {
@@ -177,67 +229,185 @@ func loadGeminiSessions() []geminiSessionFile {
 			if e.IsDir() || !strings.HasPrefix(e.Name(), "session-") || !strings.HasSuffix(e.Name(), ".json") {
 				continue
 			}
-
-			path := filepath.Join(chatsDir, e.Name())
 			info, err := e.Info()
 			if err != nil {
 				continue
 			}
-
-			data, err := os.ReadFile(path)
-			if err != nil {
+			f := geminiSessionFile{
+				Path:        filepath.Join(chatsDir, e.Name()),
+				ModTime:     info.ModTime(),
+				ProjectDir:  projectPath,
+				ProjectRoot: projectDirs[projectPath],
+			}
+			if !open[f.Path] && f.ModTime.Before(since) {
 				continue
 			}
-
-			var session geminiSession
-			if json.Unmarshal(data, &session) != nil {
+			session, err := decodeGeminiSession(f.Path)
+			if err != nil {
 				continue
 			}
-
-			sessions = append(sessions, geminiSessionFile{
-				Path:       path,
-				ModTime:    info.ModTime(),
-				ProjectDir: projectPath,
-				Data:       session,
-			})
+			f.Data = *session
+			sessions = append(sessions, f)
 		}
 	}
 
 	return sessions
 }
 
-// matchAllGeminiSessionsByCwd returns all sessions whose project directory matches the CWD.
-func matchAllGeminiSessionsByCwd(cwd string, sessions []geminiSessionFile) []geminiSessionFile {
-	var matched []geminiSessionFile
-	for i := range sessions {
-		if matchGeminiProject(cwd, sessions[i].ProjectDir) {
-			matched = append(matched, sessions[i])
+// decodeGeminiSession stream-decodes a session file into its summary.
+func decodeGeminiSession(path string) (*geminiSession, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := &geminiSession{}
+	str := func(dst *string) func(*json.Decoder) error {
+		return func(dec *json.Decoder) error { return dec.Decode(dst) }
+	}
+	dec := json.NewDecoder(bufio.NewReader(f))
+	err = decodeObject(dec, map[string]func(*json.Decoder) error{
+		"sessionId":   str(&s.SessionID),
+		"startTime":   str(&s.StartTime),
+		"lastUpdated": str(&s.LastUpdated),
+		"messages": func(dec *json.Decoder) error {
+			return decodeArray(dec, func(dec *json.Decoder) error {
+				var msg geminiMessage
+				if err := dec.Decode(&msg); err != nil {
+					return err
+				}
+				s.add(msg)
+				return nil
+			})
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// add folds the next message of the session into the summary.
+func (s *geminiSession) add(msg geminiMessage) {
+	s.Messages++
+	s.LastMessage = msg
+	if s.FirstPrompt == "" && msg.Type == "user" {
+		s.FirstPrompt = strings.TrimSpace(geminiText(msg.Content))
+	}
+	if msg.Model != "" {
+		s.Model = msg.Model
+	}
+	if t := msg.Tokens; t != nil {
+		s.Usage.Add(model.Usage{
+			InputTokens:     t.Input - t.Cached,
+			OutputTokens:    t.Output + t.Thoughts,
+			CacheReadTokens: t.Cached,
+		})
+		s.Context = t.Total
+	}
+}
+
+// geminiText returns the text of message content: a string, a part, or an
+// array of parts whose texts are joined.
+func geminiText(content json.RawMessage) string {
+	var text string
+	if json.Unmarshal(content, &text) == nil {
+		return text
+	}
+	type part struct {
+		Text string `json:"text"`
+	}
+	var parts []part
+	if json.Unmarshal(content, &parts) != nil {
+		var p part
+		if json.Unmarshal(content, &p) != nil {
+			return ""
+		}
+		parts = []part{p}
+	}
+	texts := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p.Text != "" {
+			texts = append(texts, p.Text)
 		}
 	}
-	return matched
+	return strings.Join(texts, "\n")
 }
 
-// matchGeminiProject checks if the CWD matches the project directory.
-// It tries two approaches:
-// 1. Read .project_root file in the project directory for the actual project path.
-// 2. Compare the directory name directly with the CWD basename.
-func matchGeminiProject(cwd, projectDir string) bool {
-	// Approach 1: Check .project_root file.
-	projectRootFile := filepath.Join(projectDir, ".project_root")
-	data, err := os.ReadFile(projectRootFile)
-	if err == nil {
-		projectRoot := strings.TrimSpace(string(data))
-		if projectRoot != "" {
-			if cwd == projectRoot || strings.HasPrefix(cwd, projectRoot+"/") {
-				return true
+// geminiProjectRegistry is {geminiDir}/projects.json, in which newer Gemini
+// versions record the short identifier (a slug of the directory name) that
+// names each project's directory under tmp/.
+type geminiProjectRegistry struct {
+	Projects map[string]string `json:"projects"` // project root -> identifier
+}
+
+// geminiProjectDirs returns the project directories under {geminiDir}/tmp
+// that belong to cwds, mapped to the cwd each belongs to. Gemini names a
+// project directory by the SHA-256 hex digest of the project root (its
+// working directory), or in newer versions by the identifier in the project
+// registry, and writes the root to a .project_root file in it. A directory
+// found by name whose .project_root names another root is not used; one found
+// by neither name but whose .project_root names the cwd is.
+func geminiProjectDirs(geminiDir string, cwds []string) map[string]string {
+	tmpDir := filepath.Join(geminiDir, "tmp")
+	var registry geminiProjectRegistry
+	if data, err := os.ReadFile(filepath.Join(geminiDir, "projects.json")); err == nil {
+		json.Unmarshal(data, &registry)
+	}
+
+	dirs := make(map[string]string)
+	want := make(map[string]bool, len(cwds))
+	for _, cwd := range cwds {
+		want[cwd] = true
+		for _, id := range []string{geminiProjectHash(cwd), registry.Projects[cwd]} {
+			if id == "" || id != filepath.Base(id) || id == ".." {
+				continue
+			}
+			dir := filepath.Join(tmpDir, id)
+			root, err := readGeminiProjectRoot(dir)
+			if err == nil && (root == "" || root == cwd) {
+				dirs[dir] = cwd
 			}
 		}
 	}
 
-	// Approach 2: Directory name matches CWD basename.
-	dirName := filepath.Base(projectDir)
-	cwdBase := filepath.Base(cwd)
-	return dirName == cwdBase
+	// Directories named some other way are recognised by their root alone.
+	entries, _ := os.ReadDir(tmpDir)
+	for _, e := range entries {
+		dir := filepath.Join(tmpDir, e.Name())
+		if _, ok := dirs[dir]; ok || !e.IsDir() {
+			continue
+		}
+		if root, err := readGeminiProjectRoot(dir); err == nil && want[root] {
+			dirs[dir] = root
+		}
+	}
+	return dirs
+}
+
+// geminiProjectHash returns the identifier older Gemini versions name a
+// project directory by: the hex SHA-256 digest of the project root.
+func geminiProjectHash(root string) string {
+	sum := sha256.Sum256([]byte(root))
+	return hex.EncodeToString(sum[:])
+}
+
+// readGeminiProjectRoot returns the project root recorded in a project
+// directory, or "" if it has none. It fails if dir is not a directory.
+func readGeminiProjectRoot(dir string) (string, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fs.ErrNotExist
+	}
+	data, err := os.ReadFile(filepath.Join(dir, ".project_root"))
+	if err != nil {
+		return "", nil
+	}
+	return strings.TrimSpace(string(data)), nil
 }
 
 // geminiStatusFromSession reads the last message's type to determine status.
@@ -248,18 +418,61 @@ func matchGeminiProject(cwd, projectDir string) bool {
 // | "gemini"          | IDLE     |
 // | "error"           | IDLE     |
 // | "info"            | IDLE     |
+//
+// A "gemini" message with an unfinished tool call is BUSY instead, or
+// WAITING while the call awaits approval.
 func geminiStatusFromSession(session *geminiSession) string {
-	if len(session.Messages) == 0 {
+	if session.Messages == 0 {
 		// No messages — session just started, waiting for user input.
 		return model.StatusIdle
 	}
 
-	lastMsg := session.Messages[len(session.Messages)-1]
-	switch lastMsg.Type {
+	switch session.LastMessage.Type {
 	case "user":
 		return model.StatusBusy
+	case "gemini":
+		if tc := geminiPendingToolCall(session); tc != nil {
+			return geminiPendingToolStatus[tc.Status]
+		}
+		return model.StatusIdle
 	default:
-		// "gemini", "error", "info", or any other type → idle.
+		// "error", "info", or any other type → idle.
 		return model.StatusIdle
 	}
 }
+
+// geminiStatusSince returns the timestamp of the last message, which is when
+// the current status began. Zero if there are no messages.
+func geminiStatusSince(session *geminiSession) time.Time {
+	if session.Messages == 0 {
+		return time.Time{}
+	}
+	return parseTimestamp(session.LastMessage.Timestamp)
+}
+
+// geminiPendingToolCall returns the last tool call of the last message that
+// has not finished, preferring one awaiting approval, or nil if there is none.
+func geminiPendingToolCall(session *geminiSession) *geminiToolCall {
+	var pending *geminiToolCall
+	for i, tc := range session.LastMessage.ToolCalls {
+		switch geminiPendingToolStatus[tc.Status] {
+		case model.StatusWaitingApproval:
+			return &session.LastMessage.ToolCalls[i]
+		case model.StatusBusy:
+			pending = &session.LastMessage.ToolCalls[i]
+		}
+	}
+	return pending
+}
+
+// geminiActivity describes the pending tool call of a session, or returns ""
+// if there is none.
+func geminiActivity(session *geminiSession) string {
+	if session.LastMessage.Type != "gemini" {
+		return ""
+	}
+	if tc := geminiPendingToolCall(session); tc != nil {
+		return toolActivity(tc.Name, tc.Args)
+	}
+	return ""
+}
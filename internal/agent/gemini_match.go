@@ -0,0 +1,347 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/model"
+	"github.com/Eric-Song-Nop/agentstat/internal/platform"
+)
+
+// geminiStartSlack allows for a process start time and a session startTime
+// being taken from different clocks at different granularities.
+const geminiStartSlack = 2 * time.Second
+
+// geminiMatch records which session file a Gemini process was mapped to and how.
+type geminiMatch struct {
+	Session    int    // index into the sessions being matched
+	Method     string // one of the geminiMatchStrategies names
+	Confidence string // model.Confidence*
+}
+
+// geminiMatchStrategy maps some of pids to sessions. Sessions in claimed are
+// already taken by other processes and must not be returned.
+type geminiMatchStrategy struct {
+	Name  string
+	Match func(snap *platform.Snapshot, families map[int][]int, pids []int, sessions []geminiSessionFile, claimed map[int]bool) map[int]geminiMatch
+}
+
+// geminiMatchStrategies are tried in order; each only sees the PIDs that the
+// earlier ones left unmapped.
+var geminiMatchStrategies = []geminiMatchStrategy{
+	{"open-file", matchGeminiByOpenFiles},
+	{"start-time", matchGeminiByStartTime},
+	{"recent", matchGeminiByRecency},
+}
+
+// matchGeminiSessions maps Gemini parent PIDs sharing one data directory to
+// their session files. families lists each parent with its child processes.
+// Sessions no process is mapped to are left out: they belong to processes
+// that have exited.
+func matchGeminiSessions(snap *platform.Snapshot, families map[int][]int, pids []int, sessions []geminiSessionFile) map[int]geminiMatch {
+	matches := make(map[int]geminiMatch, len(pids))
+	claimed := make(map[int]bool)
+	remaining := pids
+
+	for _, s := range geminiMatchStrategies {
+		if len(remaining) == 0 {
+			break
+		}
+		for pid, m := range s.Match(snap, families, remaining, sessions, claimed) {
+			if claimed[m.Session] {
+				continue
+			}
+			m.Method = s.Name
+			matches[pid] = m
+			claimed[m.Session] = true
+		}
+
+		var next []int
+		for _, pid := range remaining {
+			if _, ok := matches[pid]; !ok {
+				next = append(next, pid)
+			}
+		}
+		remaining = next
+	}
+	return matches
+}
+
+// geminiCandidates returns the indexes of the unclaimed sessions of the
+// project of pid's working directory.
+func geminiCandidates(snap *platform.Snapshot, pid int, sessions []geminiSessionFile, claimed map[int]bool) []int {
+	cwd := snap.Cwd(pid)
+	if cwd == "" || cwd == "-" {
+		return nil
+	}
+	var candidates []int
+	for i := range sessions {
+		if !claimed[i] && sessions[i].ProjectRoot == cwd {
+			candidates = append(candidates, i)
+		}
+	}
+	return candidates
+}
+
+// matchGeminiByOpenFiles looks for a session file among the open files of the
+// process and its children, which catches one being written right now.
+func matchGeminiByOpenFiles(snap *platform.Snapshot, families map[int][]int, pids []int, sessions []geminiSessionFile, claimed map[int]bool) map[int]geminiMatch {
+	byPath := make(map[string]int, len(sessions))
+	for i := range sessions {
+		if !claimed[i] {
+			byPath[sessions[i].Path] = i
+		}
+	}
+
+	found := make(map[int]geminiMatch)
+	for _, pid := range pids {
+		pe := newProcEnv(snap, pid)
+	family:
+		for _, member := range families[pid] {
+			for _, f := range platform.P.ListOpenFiles(member) {
+				if i, ok := byPath[pe.hostPath(f)]; ok {
+					found[pid] = geminiMatch{Session: i, Confidence: model.ConfidenceHigh}
+					break family
+				}
+			}
+		}
+	}
+	return found
+}
+
+// matchGeminiByStartTime gives each session to the process that started it:
+// of the processes in its project, the one that started last before the
+// session's startTime, or else the one that started closest after it, within
+// geminiStartSlack. A process that started several (after /clear) is mapped
+// to the most recently updated of them.
+func matchGeminiByStartTime(snap *platform.Snapshot, _ map[int][]int, pids []int, sessions []geminiSessionFile, claimed map[int]bool) map[int]geminiMatch {
+	type start struct {
+		pid int
+		gap time.Duration // from the process start to the session start
+	}
+	// closer reports whether a is a better starter than b.
+	closer := func(a, b start) bool {
+		if (a.gap >= 0) != (b.gap >= 0) {
+			return a.gap >= 0
+		}
+		return a.gap.Abs() < b.gap.Abs()
+	}
+
+	starters := make(map[int]start) // session index -> its starter
+	for _, pid := range pids {
+		started := startTime(snap, pid)
+		if started.IsZero() {
+			continue
+		}
+		for _, i := range geminiCandidates(snap, pid, sessions, claimed) {
+			st := parseTimestamp(sessions[i].Data.StartTime)
+			if st.IsZero() || st.Before(started.Add(-geminiStartSlack)) {
+				continue
+			}
+			c := start{pid, st.Sub(started)}
+			if prev, ok := starters[i]; !ok || closer(c, prev) {
+				starters[i] = c
+			}
+		}
+	}
+
+	found := make(map[int]geminiMatch)
+	for i, c := range starters {
+		if m, ok := found[c.pid]; !ok || sessions[i].newerThan(&sessions[m.Session]) {
+			found[c.pid] = geminiMatch{Session: i, Confidence: model.ConfidenceMedium}
+		}
+	}
+	return found
+}
+
+// matchGeminiByRecency maps each remaining process, most recently started
+// first, to the most recently updated session of its project that was
+// written since it started. This covers resumed sessions, whose startTime
+// predates the process, but may pick a session of an exited process. A
+// session resumed but not written to since is left unmatched, so its process
+// is reported unknown rather than with a stale session.
+func matchGeminiByRecency(snap *platform.Snapshot, _ map[int][]int, pids []int, sessions []geminiSessionFile, claimed map[int]bool) map[int]geminiMatch {
+	pids = slices.Clone(pids)
+	sort.SliceStable(pids, func(i, j int) bool {
+		return startTime(snap, pids[i]).After(startTime(snap, pids[j]))
+	})
+
+	taken := maps.Clone(claimed)
+	found := make(map[int]geminiMatch)
+	for _, pid := range pids {
+		started := startTime(snap, pid).Add(-geminiStartSlack)
+		best := -1
+		for _, i := range geminiCandidates(snap, pid, sessions, taken) {
+			if sessions[i].updated().Before(started) {
+				continue
+			}
+			if best < 0 || sessions[i].newerThan(&sessions[best]) {
+				best = i
+			}
+		}
+		if best >= 0 {
+			found[pid] = geminiMatch{Session: best, Confidence: model.ConfidenceLow}
+			taken[best] = true
+		}
+	}
+	return found
+}
+
+// updated returns when the session was last written: its lastUpdated, or the
+// file's modification time if that is missing.
+func (f *geminiSessionFile) updated() time.Time {
+	if t := parseTimestamp(f.Data.LastUpdated); !t.IsZero() {
+		return t
+	}
+	return f.ModTime
+}
+
+// newerThan orders sessions by last update, newest first; the session ID
+// breaks ties so that matching is deterministic.
+func (f *geminiSessionFile) newerThan(other *geminiSessionFile) bool {
+	a, b := f.updated(), other.updated()
+	if !a.Equal(b) {
+		return a.After(b)
+	}
+	return f.Data.SessionID > other.Data.SessionID
+}
+
+// geminiCheckpointPrompts bounds how many user prompts are read from the
+// start of a checkpoint to recognise the session it was saved from.
+const geminiCheckpointPrompts = 3
+
+// geminiCheckpoint is a conversation saved with /chat save {tag} as
+// {projectDir}/checkpoint-{tag}.json.
+type geminiCheckpoint struct {
+	Tag     string
+	ModTime time.Time
+	Prompts []string // the first user prompts of the saved history
+}
+
+// geminiCheckpointTag returns the tag of the newest checkpoint in projectDir
+// saved from a session whose first prompt is prompt, or "" if there is none.
+// cache holds the checkpoints already read, by project directory.
+func geminiCheckpointTag(projectDir, prompt string, cache map[string][]geminiCheckpoint) string {
+	if prompt == "" {
+		return ""
+	}
+	checkpoints, ok := cache[projectDir]
+	if !ok {
+		checkpoints = loadGeminiCheckpoints(projectDir)
+		cache[projectDir] = checkpoints
+	}
+	var best *geminiCheckpoint
+	for i, c := range checkpoints {
+		if slices.Contains(c.Prompts, prompt) && (best == nil || c.ModTime.After(best.ModTime)) {
+			best = &checkpoints[i]
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.Tag
+}
+
+// loadGeminiCheckpoints reads the checkpoints of a project directory.
+func loadGeminiCheckpoints(projectDir string) []geminiCheckpoint {
+	entries, err := os.ReadDir(projectDir)
+	if err != nil {
+		return nil
+	}
+	var checkpoints []geminiCheckpoint
+	for _, e := range entries {
+		name, ok := strings.CutPrefix(e.Name(), "checkpoint-")
+		if !ok || e.IsDir() {
+			continue
+		}
+		name, ok = strings.CutSuffix(name, ".json")
+		if !ok {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		// Newer versions percent-encode the tag in the file name.
+		tag, err := url.PathUnescape(name)
+		if err != nil {
+			tag = name
+		}
+		checkpoints = append(checkpoints, geminiCheckpoint{
+			Tag:     tag,
+			ModTime: info.ModTime(),
+			Prompts: readGeminiCheckpointPrompts(filepath.Join(projectDir, e.Name())),
+		})
+	}
+	return checkpoints
+}
+
+// errEnoughPrompts stops decoding a checkpoint once its first prompts are read.
+var errEnoughPrompts = errors.New("enough prompts")
+
+// readGeminiCheckpointPrompts stream-decodes the first user prompts of a
+// checkpoint, whose history is the file itself or its "history" key.
+func readGeminiCheckpointPrompts(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var prompts []string
+	history := func(dec *json.Decoder) error {
+		return decodeArray(dec, func(dec *json.Decoder) error {
+			var c struct {
+				Role  string          `json:"role"`
+				Parts json.RawMessage `json:"parts"`
+			}
+			if err := dec.Decode(&c); err != nil {
+				return err
+			}
+			if c.Role == "user" {
+				if text := strings.TrimSpace(geminiText(c.Parts)); text != "" {
+					prompts = append(prompts, text)
+				}
+			}
+			if len(prompts) == geminiCheckpointPrompts {
+				return errEnoughPrompts
+			}
+			return nil
+		})
+	}
+
+	dec := json.NewDecoder(br)
+	if first, err := peekNonSpace(br); err == nil && first == '{' {
+		decodeObject(dec, map[string]func(*json.Decoder) error{"history": history})
+	} else {
+		history(dec)
+	}
+	return prompts
+}
+
+// peekNonSpace skips JSON whitespace and returns the next byte without
+// consuming it.
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\n', '\r':
+			br.Discard(1)
+		default:
+			return b[0], nil
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/model"
+	"github.com/Eric-Song-Nop/agentstat/internal/platform"
+)
+
+// geminiTestSession returns a session of the /src project started and last
+// updated at the given minutes after t0.
+func geminiTestSession(t0 time.Time, id string, started, updated int) geminiSessionFile {
+	at := func(min int) string { return t0.Add(time.Duration(min) * time.Minute).Format(time.RFC3339) }
+	return geminiSessionFile{
+		Path:        "/gemini/tmp/src/chats/session-" + id + ".json",
+		ModTime:     t0.Add(time.Duration(updated) * time.Minute),
+		ProjectRoot: "/src",
+		Data:        geminiSession{SessionID: id, StartTime: at(started), LastUpdated: at(updated)},
+	}
+}
+
+func TestMatchGeminiSessions(t *testing.T) {
+	t0 := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(min int) time.Time { return t0.Add(time.Duration(min) * time.Minute) }
+
+	type want struct {
+		session    string // "" if unmatched
+		method     string
+		confidence string
+	}
+	tests := []struct {
+		name     string
+		procs    []*platform.Process // parents; child PIDs are PID+1
+		open     map[int][]string
+		sessions []geminiSessionFile
+		want     map[int]want
+	}{
+		{
+			name:     "open file of the child",
+			procs:    []*platform.Process{fakeProcess(10, 1, "/src", at(0))},
+			open:     map[int][]string{11: {"/gemini/tmp/src/chats/session-b.json"}},
+			sessions: []geminiSessionFile{geminiTestSession(t0, "a", 1, 30), geminiTestSession(t0, "b", -60, -50)},
+			want:     map[int]want{10: {"b", "open-file", model.ConfidenceHigh}},
+		},
+		{
+			name: "each session to the process that started last before it",
+			procs: []*platform.Process{
+				fakeProcess(10, 1, "/src", at(0)),
+				fakeProcess(20, 1, "/src", at(10)),
+			},
+			sessions: []geminiSessionFile{
+				geminiTestSession(t0, "a", 1, 40),
+				geminiTestSession(t0, "b", 11, 20),
+				// Started by 10 after /clear, and updated since.
+				geminiTestSession(t0, "c", 5, 45),
+			},
+			want: map[int]want{
+				10: {"c", "start-time", model.ConfidenceMedium},
+				20: {"b", "start-time", model.ConfidenceMedium},
+			},
+		},
+		{
+			name:     "session started just before its process",
+			procs:    []*platform.Process{fakeProcess(10, 1, "/src", at(0))},
+			sessions: []geminiSessionFile{geminiTestSession(t0, "a", 0, 5)},
+			want:     map[int]want{10: {"a", "start-time", model.ConfidenceMedium}},
+		},
+		{
+			name:     "resumed session written since the start",
+			procs:    []*platform.Process{fakeProcess(10, 1, "/src", at(0))},
+			sessions: []geminiSessionFile{geminiTestSession(t0, "a", -120, -60), geminiTestSession(t0, "b", -90, 5)},
+			want:     map[int]want{10: {"b", "recent", model.ConfidenceLow}},
+		},
+		{
+			name: "newest process takes the newest resumed session",
+			procs: []*platform.Process{
+				fakeProcess(10, 1, "/src", at(0)),
+				fakeProcess(20, 1, "/src", at(10)),
+			},
+			sessions: []geminiSessionFile{geminiTestSession(t0, "a", -120, 15), geminiTestSession(t0, "b", -90, 30)},
+			want: map[int]want{
+				10: {"a", "recent", model.ConfidenceLow},
+				20: {"b", "recent", model.ConfidenceLow},
+			},
+		},
+		{
+			name:     "resumed session not written since the start",
+			procs:    []*platform.Process{fakeProcess(10, 1, "/src", at(0))},
+			sessions: []geminiSessionFile{geminiTestSession(t0, "a", -120, -60)},
+			want:     map[int]want{10: {}},
+		},
+		{
+			name:     "session of another project",
+			procs:    []*platform.Process{fakeProcess(10, 1, "/other", at(0))},
+			sessions: []geminiSessionFile{geminiTestSession(t0, "a", 1, 5)},
+			want:     map[int]want{10: {}},
+		},
+		{
+			name: "an open file is claimed before start times",
+			procs: []*platform.Process{
+				fakeProcess(10, 1, "/src", at(0)),
+				fakeProcess(20, 1, "/src", at(10)),
+			},
+			// a was started after 10 but is open in 20 (resumed there).
+			open:     map[int][]string{20: {"/gemini/tmp/src/chats/session-a.json"}},
+			sessions: []geminiSessionFile{geminiTestSession(t0, "a", 1, 15)},
+			want: map[int]want{
+				10: {},
+				20: {"a", "open-file", model.ConfidenceHigh},
+			},
+		},
+		{
+			name: "a session taken by its starter is not given by recency",
+			procs: []*platform.Process{
+				fakeProcess(10, 1, "/src", at(0)),
+				fakeProcess(20, 1, "/src", at(10)),
+			},
+			sessions: []geminiSessionFile{geminiTestSession(t0, "a", 11, 30), geminiTestSession(t0, "b", -60, 20)},
+			want: map[int]want{
+				10: {"b", "recent", model.ConfidenceLow},
+				20: {"a", "start-time", model.ConfidenceMedium},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakePlatform(t, fakePlatform{open: tt.open})
+			var procs []*platform.Process
+			families := make(map[int][]int)
+			var pids []int
+			for _, p := range tt.procs {
+				child := fakeProcess(p.PID+1, p.PID, p.Cwd, p.StartTime.Add(time.Second))
+				procs = append(procs, p, child)
+				families[p.PID] = []int{p.PID, child.PID}
+				pids = append(pids, p.PID)
+			}
+			snap := platform.NewSnapshot(procs)
+
+			matches := matchGeminiSessions(snap, families, pids, tt.sessions)
+			for pid, w := range tt.want {
+				m, ok := matches[pid]
+				if w.session == "" {
+					if ok {
+						t.Errorf("PID %d: matched %s by %s, want no match", pid, tt.sessions[m.Session].Data.SessionID, m.Method)
+					}
+					continue
+				}
+				if !ok {
+					t.Errorf("PID %d: no match, want %s", pid, w.session)
+					continue
+				}
+				got := want{tt.sessions[m.Session].Data.SessionID, m.Method, m.Confidence}
+				if got != w {
+					t.Errorf("PID %d: got %+v, want %+v", pid, got, w)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGeminiProjectDirs(t *testing.T) {
+	geminiDir := t.TempDir()
+	tmp := filepath.Join(geminiDir, "tmp")
+	mkdir := func(name, root string) string {
+		t.Helper()
+		dir := filepath.Join(tmp, name)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if root != "" {
+			if err := os.WriteFile(filepath.Join(dir, ".project_root"), []byte(root+"\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dir
+	}
+	registry := `{"projects":{"/src/registered":"registered","/src/escape":"../outside"}}`
+	if err := os.WriteFile(filepath.Join(geminiDir, "projects.json"), []byte(registry), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	hashed := mkdir(geminiProjectHash("/src/hashed"), "/src/hashed")
+	registered := mkdir("registered", "") // no .project_root: trusted by name
+	mkdir(geminiProjectHash("/src/moved"), "/src/elsewhere")
+	renamed := mkdir("renamed-1", "/src/moved")
+	mkdir("other", "/src/not-running")
+	if err := os.MkdirAll(filepath.Join(geminiDir, "outside"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	got := geminiProjectDirs(geminiDir, []string{"/src/hashed", "/src/registered", "/src/moved", "/src/escape", "/src/missing"})
+	want := map[string]string{
+		hashed:     "/src/hashed",
+		registered: "/src/registered",
+		// The directory named by the hash of /src/moved belongs to another
+		// root; the one whose .project_root names it is used instead.
+		renamed: "/src/moved",
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
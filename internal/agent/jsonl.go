@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"bytes"
+	"io"
+)
+
+// jsonlChunkSize is the initial read size of scanJSONLBackward. It doubles
+// while a single line does not fit, so long lines cost linear time.
+const jsonlChunkSize = 64 * 1024
+
+// scanJSONLBackward calls fn with each non-blank line of r, last line first,
+// until fn returns false or the start of the input is reached. size is the
+// number of bytes of r to consider. offset is the position of the line in r,
+// so a caller can resume reading forward from there. Lines may be of any
+// length and are passed without their line ending (\n or \r\n); the line
+// slice is only valid during the call.
+func scanJSONLBackward(r io.ReaderAt, size int64, fn func(line []byte, offset int64) bool) error {
+	chunk := int64(jsonlChunkSize)
+	pos := size    // start of buf within r
+	var buf []byte // unconsumed bytes [pos, pos+len(buf)), a suffix of which may be a partial line
+
+	for {
+		if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+			line := bytes.TrimSuffix(buf[i+1:], []byte("\r"))
+			buf = buf[:i]
+			if len(bytes.TrimSpace(line)) > 0 && !fn(line, pos+int64(i)+1) {
+				return nil
+			}
+			continue
+		}
+
+		if pos == 0 {
+			// The first line of the input.
+			if len(bytes.TrimSpace(buf)) > 0 {
+				fn(bytes.TrimSuffix(buf, []byte("\r")), 0)
+			}
+			return nil
+		}
+
+		// No complete line left in buf: prepend the previous chunk. Growing
+		// the chunk keeps the copying linear when one line spans many chunks.
+		if int64(len(buf)) >= chunk {
+			chunk *= 2
+		}
+		n := min(chunk, pos)
+		next := make([]byte, n+int64(len(buf)))
+		if _, err := r.ReadAt(next[:n], pos-n); err != nil && err != io.EOF {
+			return err
+		}
+		copy(next[n:], buf)
+		buf = next
+		pos -= n
+	}
+}
@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// scannedLine is one call of the scanJSONLBackward callback.
+type scannedLine struct {
+	line   string
+	offset int64
+}
+
+// scanAll collects what scanJSONLBackward reports for input, up to limit lines
+// (all if limit is 0).
+func scanAll(t *testing.T, input string, limit int) []scannedLine {
+	t.Helper()
+	var got []scannedLine
+	err := scanJSONLBackward(strings.NewReader(input), int64(len(input)), func(line []byte, offset int64) bool {
+		got = append(got, scannedLine{string(line), offset})
+		return limit == 0 || len(got) < limit
+	})
+	if err != nil {
+		t.Fatalf("scanJSONLBackward: %v", err)
+	}
+	return got
+}
+
+func TestScanJSONLBackward(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []scannedLine
+	}{
+		{"empty", "", nil},
+		{"trailing newline", "a\nbb\n", []scannedLine{{"bb", 2}, {"a", 0}}},
+		{"no trailing newline", "a\nbb", []scannedLine{{"bb", 2}, {"a", 0}}},
+		{"blank lines", "\n a\n\n  \nb\n\n", []scannedLine{{"b", 8}, {" a", 1}}},
+		{"CRLF", "a\r\nbb\r\n", []scannedLine{{"bb", 3}, {"a", 0}}},
+		{"CRLF without trailing newline", "a\r\nbb", []scannedLine{{"bb", 3}, {"a", 0}}},
+		{"only the first line", "first\r", []scannedLine{{"first", 0}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scanAll(t, tt.input, 0); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestScanJSONLBackwardChunks checks lines around the chunk boundaries, and
+// lines longer than a chunk, against a forward split of the same input.
+func TestScanJSONLBackwardChunks(t *testing.T) {
+	var b strings.Builder
+	var want []scannedLine
+	add := func(line, ending string) {
+		want = append(want, scannedLine{line, int64(b.Len())})
+		b.WriteString(line + ending)
+	}
+	for i := 0; b.Len() < 3*jsonlChunkSize; i++ {
+		// Line lengths cycle so that boundaries fall at every position of
+		// a line, including right before and after a newline.
+		add(fmt.Sprintf(`{"n":%d,"pad":"%s"}`, i, strings.Repeat("x", i%97)), "\n")
+		if i == 1000 {
+			add(strings.Repeat("y", 2*jsonlChunkSize+3), "\r\n")
+		}
+	}
+	add(`{"last":true}`, "")
+	slices.Reverse(want)
+
+	input := b.String()
+	got := scanAll(t, input, 0)
+	if len(got) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("line %d = %.40q at %d, want %.40q at %d", i, got[i].line, got[i].offset, want[i].line, want[i].offset)
+		}
+		if !strings.HasPrefix(input[got[i].offset:], got[i].line) {
+			t.Fatalf("line %d is not at offset %d", i, got[i].offset)
+		}
+	}
+}
+
+func TestScanJSONLBackwardStops(t *testing.T) {
+	got := scanAll(t, "a\nb\nc\n", 2)
+	want := []scannedLine{{"c", 4}, {"b", 2}}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -3,8 +3,12 @@ package agent
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
-	"strings"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/Eric-Song-Nop/agentstat/internal/model"
@@ -13,8 +17,15 @@ import (
 
 // openCodeInstance represents a discovered OpenCode TUI instance.
 type openCodeInstance struct {
-	Port int
-	PID  int
+	Port    int
+	PID     int
+	Addr    string // bind address reported by FindListenTCP
+	Dir     string // working directory of the process, "-" if unknown
+	Started int64  // process start in Unix milliseconds, 0 if unknown
+	DataDir string // holds opencode.db, "" if unknown
+	// Basic auth credentials for the API, from the config or the process's
+	// OPENCODE_SERVER_USERNAME/OPENCODE_SERVER_PASSWORD; none if Password is "".
+	Username, Password string
 }
 
 // sessionStatusEntry represents one entry from /session/status response.
@@ -22,9 +33,16 @@ type sessionStatusEntry struct {
 	Type string `json:"type"` // "busy", "retry", etc.
 }
 
+// permissionEntry represents one pending request from /permission response.
+type permissionEntry struct {
+	ID        string `json:"id"`
+	SessionID string `json:"sessionID"`
+}
+
 // sessionListEntry represents one session from /session response.
 type sessionListEntry struct {
 	ID        string `json:"id"`
+	ParentID  string `json:"parentID"` // set for sessions spawned by a subagent task
 	Title     string `json:"title"`
 	Directory string `json:"directory"`
 	Time      struct {
@@ -32,97 +50,339 @@ type sessionListEntry struct {
 	} `json:"time"`
 }
 
+// messageEntry represents one message from /session/{id}/message response.
+type messageEntry struct {
+	Info struct {
+		ID        string          `json:"id"`
+		SessionID string          `json:"sessionID"`
+		Role      string          `json:"role"`
+		ModelID   string          `json:"modelID"` // assistant messages
+		Cost      float64         `json:"cost"`    // USD, assistant messages
+		Summary   bool            `json:"summary"` // assistant message produced by a compaction
+		Error     json.RawMessage `json:"error"`   // set on failed or aborted responses
+		Time      struct {
+			Completed int64 `json:"completed"` // 0 while the message is being generated
+		} `json:"time"`
+		Tokens struct {
+			Input     int64 `json:"input"`
+			Output    int64 `json:"output"`
+			Reasoning int64 `json:"reasoning"`
+			Cache     struct {
+				Read  int64 `json:"read"`
+				Write int64 `json:"write"`
+			} `json:"cache"`
+		} `json:"tokens"`
+	} `json:"info"`
+	Parts []messagePart `json:"parts"`
+}
+
+// failed reports whether m is a response that failed or was aborted. Servers
+// may send the error as null when there is none.
+func (m messageEntry) failed() bool {
+	return len(m.Info.Error) > 0 && string(m.Info.Error) != "null"
+}
+
+// messagePart is one part of a message. Only tool parts are of interest.
+type messagePart struct {
+	ID        string `json:"id"`
+	SessionID string `json:"sessionID"`
+	MessageID string `json:"messageID"`
+	Type      string `json:"type"` // "text" | "reasoning" | "tool" | ...
+	Tool      string `json:"tool"` // tool parts
+	State     struct {
+		Status string          `json:"status"` // "pending" | "running" | "completed" | "error"
+		Input  json.RawMessage `json:"input"`
+	} `json:"state"`
+}
+
+// httpClient is used for all OpenCode API requests; its timeout comes from the config.
 var httpClient = &http.Client{Timeout: 500 * time.Millisecond}
 
 // DiscoverOpenCode finds all running OpenCode instances.
-// Each process = one AgentSession. Status is "busy"/"retry" if any session is active, otherwise "idle".
-func DiscoverOpenCode() []model.AgentSession {
-	instances := findOpenCodeInstances()
+// Each busy, retrying or waiting session is one AgentSession; an instance
+// with none of those is reported once, as idle.
+func DiscoverOpenCode(snap *platform.Snapshot) []model.AgentSession {
+	instances := findOpenCodeInstances(snap)
 	if len(instances) == 0 {
 		return nil
 	}
-	return ConcurrentProbe(instances, queryOpenCodeInstance)
+	httpClient = &http.Client{Timeout: conf.Agent("opencode").Timeout.Duration}
+	usage := loadOpenCodeUsageCache()
+	sessions := ConcurrentProbeAll(instances, func(inst openCodeInstance) []model.AgentSession {
+		return queryOpenCodeInstance(inst, usage)
+	})
+	usage.save()
+	return withProcessInfo(snap, sessions)
 }
 
-// findOpenCodeInstances uses FindListenTCP to discover all opencode listening ports.
-// Deduplicates by PID (a single process may listen on multiple ports).
-func findOpenCodeInstances() []openCodeInstance {
-	entries := platform.P.FindListenTCP()
+// findOpenCodeInstances finds the listening ports of the OpenCode processes
+// with FindListenTCP. Deduplicates by PID (a single process may listen on
+// multiple ports).
+func findOpenCodeInstances(snap *platform.Snapshot) []openCodeInstance {
+	entries := platform.P.FindListenTCP(findOpenCodePIDs(snap))
 
 	seen := make(map[int]bool)
 	var instances []openCodeInstance
 	for _, e := range entries {
-		if strings.EqualFold(e.Cmd, "opencode") && !seen[e.PID] {
+		if !seen[e.PID] {
 			seen[e.PID] = true
-			instances = append(instances, openCodeInstance{Port: e.Port, PID: e.PID})
+			inst := openCodeInstance{Port: e.Port, PID: e.PID, Addr: e.Addr, Dir: snap.Cwd(e.PID)}
+			if t := startTime(snap, e.PID); !t.IsZero() {
+				inst.Started = t.UnixMilli()
+			}
+			pe := newProcEnv(snap, e.PID)
+			inst.Username, inst.Password = openCodeCredentials(pe)
+			inst.DataDir = pe.openCodeDataDir()
+			instances = append(instances, inst)
 		}
 	}
 	return instances
 }
 
-// queryOpenCodeInstance queries a single OpenCode process and returns one AgentSession.
-// Only populates session metadata (ID, title, directory) when busy.
-// When idle, those fields are left empty — we can't reliably determine which session the TUI is viewing.
-func queryOpenCodeInstance(inst openCodeInstance) *model.AgentSession {
-	base := fmt.Sprintf("http://localhost:%d", inst.Port)
+// findOpenCodePIDs returns PIDs of OpenCode processes from the process table.
+// The configured regex matches the command name, so it is applied to the base
+// name of argv[0].
+func findOpenCodePIDs(snap *platform.Snapshot) []int {
+	re := processRegexp("opencode")
+	var pids []int
+	for _, pid := range snap.PIDs() {
+		if p := snap.Get(pid); len(p.Argv) > 0 && re.MatchString(filepath.Base(p.Argv[0])) {
+			pids = append(pids, pid)
+		}
+	}
+	return filterOwnPIDs(snap, pids)
+}
+
+// openCodeCredentials returns the basic auth credentials of an OpenCode
+// server: the configured ones, else those the process was started with.
+// OpenCode's default user name is "opencode".
+func openCodeCredentials(pe *procEnv) (username, password string) {
+	c := conf.Agent("opencode")
+	username, password = c.Username, c.Password
+	if password == "" {
+		username, password = pe.getenv("OPENCODE_SERVER_USERNAME"), pe.getenv("OPENCODE_SERVER_PASSWORD")
+	}
+	if username == "" {
+		username = "opencode"
+	}
+	return username, password
+}
+
+// openCodeState is the session state of one OpenCode instance, as fetched
+// from its API or maintained from its event stream.
+type openCodeState struct {
+	Status   map[string]sessionStatusEntry // by session ID; idle sessions may be absent
+	Sessions []sessionListEntry
+	Waiting  map[string]bool // sessions with a pending permission request
+}
 
-	statusMap := fetchSessionStatus(base)
+// baseURL returns the URL of the instance's API, reached through its bind
+// address (see platform.ListenEntry.HostPort).
+func (inst openCodeInstance) baseURL() string {
+	return "http://" + platform.ListenEntry{Addr: inst.Addr, Port: inst.Port}.HostPort()
+}
 
-	// If any session is busy/retry, report that session's metadata.
-	for id, entry := range statusMap {
-		result := &model.AgentSession{
+// authorize adds the instance's basic auth credentials to req, if it has any.
+func (inst openCodeInstance) authorize(req *http.Request) {
+	if inst.Password != "" {
+		req.SetBasicAuth(inst.Username, inst.Password)
+	}
+}
+
+// queryOpenCodeInstance queries a single OpenCode process and returns its
+// sessions (see openCodeSessions). When the API cannot be used, the sessions
+// are read from the instance's database instead (see readOpenCodeDB); if that
+// fails too, the instance is reported with unknown status. usage may be nil.
+func queryOpenCodeInstance(inst openCodeInstance, usage *openCodeUsageCache) []model.AgentSession {
+	status, err := fetchSessionStatus(inst)
+	if err != nil {
+		if sessions := readOpenCodeDB(inst); len(sessions) > 0 {
+			return sessions
+		}
+		return []model.AgentSession{{
 			Agent:     "opencode",
-			Status:    entry.Type,
+			Status:    model.StatusUnknown,
+			Directory: inst.Dir,
+			PID:       inst.PID,
+			Address:   inst.address(),
+		}}
+	}
+
+	st := openCodeState{
+		Status:   status,
+		Sessions: fetchSessionList(inst),
+		Waiting:  make(map[string]bool),
+	}
+	for _, p := range fetchPendingPermissions(inst) {
+		st.Waiting[p.SessionID] = true
+	}
+	return openCodeSessions(inst, st, func(id string) openCodeMessages {
+		msgs, err := fetchSessionMessages(inst, id, usage)
+		if err != nil {
+			warnOpenCodeMessages(inst, id, err)
+		}
+		return msgs
+	})
+}
+
+// warnOpenCodeMessages reports that the messages of a session could not be
+// fetched, which leaves its usage, cost and activity unknown.
+func warnOpenCodeMessages(inst openCodeInstance, id string, err error) {
+	warnOnce("opencode on port %d: cannot fetch the messages of session %s: %v; usage unavailable (a long session may need a higher timeout)", inst.Port, id, err)
+}
+
+// address returns the instance's listening address for display.
+func (inst openCodeInstance) address() string {
+	return net.JoinHostPort(inst.Addr, strconv.Itoa(inst.Port))
+}
+
+// openCodeSessions returns one AgentSession per active session of an
+// instance, most recently updated first; a session with a pending permission
+// request is blocked on the user. An instance without active sessions yields
+// one idle AgentSession for its most recently updated top-level session. The
+// API does not expose which session the TUI is showing, so that is the best
+// guess; the session fields stay empty if the instance has no sessions at
+// all. messages returns the messages of a session, for its usage.
+func openCodeSessions(inst openCodeInstance, st openCodeState, messages func(id string) openCodeMessages) []model.AgentSession {
+	addr := inst.address()
+
+	// Most recently updated first; the ID breaks ties so rows keep their order.
+	list := slices.Clone(st.Sessions)
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Time.Updated != list[j].Time.Updated {
+			return list[i].Time.Updated > list[j].Time.Updated
+		}
+		return list[i].ID < list[j].ID
+	})
+	byID := make(map[string]sessionListEntry, len(list))
+	for _, s := range list {
+		byID[s.ID] = s
+	}
+
+	var active []string
+	for id, entry := range st.Status {
+		if entry.Type != model.StatusIdle {
+			active = append(active, id)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool {
+		a, b := byID[active[i]], byID[active[j]]
+		if a.Time.Updated != b.Time.Updated {
+			return a.Time.Updated > b.Time.Updated
+		}
+		return active[i] < active[j]
+	})
+
+	var results []model.AgentSession
+	for _, id := range active {
+		result := model.AgentSession{
+			Agent:     "opencode",
+			Status:    st.Status[id].Type,
 			SessionID: id,
 			PID:       inst.PID,
+			Address:   addr,
+		}
+		if st.Waiting[id] {
+			result.Status = model.StatusWaitingApproval
+		}
+		if s, ok := byID[id]; ok {
+			applySessionInfo(&result, s)
+		}
+		msgs := messages(id)
+		applySessionUsage(&result, msgs)
+		result.Activity = openCodeActivity(msgs.Latest)
+		results = append(results, result)
+	}
+	if len(results) > 0 {
+		return results
+	}
+
+	// No active session — report idle with the latest top-level session.
+	result := model.AgentSession{
+		Agent:   "opencode",
+		Status:  model.StatusIdle,
+		PID:     inst.PID,
+		Address: addr,
+	}
+	for _, s := range list {
+		if s.ParentID == "" {
+			result.SessionID = s.ID
+			applySessionInfo(&result, s)
+			applySessionUsage(&result, messages(s.ID))
+			break
 		}
-		// Enrich with title/directory from session list.
-		if sessions := fetchSessionList(base); sessions != nil {
-			for _, s := range sessions {
-				if s.ID == id {
-					result.Title = s.Title
-					result.Directory = s.Directory
-					break
-				}
+	}
+	return []model.AgentSession{result}
+}
+
+// openCodeActivity describes the latest tool part that is pending or
+// running, or returns "" if there is none.
+func openCodeActivity(messages []messageEntry) string {
+	for _, m := range slices.Backward(messages) {
+		for _, p := range slices.Backward(m.Parts) {
+			if p.Type == "tool" && (p.State.Status == "pending" || p.State.Status == "running") {
+				return toolActivity(p.Tool, p.State.Input)
 			}
 		}
-		return result
 	}
+	return ""
+}
 
-	// No busy session — report idle with no session metadata.
-	return &model.AgentSession{
-		Agent:  "opencode",
-		Status: model.StatusIdle,
-		PID:    inst.PID,
+// applySessionInfo copies the title, directory and update time of a
+// /session entry into s.
+func applySessionInfo(s *model.AgentSession, e sessionListEntry) {
+	s.Title = e.Title
+	s.Directory = e.Directory
+	if e.Time.Updated > 0 {
+		s.LastActivityAt = time.UnixMilli(e.Time.Updated)
 	}
 }
 
-// fetchSessionList calls GET /session and returns the session list.
-func fetchSessionList(base string) []sessionListEntry {
-	resp, err := httpClient.Get(base + "/session")
+// getOpenCodeJSON calls GET path on the instance's API and decodes the JSON
+// response into v. Responses other than 200 OK are errors, so a server that
+// wants credentials agentstat does not have fails like an unreachable one.
+func getOpenCodeJSON(inst openCodeInstance, path string, v any) error {
+	req, err := http.NewRequest(http.MethodGet, inst.baseURL()+path, nil)
 	if err != nil {
-		return nil
+		return err
+	}
+	inst.authorize(req)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
 
+// fetchSessionList calls GET /session and returns the session list.
+func fetchSessionList(inst openCodeInstance) []sessionListEntry {
 	var sessions []sessionListEntry
-	if err := json.NewDecoder(resp.Body).Decode(&sessions); err != nil {
+	if getOpenCodeJSON(inst, "/session", &sessions) != nil {
 		return nil
 	}
 	return sessions
 }
 
 // fetchSessionStatus calls GET /session/status and returns the status map.
-func fetchSessionStatus(base string) map[string]sessionStatusEntry {
-	resp, err := httpClient.Get(base + "/session/status")
-	if err != nil {
-		return nil
+// An error means the API is unusable, e.g. unreachable or password-protected.
+func fetchSessionStatus(inst openCodeInstance) (map[string]sessionStatusEntry, error) {
+	var statusMap map[string]sessionStatusEntry
+	if err := getOpenCodeJSON(inst, "/session/status", &statusMap); err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
+	return statusMap, nil
+}
 
-	var statusMap map[string]sessionStatusEntry
-	if err := json.NewDecoder(resp.Body).Decode(&statusMap); err != nil {
+// fetchPendingPermissions calls GET /permission and returns the permission
+// requests awaiting a reply. Servers without the endpoint yield nil.
+func fetchPendingPermissions(inst openCodeInstance) []permissionEntry {
+	var pending []permissionEntry
+	if getOpenCodeJSON(inst, "/permission", &pending) != nil {
 		return nil
 	}
-	return statusMap
+	return pending
 }
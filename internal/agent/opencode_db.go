@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/model"
+)
+
+// openCodeDBMaxSessions bounds how many of a directory's sessions are read
+// from opencode.db, most recently updated first.
+const openCodeDBMaxSessions = 20
+
+// readOpenCodeDB reads the sessions of an instance from {dataDir}/opencode.db,
+// opened read-only, for when its API cannot be used (see openCodeSessions).
+// Only sessions of the instance's working directory are considered. One
+// updated since the process started is busy while its last message is a
+// prompt or an unfinished response. Pending permissions are not stored, so
+// waiting cannot be told apart from busy.
+func readOpenCodeDB(inst openCodeInstance) []model.AgentSession {
+	if inst.DataDir == "" || inst.Dir == "-" {
+		return nil
+	}
+	dbPath := filepath.Join(inst.DataDir, "opencode.db")
+	busy := conf.Agent("opencode").Timeout.Milliseconds()
+	db, err := sql.Open("sqlite", fmt.Sprintf("%s?mode=ro&_journal_mode=WAL&_pragma=busy_timeout(%d)", dbPath, busy))
+	if err != nil {
+		return nil
+	}
+	defer db.Close()
+
+	rows, err := db.Query(
+		`SELECT id, COALESCE(parent_id, ''), COALESCE(title, ''), directory, time_updated
+		FROM session WHERE directory = ? ORDER BY time_updated DESC LIMIT ?`,
+		inst.Dir, openCodeDBMaxSessions,
+	)
+	if err != nil {
+		return nil
+	}
+	var list []sessionListEntry
+	for rows.Next() {
+		var e sessionListEntry
+		if rows.Scan(&e.ID, &e.ParentID, &e.Title, &e.Directory, &e.Time.Updated) == nil {
+			list = append(list, e)
+		}
+	}
+	rows.Close()
+	if len(list) == 0 {
+		return nil
+	}
+
+	st := openCodeState{Status: make(map[string]sessionStatusEntry), Sessions: list}
+	for _, e := range list {
+		if e.Time.Updated < inst.Started {
+			break // sorted: the rest are older still
+		}
+		if last := readOpenCodeDBMessages(db, e.ID, 1); len(last) == 1 && openCodeMessagePending(last[0]) {
+			st.Status[e.ID] = sessionStatusEntry{Type: model.StatusBusy}
+		}
+	}
+	return openCodeSessions(inst, st, func(id string) openCodeMessages {
+		msgs := readOpenCodeDBMessages(db, id, -1)
+		// Queried newest first; usage wants them in order.
+		slices.Reverse(msgs)
+		return openCodeMessages{Latest: msgs}
+	})
+}
+
+// readOpenCodeDBMessages returns up to limit (-1: all) messages of a session,
+// newest first. The data column holds the message info as the API returns it.
+func readOpenCodeDBMessages(db *sql.DB, sessionID string, limit int) []messageEntry {
+	rows, err := db.Query(
+		`SELECT id, data FROM message WHERE session_id = ? ORDER BY time_created DESC, id DESC LIMIT ?`,
+		sessionID, limit,
+	)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var msgs []messageEntry
+	for rows.Next() {
+		var id string
+		var data []byte
+		if rows.Scan(&id, &data) != nil {
+			continue
+		}
+		var m messageEntry
+		if json.Unmarshal(data, &m.Info) != nil {
+			continue
+		}
+		m.Info.ID, m.Info.SessionID = id, sessionID
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+// openCodeMessagePending reports whether a session whose last message is m
+// is still working: m is a prompt awaiting its response, or a response that
+// is neither completed nor failed.
+func openCodeMessagePending(m messageEntry) bool {
+	switch m.Info.Role {
+	case "user":
+		return true
+	case "assistant":
+		return m.Info.Time.Completed == 0 && !m.failed()
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/model"
+)
+
+func TestReadOpenCodeDB(t *testing.T) {
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite", filepath.Join(dir, "opencode.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	exec := func(query string, args ...any) {
+		t.Helper()
+		if _, err := db.Exec(query, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exec(`CREATE TABLE session (id TEXT PRIMARY KEY, parent_id TEXT, title TEXT, directory TEXT, time_updated INTEGER)`)
+	exec(`CREATE TABLE message (id TEXT PRIMARY KEY, session_id TEXT, time_created INTEGER, data TEXT)`)
+
+	// The last message of each session decides whether it is busy.
+	sessions := []struct{ id, last string }{
+		{"generating", `{"role":"assistant","time":{"completed":0},"error":null}`},
+		{"aborted", `{"role":"assistant","time":{"completed":0},"error":{"name":"MessageAbortedError"}}`},
+		{"prompted", `{"role":"user"}`},
+		{"done", `{"role":"assistant","time":{"completed":2000},"tokens":{"input":10}}`},
+	}
+	for i, s := range sessions {
+		exec(`INSERT INTO session VALUES (?, NULL, ?, '/src', ?)`, s.id, "title "+s.id, 2000+i)
+		exec(`INSERT INTO message VALUES (?, ?, 1000, ?)`, s.id+"-1", s.id, `{"role":"user"}`)
+		exec(`INSERT INTO message VALUES (?, ?, 1001, ?)`, s.id+"-2", s.id, s.last)
+	}
+	// Sessions not updated since the process started are idle.
+	exec(`INSERT INTO session VALUES ('old', NULL, 'old', '/src', 500)`)
+	exec(`INSERT INTO message VALUES ('old-1', 'old', 400, '{"role":"user"}')`)
+
+	inst := openCodeInstance{PID: 42, Dir: "/src", DataDir: dir, Started: 1000}
+	var busy []string
+	for _, s := range readOpenCodeDB(inst) {
+		if s.Status != model.StatusBusy {
+			t.Errorf("%s: status %q, want busy", s.SessionID, s.Status)
+		}
+		busy = append(busy, s.SessionID)
+	}
+	if want := []string{"prompted", "generating"}; !slices.Equal(busy, want) {
+		t.Errorf("busy sessions %v, want %v", busy, want)
+	}
+
+	// Without a busy session, the latest one is reported idle with its usage.
+	exec(`DELETE FROM session WHERE id IN ('generating', 'prompted')`)
+	got := readOpenCodeDB(inst)
+	if len(got) != 1 || got[0].SessionID != "done" || got[0].Status != model.StatusIdle || got[0].Usage.InputTokens != 10 {
+		t.Errorf("got %+v, want session done idle with 10 input tokens", got)
+	}
+}
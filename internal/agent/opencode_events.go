@@ -0,0 +1,537 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/model"
+	"github.com/Eric-Song-Nop/agentstat/internal/platform"
+)
+
+// openCodeEventPaths are the event stream endpoints, tried in order: the
+// instance's own stream, then the global one of newer servers.
+var openCodeEventPaths = []string{"/event", "/global/event"}
+
+// openCodeReconnectDelay is how long a dropped event stream waits before
+// reconnecting. Each failed attempt doubles the delay, up to
+// openCodeMaxReconnectDelay. Variables so that tests can shorten them.
+var (
+	openCodeReconnectDelay    = time.Second
+	openCodeMaxReconnectDelay = time.Minute
+)
+
+// openCodeIdleTimeout is how long an event stream may stay silent before the
+// connection is taken to be lost. Servers send a server.heartbeat event every
+// 30 seconds on an otherwise quiet stream.
+var openCodeIdleTimeout = 75 * time.Second
+
+// errNoOpenCodeEventStream means that the server has no event stream, so
+// reconnecting is pointless.
+var errNoOpenCodeEventStream = errors.New("no event stream")
+
+// openCodeEvent is one server-sent event of OpenCode. /global/event wraps it
+// in a payload, next to the directory of the instance it belongs to.
+type openCodeEvent struct {
+	Type       string          `json:"type"`
+	Properties json.RawMessage `json:"properties"`
+	Payload    *struct {
+		Type       string          `json:"type"`
+		Properties json.RawMessage `json:"properties"`
+	} `json:"payload"`
+}
+
+// OpenCodeMonitor follows the event stream of every OpenCode instance it has
+// discovered and keeps their session state in memory, so that watch mode sees
+// status changes and permission prompts as they happen instead of polling.
+type OpenCodeMonitor struct {
+	onChange func()
+
+	mu      sync.Mutex
+	streams map[int]*openCodeStream // by PID
+}
+
+// NewOpenCodeMonitor returns a monitor that calls onChange, from its own
+// goroutines, whenever an event changes the state of an instance. Configure
+// must have been called.
+func NewOpenCodeMonitor(onChange func()) *OpenCodeMonitor {
+	// Set once: the streams' goroutines use the client from now on.
+	httpClient = &http.Client{Timeout: conf.Agent("opencode").Timeout.Duration}
+	return &OpenCodeMonitor{onChange: onChange, streams: make(map[int]*openCodeStream)}
+}
+
+// Discover is DiscoverOpenCode served from the event streams. Streams are
+// opened for new instances, reopened when an instance's port changed and
+// closed for instances that exited. Instances whose stream is not connected
+// are queried directly.
+func (m *OpenCodeMonitor) Discover(snap *platform.Snapshot) []model.AgentSession {
+	instances := findOpenCodeInstances(snap)
+
+	m.mu.Lock()
+	seen := make(map[int]bool, len(instances))
+	streams := make([]*openCodeStream, 0, len(instances))
+	for _, inst := range instances {
+		seen[inst.PID] = true
+		s := m.streams[inst.PID]
+		if s == nil || s.inst != inst {
+			if s != nil {
+				s.close()
+			}
+			s = startOpenCodeStream(inst, m.onChange)
+			m.streams[inst.PID] = s
+		}
+		streams = append(streams, s)
+	}
+	for pid, s := range m.streams {
+		if !seen[pid] {
+			s.close()
+			delete(m.streams, pid)
+		}
+	}
+	m.mu.Unlock()
+
+	if len(streams) == 0 {
+		return nil
+	}
+	// Flushed rather than saved: sessions fetched by an earlier call stay.
+	usage := loadOpenCodeUsageCache()
+	sessions := ConcurrentProbeAll(streams, func(s *openCodeStream) []model.AgentSession {
+		return s.agentSessions(usage)
+	})
+	usage.flush()
+	return withProcessInfo(snap, sessions)
+}
+
+// Polling reports whether some instance has no connected event stream, so
+// that its state only changes when Discover queries it.
+func (m *OpenCodeMonitor) Polling() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.streams {
+		if !s.isLive() {
+			return true
+		}
+	}
+	return false
+}
+
+// Close disconnects all event streams.
+func (m *OpenCodeMonitor) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for pid, s := range m.streams {
+		s.close()
+		delete(m.streams, pid)
+	}
+}
+
+// openCodeStream is the event stream of one OpenCode instance and the session
+// state built from it.
+type openCodeStream struct {
+	inst     openCodeInstance
+	onChange func()
+	client   *http.Client // without an overall timeout, which would end the stream
+	cancel   context.CancelFunc
+
+	mu       sync.Mutex
+	live     bool // connected, with the initial state loaded
+	status   map[string]sessionStatusEntry
+	sessions map[string]sessionListEntry
+	pending  map[string]map[string]bool  // session ID -> pending permission IDs
+	messages map[string]openCodeMessages // by session ID, once fetched for a report
+}
+
+// startOpenCodeStream connects to the event stream of inst in the background.
+func startOpenCodeStream(inst openCodeInstance, onChange func()) *openCodeStream {
+	timeout := conf.Agent("opencode").Timeout.Duration
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &openCodeStream{
+		inst:     inst,
+		onChange: onChange,
+		client: &http.Client{Transport: &http.Transport{
+			DialContext:           (&net.Dialer{Timeout: timeout}).DialContext,
+			ResponseHeaderTimeout: timeout,
+		}},
+		cancel: cancel,
+	}
+	go s.run(ctx)
+	return s
+}
+
+// run keeps the stream connected until ctx is cancelled, reconnecting after a
+// delay whenever it drops; the delay grows while attempts fail. It gives up
+// if the server has no event stream, leaving the instance to be queried
+// directly.
+func (s *openCodeStream) run(ctx context.Context) {
+	delay := openCodeReconnectDelay
+	for {
+		err := s.follow(ctx)
+		s.mu.Lock()
+		wasLive := s.live
+		s.live = false
+		s.mu.Unlock()
+		if wasLive && ctx.Err() == nil {
+			s.onChange()
+		}
+		if errors.Is(err, errNoOpenCodeEventStream) {
+			return
+		}
+
+		if wasLive {
+			delay = openCodeReconnectDelay
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, openCodeMaxReconnectDelay)
+	}
+}
+
+// follow connects to the event stream, loads the current state and applies
+// events to it until the stream ends, or stays silent for
+// openCodeIdleTimeout.
+func (s *openCodeStream) follow(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	body, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	// A connection lost without a reset never ends the read by itself.
+	idle := time.AfterFunc(openCodeIdleTimeout, cancel)
+	defer idle.Stop()
+
+	// Load the state only once connected, so no event in between is missed.
+	status, err := fetchSessionStatus(s.inst)
+	if err != nil {
+		return err
+	}
+	list := fetchSessionList(s.inst)
+	permissions := fetchPendingPermissions(s.inst)
+
+	s.mu.Lock()
+	s.status = make(map[string]sessionStatusEntry, len(status))
+	maps.Copy(s.status, status)
+	s.sessions = make(map[string]sessionListEntry, len(list))
+	for _, e := range list {
+		s.sessions[e.ID] = e
+	}
+	s.pending = make(map[string]map[string]bool)
+	for _, p := range permissions {
+		s.addPendingLocked(p.SessionID, p.ID)
+	}
+	s.messages = make(map[string]openCodeMessages)
+	s.live = true
+	s.mu.Unlock()
+	s.onChange()
+
+	return readServerSentEvents(body, func() { idle.Reset(openCodeIdleTimeout) }, func(data []byte) {
+		if s.apply(data) {
+			s.onChange()
+		}
+	})
+}
+
+// connect opens the first event stream endpoint the server provides. It
+// returns errNoOpenCodeEventStream if every endpoint is missing (404) or
+// answers with something other than an event stream.
+func (s *openCodeStream) connect(ctx context.Context) (io.ReadCloser, error) {
+	missing := true
+	for _, path := range openCodeEventPaths {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.inst.baseURL()+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "text/event-stream")
+		s.inst.authorize(req)
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+			return resp.Body, nil
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+			missing = false
+		}
+	}
+	if missing {
+		return nil, fmt.Errorf("opencode on port %d: %w", s.inst.Port, errNoOpenCodeEventStream)
+	}
+	return nil, fmt.Errorf("opencode on port %d: event stream unavailable", s.inst.Port)
+}
+
+// apply updates the state from one event and reports whether it changed
+// anything a report shows.
+func (s *openCodeStream) apply(data []byte) bool {
+	var ev openCodeEvent
+	if json.Unmarshal(data, &ev) != nil {
+		return false
+	}
+	typ, props := ev.Type, ev.Properties
+	if ev.Payload != nil {
+		typ, props = ev.Payload.Type, ev.Payload.Properties
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch typ {
+	case "session.status":
+		var p struct {
+			SessionID string             `json:"sessionID"`
+			Status    sessionStatusEntry `json:"status"`
+		}
+		if json.Unmarshal(props, &p) != nil {
+			return false
+		}
+		if p.Status.Type == model.StatusIdle {
+			delete(s.status, p.SessionID)
+		} else {
+			s.status[p.SessionID] = p.Status
+		}
+	case "session.idle":
+		var p struct {
+			SessionID string `json:"sessionID"`
+		}
+		if json.Unmarshal(props, &p) != nil {
+			return false
+		}
+		delete(s.status, p.SessionID)
+	case "session.created", "session.updated":
+		var p struct {
+			Info sessionListEntry `json:"info"`
+		}
+		if json.Unmarshal(props, &p) != nil {
+			return false
+		}
+		s.sessions[p.Info.ID] = p.Info
+	case "session.deleted":
+		var p struct {
+			Info sessionListEntry `json:"info"`
+		}
+		if json.Unmarshal(props, &p) != nil {
+			return false
+		}
+		delete(s.sessions, p.Info.ID)
+		delete(s.status, p.Info.ID)
+		delete(s.pending, p.Info.ID)
+		delete(s.messages, p.Info.ID)
+	case "permission.updated", "permission.asked":
+		var p permissionEntry
+		if json.Unmarshal(props, &p) != nil {
+			return false
+		}
+		s.addPendingLocked(p.SessionID, p.ID)
+	case "permission.replied":
+		var p struct {
+			SessionID    string `json:"sessionID"`
+			PermissionID string `json:"permissionID"`
+			RequestID    string `json:"requestID"` // newer servers
+		}
+		if json.Unmarshal(props, &p) != nil {
+			return false
+		}
+		delete(s.pending[p.SessionID], p.PermissionID)
+		delete(s.pending[p.SessionID], p.RequestID)
+		if len(s.pending[p.SessionID]) == 0 {
+			delete(s.pending, p.SessionID)
+		}
+	case "message.updated":
+		var m messageEntry
+		if json.Unmarshal(props, &m) != nil {
+			return false
+		}
+		msgs, ok := s.messages[m.Info.SessionID]
+		if !ok {
+			// Not reported so far; fetched in full when it is.
+			return false
+		}
+		i := slices.IndexFunc(msgs.Latest, func(e messageEntry) bool { return e.Info.ID == m.Info.ID })
+		if i >= 0 {
+			// The event carries the info only; parts have events of their own.
+			m.Parts = msgs.Latest[i].Parts
+			msgs.Latest[i] = m
+		} else {
+			msgs.Latest = append(msgs.Latest, m)
+			s.messages[m.Info.SessionID] = msgs
+		}
+	case "message.part.updated":
+		var p struct {
+			Part messagePart `json:"part"`
+		}
+		if json.Unmarshal(props, &p) != nil || p.Part.Type != "tool" {
+			// Text and reasoning parts stream in many small updates; only
+			// tool parts are shown.
+			return false
+		}
+		msg := s.messageLocked(p.Part.SessionID, p.Part.MessageID)
+		if msg == nil {
+			return false
+		}
+		i := slices.IndexFunc(msg.Parts, func(e messagePart) bool { return e.ID == p.Part.ID })
+		if i >= 0 {
+			msg.Parts[i] = p.Part
+		} else {
+			msg.Parts = append(msg.Parts, p.Part)
+		}
+	case "message.part.removed":
+		var p struct {
+			SessionID string `json:"sessionID"`
+			MessageID string `json:"messageID"`
+			PartID    string `json:"partID"`
+		}
+		if json.Unmarshal(props, &p) != nil {
+			return false
+		}
+		msg := s.messageLocked(p.SessionID, p.MessageID)
+		if msg == nil {
+			return false
+		}
+		msg.Parts = slices.DeleteFunc(msg.Parts, func(e messagePart) bool { return e.ID == p.PartID })
+	case "message.removed":
+		var p struct {
+			SessionID string `json:"sessionID"`
+			MessageID string `json:"messageID"`
+		}
+		if json.Unmarshal(props, &p) != nil {
+			return false
+		}
+		msgs, ok := s.messages[p.SessionID]
+		if !ok {
+			return false
+		}
+		msgs.Latest = slices.DeleteFunc(msgs.Latest, func(e messageEntry) bool { return e.Info.ID == p.MessageID })
+		s.messages[p.SessionID] = msgs
+	default:
+		return false
+	}
+	return true
+}
+
+// messageLocked returns the cached message of a session, or nil if the
+// session's messages have not been fetched or do not include it.
+func (s *openCodeStream) messageLocked(sessionID, messageID string) *messageEntry {
+	msgs := s.messages[sessionID].Latest
+	if i := slices.IndexFunc(msgs, func(e messageEntry) bool { return e.Info.ID == messageID }); i >= 0 {
+		return &msgs[i]
+	}
+	return nil
+}
+
+func (s *openCodeStream) addPendingLocked(sessionID, permissionID string) {
+	if s.pending[sessionID] == nil {
+		s.pending[sessionID] = make(map[string]bool)
+	}
+	s.pending[sessionID][permissionID] = true
+}
+
+// agentSessions returns the instance's sessions from the stream's state, or by
+// querying the instance while the stream is not connected.
+func (s *openCodeStream) agentSessions(usage *openCodeUsageCache) []model.AgentSession {
+	s.mu.Lock()
+	if !s.live {
+		s.mu.Unlock()
+		return queryOpenCodeInstance(s.inst, usage)
+	}
+	st := openCodeState{
+		Status:   maps.Clone(s.status),
+		Sessions: slices.Collect(maps.Values(s.sessions)),
+		Waiting:  make(map[string]bool, len(s.pending)),
+	}
+	for id := range s.pending {
+		st.Waiting[id] = true
+	}
+	s.mu.Unlock()
+	return openCodeSessions(s.inst, st, func(id string) openCodeMessages {
+		return s.sessionMessages(id, usage)
+	})
+}
+
+// sessionMessages returns the messages of a session from the state, fetching
+// them the first time; events keep them current from then on.
+func (s *openCodeStream) sessionMessages(id string, usage *openCodeUsageCache) openCodeMessages {
+	s.mu.Lock()
+	msgs, ok := s.messages[id]
+	msgs.Latest = cloneMessages(msgs.Latest)
+	s.mu.Unlock()
+	if ok {
+		return msgs
+	}
+
+	msgs, err := fetchSessionMessages(s.inst, id, usage)
+	if err != nil {
+		warnOpenCodeMessages(s.inst, id, err)
+		return msgs
+	}
+	s.mu.Lock()
+	if _, ok := s.messages[id]; !ok && s.messages != nil {
+		s.messages[id] = openCodeMessages{Earlier: msgs.Earlier, Latest: cloneMessages(msgs.Latest)}
+	}
+	s.mu.Unlock()
+	return msgs
+}
+
+// cloneMessages copies messages deeply enough that events applied to the
+// copy held in the state do not show through.
+func cloneMessages(msgs []messageEntry) []messageEntry {
+	msgs = slices.Clone(msgs)
+	for i := range msgs {
+		msgs[i].Parts = slices.Clone(msgs[i].Parts)
+	}
+	return msgs
+}
+
+func (s *openCodeStream) isLive() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.live
+}
+
+// close disconnects the stream for good.
+func (s *openCodeStream) close() {
+	s.cancel()
+}
+
+// readServerSentEvents calls fn with the data of each event read from r
+// until r ends, and touch after every line, so that callers can tell a live
+// stream from a silent one. Multi-line data is joined with newlines; event
+// names, IDs and comments are ignored.
+func readServerSentEvents(r io.Reader, touch func(), fn func(data []byte)) error {
+	br := bufio.NewReader(r)
+	var data []byte
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		touch()
+		line = bytes.TrimRight(line, "\r\n")
+		switch {
+		case len(line) == 0:
+			if len(data) > 0 {
+				fn(data)
+			}
+			data = data[:0]
+		case bytes.HasPrefix(line, []byte("data:")):
+			if len(data) > 0 {
+				data = append(data, '\n')
+			}
+			data = append(data, bytes.TrimPrefix(line[len("data:"):], []byte(" "))...)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/model"
+)
+
+func TestReadServerSentEvents(t *testing.T) {
+	input := "data: a\r\ndata: b\r\n\r\n" +
+		": keep-alive\n\n" +
+		"event: message\ndata: {\"type\":\"server.heartbeat\"}\n\n" +
+		"data: unterminated\n"
+
+	var events []string
+	touched := 0
+	err := readServerSentEvents(strings.NewReader(input), func() { touched++ }, func(data []byte) {
+		events = append(events, string(data))
+	})
+	if err != io.EOF {
+		t.Errorf("err = %v, want io.EOF", err)
+	}
+	want := []string{"a\nb", `{"type":"server.heartbeat"}`}
+	if !slices.Equal(events, want) {
+		t.Errorf("events = %q, want %q", events, want)
+	}
+	if touched != 9 {
+		t.Errorf("touched %d times, want once per line (9)", touched)
+	}
+}
+
+func TestOpenCodeStreamApply(t *testing.T) {
+	s := &openCodeStream{
+		status:   make(map[string]sessionStatusEntry),
+		sessions: make(map[string]sessionListEntry),
+		pending:  make(map[string]map[string]bool),
+		messages: make(map[string]openCodeMessages),
+	}
+	steps := []struct {
+		event   string
+		changed bool
+	}{
+		{`{"type":"server.heartbeat","properties":{}}`, false},
+		{`{"type":"session.status","properties":{"sessionID":"s1","status":{"type":"busy"}}}`, true},
+		{`{"type":"permission.asked","properties":{"id":"p1","sessionID":"s1"}}`, true},
+		// /global/event wraps the event in a payload.
+		{`{"directory":"/src","payload":{"type":"permission.replied","properties":{"sessionID":"s1","requestID":"p1"}}}`, true},
+		{`{"type":"message.updated","properties":{"info":{"id":"m1","sessionID":"s1"}}}`, false},
+		{`not json`, false},
+	}
+	for _, step := range steps {
+		if got := s.apply([]byte(step.event)); got != step.changed {
+			t.Errorf("apply(%s) = %v, want %v", step.event, got, step.changed)
+		}
+	}
+	if got := s.status["s1"].Type; got != model.StatusBusy {
+		t.Errorf("status of s1 = %q, want busy", got)
+	}
+	if len(s.pending) != 0 {
+		t.Errorf("pending = %v, want none after the reply", s.pending)
+	}
+
+	s.apply([]byte(`{"type":"session.idle","properties":{"sessionID":"s1"}}`))
+	if _, ok := s.status["s1"]; ok {
+		t.Error("s1 still has a status after session.idle")
+	}
+}
+
+func TestOpenCodeStreamConnect(t *testing.T) {
+	tests := []struct {
+		name      string
+		handler   http.HandlerFunc
+		noStream  bool
+		connected bool
+	}{
+		{"event stream", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+		}, false, true},
+		{"not found", http.NotFound, true, false},
+		{"not an event stream", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+		}, true, false},
+		{"unavailable", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+		}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+			u, _ := url.Parse(srv.URL)
+			port, _ := strconv.Atoi(u.Port())
+			s := &openCodeStream{
+				inst:   openCodeInstance{Addr: u.Hostname(), Port: port},
+				client: srv.Client(),
+			}
+
+			body, err := s.connect(context.Background())
+			if body != nil {
+				body.Close()
+			}
+			if (err == nil) != tt.connected {
+				t.Errorf("err = %v, want connected = %v", err, tt.connected)
+			}
+			if got := errors.Is(err, errNoOpenCodeEventStream); got != tt.noStream {
+				t.Errorf("errors.Is(%v, errNoOpenCodeEventStream) = %v, want %v", err, got, tt.noStream)
+			}
+		})
+	}
+}
+
+// openCodeEventServer is an OpenCode server whose /event endpoint answers
+// with the given handler and that has no sessions. It records when /event
+// was requested.
+type openCodeEventServer struct {
+	event http.HandlerFunc
+
+	mu       sync.Mutex
+	connects []time.Time
+}
+
+func (f *openCodeEventServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/event":
+		f.mu.Lock()
+		f.connects = append(f.connects, time.Now())
+		f.mu.Unlock()
+		f.event(w, r)
+	case "/session/status":
+		w.Write([]byte(`{}`))
+	case "/session", "/permission":
+		w.Write([]byte(`[]`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *openCodeEventServer) connected() []time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.connects)
+}
+
+// runOpenCodeStream runs a stream against srv until the test ends, with
+// reconnect delays and idle timeout shortened. It returns a channel that
+// receives on every change and one that is closed once the stream gives up.
+func runOpenCodeStream(t *testing.T, srv *httptest.Server) (changes <-chan struct{}, done <-chan struct{}) {
+	t.Helper()
+	setDuration := func(v *time.Duration, d time.Duration) {
+		old := *v
+		*v = d
+		t.Cleanup(func() { *v = old })
+	}
+	setDuration(&openCodeReconnectDelay, 20*time.Millisecond)
+	setDuration(&openCodeMaxReconnectDelay, 80*time.Millisecond)
+	setDuration(&openCodeIdleTimeout, 100*time.Millisecond)
+
+	ch := make(chan struct{}, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &openCodeStream{
+		inst:     testOpenCodeInstance(srv),
+		onChange: func() { ch <- struct{}{} },
+		client:   srv.Client(),
+		cancel:   cancel,
+	}
+	stopped := make(chan struct{})
+	go func() {
+		s.run(ctx)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		s.close()
+		<-stopped
+	})
+	return ch, stopped
+}
+
+// waitChanges waits for n changes, failing the test if they do not come.
+func waitChanges(t *testing.T, changes <-chan struct{}, n int) {
+	t.Helper()
+	for range n {
+		select {
+		case <-changes:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("fewer than %d changes reported", n)
+		}
+	}
+}
+
+func TestOpenCodeStreamReconnect(t *testing.T) {
+	// Each connection sends one event and ends.
+	f := &openCodeEventServer{event: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"type\":\"server.connected\"}\n\n"))
+	}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	changes, done := runOpenCodeStream(t, srv)
+
+	// Connecting and dropping are each a change; the stream reconnects
+	// after the initial delay, since it was live.
+	waitChanges(t, changes, 6)
+	connects := f.connected()
+	if len(connects) < 3 {
+		t.Fatalf("%d connections, want at least 3", len(connects))
+	}
+	for i := 1; i < len(connects); i++ {
+		if gap := connects[i].Sub(connects[i-1]); gap < openCodeReconnectDelay || gap >= openCodeMaxReconnectDelay {
+			t.Errorf("reconnect %d after %v, want the initial delay %v", i, gap, openCodeReconnectDelay)
+		}
+	}
+	select {
+	case <-done:
+		t.Error("stream gave up")
+	default:
+	}
+}
+
+func TestOpenCodeStreamIdleTimeout(t *testing.T) {
+	// The connection stays open without a single event.
+	f := &openCodeEventServer{event: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	changes, _ := runOpenCodeStream(t, srv)
+
+	// Connected, dropped for silence, connected again.
+	waitChanges(t, changes, 3)
+	if n := len(f.connected()); n < 2 {
+		t.Errorf("%d connections, want a reconnect after the idle timeout", n)
+	}
+}
+
+func TestOpenCodeStreamBackoff(t *testing.T) {
+	f := &openCodeEventServer{event: func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "starting", http.StatusServiceUnavailable)
+	}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	runOpenCodeStream(t, srv)
+
+	// Each failed attempt doubles the delay, up to the maximum.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(f.connected()) < 6 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	connects := f.connected()
+	if len(connects) < 6 {
+		t.Fatalf("%d connections, want at least 6", len(connects))
+	}
+	want := openCodeReconnectDelay
+	for i := 1; i < 6; i++ {
+		if gap := connects[i].Sub(connects[i-1]); gap < want {
+			t.Errorf("attempt %d after %v, want at least %v", i, gap, want)
+		}
+		want = min(2*want, openCodeMaxReconnectDelay)
+	}
+}
+
+func TestOpenCodeStreamNoEventStream(t *testing.T) {
+	f := &openCodeEventServer{event: http.NotFound}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	changes, done := runOpenCodeStream(t, srv)
+
+	// A server without an event stream is not asked again.
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream still retrying a server without an event stream")
+	}
+	if n := len(f.connected()); n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+	if len(changes) != 0 {
+		t.Errorf("%d changes reported, want none", len(changes))
+	}
+}
@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/model"
+)
+
+// openCodeSession returns a session list entry updated at the given Unix
+// millisecond.
+func openCodeSession(id, parent string, updated int64) sessionListEntry {
+	e := sessionListEntry{ID: id, ParentID: parent, Title: "title " + id, Directory: "/src"}
+	e.Time.Updated = updated
+	return e
+}
+
+func TestOpenCodeSessionsActive(t *testing.T) {
+	inst := openCodeInstance{PID: 42, Addr: "127.0.0.1", Port: 4096}
+	st := openCodeState{
+		Status: map[string]sessionStatusEntry{
+			"s1": {Type: model.StatusBusy},
+			"s2": {Type: model.StatusRetry},
+			"s3": {Type: model.StatusIdle},
+			"s4": {Type: model.StatusBusy},
+		},
+		Sessions: []sessionListEntry{
+			openCodeSession("s1", "", 1000),
+			openCodeSession("s2", "", 3000),
+			openCodeSession("s3", "", 4000),
+			openCodeSession("s4", "s1", 2000),
+		},
+		Waiting: map[string]bool{"s4": true},
+	}
+	var running messageEntry
+	running.Info.ID, running.Info.Role = "m1", "assistant"
+	running.Parts = []messagePart{{ID: "p1", Type: "tool", Tool: "bash"}}
+	running.Parts[0].State.Status = "running"
+	running.Parts[0].State.Input = json.RawMessage(`{"command":"go test ./..."}`)
+	messages := func(id string) openCodeMessages {
+		if id == "s1" {
+			return openCodeMessages{Latest: []messageEntry{running}}
+		}
+		return openCodeMessages{}
+	}
+
+	got := openCodeSessions(inst, st, messages)
+	var ids, statuses []string
+	for _, s := range got {
+		ids = append(ids, s.SessionID)
+		statuses = append(statuses, s.Status)
+		if s.PID != 42 || s.Address != "127.0.0.1:4096" {
+			t.Errorf("%s: PID %d address %q", s.SessionID, s.PID, s.Address)
+		}
+	}
+	// Active sessions only, most recently updated first; a pending
+	// permission request makes a session wait.
+	if want := []string{"s2", "s4", "s1"}; !slices.Equal(ids, want) {
+		t.Errorf("sessions %v, want %v", ids, want)
+	}
+	if want := []string{model.StatusRetry, model.StatusWaitingApproval, model.StatusBusy}; !slices.Equal(statuses, want) {
+		t.Errorf("statuses %v, want %v", statuses, want)
+	}
+	if s := got[2]; s.Title != "title s1" || s.Activity != "bash: go test ./..." || !s.LastActivityAt.Equal(time.UnixMilli(1000)) {
+		t.Errorf("s1: title %q activity %q last activity %v", s.Title, s.Activity, s.LastActivityAt)
+	}
+}
+
+func TestOpenCodeSessionsIdle(t *testing.T) {
+	inst := openCodeInstance{PID: 42, Addr: "127.0.0.1", Port: 4096}
+	none := func(string) openCodeMessages { return openCodeMessages{} }
+
+	// The latest top-level session stands for an idle instance; subagent
+	// sessions are skipped.
+	st := openCodeState{Sessions: []sessionListEntry{
+		openCodeSession("old", "", 1000),
+		openCodeSession("child", "new", 3000),
+		openCodeSession("new", "", 2000),
+	}}
+	got := openCodeSessions(inst, st, none)
+	if len(got) != 1 || got[0].SessionID != "new" || got[0].Status != model.StatusIdle {
+		t.Errorf("got %+v, want idle session new", got)
+	}
+
+	// Without any session the instance is still reported.
+	got = openCodeSessions(inst, openCodeState{}, none)
+	if len(got) != 1 || got[0].SessionID != "" || got[0].Status != model.StatusIdle || got[0].PID != 42 {
+		t.Errorf("got %+v, want one idle session without ID", got)
+	}
+}
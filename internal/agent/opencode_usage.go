@@ -0,0 +1,191 @@
+package agent
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/model"
+)
+
+// openCodeMessageLimit is how many of the latest messages of a session are
+// fetched. The usage of the messages before them is kept in
+// openCodeUsageCache, so a long session is only fetched in full once.
+const openCodeMessageLimit = 100
+
+// openCodeUsageCacheVersion is bumped whenever the layout or meaning of
+// openCodeUsage changes; a cache with another version is discarded.
+const openCodeUsageCacheVersion = 1
+
+// openCodeUsage is the usage summed over the messages of a session up to
+// Through. Message IDs sort in creation order.
+type openCodeUsage struct {
+	Through     string      `json:"through"`           // ID of the last message summed
+	Model       string      `json:"model,omitempty"`   // of the latest response
+	Context     int64       `json:"context,omitempty"` // context size of the latest response
+	Usage       model.Usage `json:"usage"`
+	Cost        float64     `json:"cost,omitempty"`
+	Compactions int         `json:"compactions,omitempty"`
+}
+
+// add sums one message into u. Summary messages are compactions.
+func (u *openCodeUsage) add(m messageEntry) {
+	u.Through = m.Info.ID
+	if m.Info.Role != "assistant" {
+		return
+	}
+	if m.Info.ModelID != "" {
+		u.Model = m.Info.ModelID
+	}
+	u.Cost += m.Info.Cost
+	t := m.Info.Tokens
+	last := model.Usage{
+		InputTokens:      t.Input,
+		OutputTokens:     t.Output + t.Reasoning,
+		CacheReadTokens:  t.Cache.Read,
+		CacheWriteTokens: t.Cache.Write,
+	}
+	u.Usage.Add(last)
+	u.Context = last.Total()
+	if m.Info.Summary {
+		u.Compactions++
+	}
+}
+
+// openCodeMessages holds the latest messages of a session and the usage of
+// the messages before them.
+type openCodeMessages struct {
+	Earlier openCodeUsage
+	Latest  []messageEntry
+}
+
+// openCodeUsageCache persists the usage of the finished messages of each
+// reported session, opencode-usage.json, so that later runs only fetch the
+// latest messages (see fetchSessionMessages).
+type openCodeUsageCache struct {
+	Version  int                      `json:"version"`
+	Sessions map[string]openCodeUsage `json:"sessions"` // keyed by session ID
+
+	mu    sync.Mutex
+	path  string
+	used  map[string]bool // sessions fetched in this run
+	dirty bool
+}
+
+// loadOpenCodeUsageCache reads the usage cache, returning an empty one if it
+// is missing, unreadable or of another version.
+func loadOpenCodeUsageCache() *openCodeUsageCache {
+	path := cachePath("opencode-usage.json")
+	c := &openCodeUsageCache{}
+	if !readCacheFile(path, c) || c.Version != openCodeUsageCacheVersion || c.Sessions == nil {
+		c = &openCodeUsageCache{Version: openCodeUsageCacheVersion, Sessions: make(map[string]openCodeUsage)}
+	}
+	c.path = path
+	c.used = make(map[string]bool)
+	return c
+}
+
+// save drops the sessions not fetched in this run and writes the cache if it
+// changed (see writeCacheFile).
+func (c *openCodeUsageCache) save() {
+	for id := range c.Sessions {
+		if !c.used[id] {
+			delete(c.Sessions, id)
+			c.dirty = true
+		}
+	}
+	c.flush()
+}
+
+// flush writes the cache if it changed, keeping the sessions not fetched in
+// this run: for watch mode, which fetches each session once.
+func (c *openCodeUsageCache) flush() {
+	if c.dirty {
+		writeCacheFile(c.path, c)
+	}
+}
+
+// earlier returns the cached usage of session id if it reaches the first of
+// latest, so that latest continues it. c may be nil.
+func (c *openCodeUsageCache) earlier(id string, latest []messageEntry) (openCodeUsage, bool) {
+	if c == nil {
+		return openCodeUsage{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.used[id] = true
+	u, ok := c.Sessions[id]
+	return u, ok && len(latest) > 0 && u.Through >= latest[0].Info.ID
+}
+
+// update caches the usage of session id through its last finished message:
+// earlier plus latest up to the first response still being generated, i.e.
+// neither completed nor failed. c may be nil.
+func (c *openCodeUsageCache) update(id string, msgs openCodeMessages) {
+	if c == nil {
+		return
+	}
+	u := msgs.Earlier
+	for _, m := range msgs.Latest {
+		if m.Info.Role == "assistant" && m.Info.Time.Completed == 0 && !m.failed() {
+			break
+		}
+		u.add(m)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.used[id] = true
+	if c.Sessions[id] != u {
+		c.Sessions[id] = u
+		c.dirty = true
+	}
+}
+
+// fetchSessionMessages fetches the latest openCodeMessageLimit messages of a
+// session from GET /session/{id}/message?limit=N, and takes the usage of the
+// messages before them from cache. When the cache does not reach them (the
+// first time a long session is seen, or after many new messages), the whole
+// session is fetched instead. cache may be nil.
+func fetchSessionMessages(inst openCodeInstance, id string, cache *openCodeUsageCache) (openCodeMessages, error) {
+	path := "/session/" + url.PathEscape(id) + "/message"
+	var msgs openCodeMessages
+	if err := getOpenCodeJSON(inst, fmt.Sprintf("%s?limit=%d", path, openCodeMessageLimit), &msgs.Latest); err != nil {
+		return openCodeMessages{}, err
+	}
+	// Fewer messages are the whole session; more come from servers that
+	// ignore the limit.
+	if len(msgs.Latest) == openCodeMessageLimit {
+		if earlier, ok := cache.earlier(id, msgs.Latest); ok {
+			msgs.Earlier = earlier
+			i := 0
+			for i < len(msgs.Latest) && msgs.Latest[i].Info.ID <= earlier.Through {
+				i++
+			}
+			msgs.Latest = msgs.Latest[i:]
+		} else if err := getOpenCodeJSON(inst, path, &msgs.Latest); err != nil {
+			return openCodeMessages{}, err
+		}
+	}
+	cache.update(id, msgs)
+	return msgs, nil
+}
+
+// applySessionUsage sets the usage of s from the messages of its session:
+// the cost and tokens summed over all responses, and the model and context
+// size of the latest one. A summary message still being generated means
+// compacting.
+func applySessionUsage(s *model.AgentSession, msgs openCodeMessages) {
+	u := msgs.Earlier
+	for _, m := range msgs.Latest {
+		u.add(m)
+		if m.Info.Role == "assistant" {
+			s.Compacting = m.Info.Summary && m.Info.Time.Completed == 0
+		}
+	}
+	s.Model = u.Model
+	s.Usage = u.Usage
+	s.Cost = u.Cost
+	s.ContextTokens = u.Context
+	s.Compactions = u.Compactions
+	s.ContextWindow = contextWindow(s.Model)
+}
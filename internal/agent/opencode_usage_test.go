@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/model"
+)
+
+// openCodeMessageServer serves the messages of session s1, the latest limit
+// of them when asked to, and counts the requests for all of them.
+type openCodeMessageServer struct {
+	msgs        []messageEntry
+	ignoreLimit bool
+	full        int
+}
+
+func (f *openCodeMessageServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/session/s1/message" {
+		http.NotFound(w, r)
+		return
+	}
+	msgs := f.msgs
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && !f.ignoreLimit {
+		msgs = msgs[max(0, len(msgs)-n):]
+	} else {
+		f.full++
+	}
+	json.NewEncoder(w).Encode(msgs)
+}
+
+// add appends n responses of 10 input tokens each, completed unless pending.
+func (f *openCodeMessageServer) add(n int, pending bool) {
+	for range n {
+		var m messageEntry
+		m.Info.ID = fmt.Sprintf("msg_%04d", len(f.msgs))
+		m.Info.Role, m.Info.ModelID = "assistant", "gpt-5"
+		m.Info.Tokens.Input = 10
+		if !pending {
+			m.Info.Time.Completed = 1
+		}
+		f.msgs = append(f.msgs, m)
+	}
+}
+
+// testOpenCodeInstance returns the instance served by srv.
+func testOpenCodeInstance(srv *httptest.Server) openCodeInstance {
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return openCodeInstance{Addr: u.Hostname(), Port: port}
+}
+
+func TestFetchSessionMessages(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	f := &openCodeMessageServer{}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	inst := testOpenCodeInstance(srv)
+
+	fetch := func(cache *openCodeUsageCache) model.AgentSession {
+		t.Helper()
+		msgs, err := fetchSessionMessages(inst, "s1", cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s model.AgentSession
+		applySessionUsage(&s, msgs)
+		return s
+	}
+	check := func(step string, s model.AgentSession, responses, full int) {
+		t.Helper()
+		if want := int64(10 * responses); s.Usage.InputTokens != want || s.Model != "gpt-5" {
+			t.Errorf("%s: input tokens %d model %q, want %d and gpt-5", step, s.Usage.InputTokens, s.Model, want)
+		}
+		if f.full != full {
+			t.Errorf("%s: %d full fetches, want %d", step, f.full, full)
+		}
+	}
+
+	// A short session fits in one page.
+	f.add(50, false)
+	cache := loadOpenCodeUsageCache()
+	check("short session", fetch(cache), 50, 0)
+
+	// A long one is fetched in full once; then only its latest messages.
+	f.add(100, false)
+	check("long session", fetch(cache), 150, 1)
+	cache.save()
+	cache = loadOpenCodeUsageCache()
+	f.add(10, false)
+	check("new messages", fetch(cache), 160, 1)
+
+	// A response in progress is not cached, so it is counted when it ends.
+	f.add(1, true)
+	f.add(5, false)
+	check("pending response", fetch(cache), 166, 1)
+	f.msgs[160].Info.Time.Completed = 1
+	f.msgs[160].Info.Tokens.Input = 20
+	if s := fetch(cache); s.Usage.InputTokens != 1670 || f.full != 1 {
+		t.Errorf("completed response: input tokens %d after %d full fetches, want 1670 after 1", s.Usage.InputTokens, f.full)
+	}
+
+	// More new messages than a page: the cache no longer reaches them.
+	f.add(openCodeMessageLimit+1, false)
+	if s := fetch(cache); s.Usage.InputTokens != 1670+10*(openCodeMessageLimit+1) || f.full != 2 {
+		t.Errorf("many new messages: input tokens %d after %d full fetches", s.Usage.InputTokens, f.full)
+	}
+
+	// Without a cache, a server that ignores the limit is not asked twice.
+	f.ignoreLimit, f.full = true, 0
+	if s := fetch(nil); s.Usage.InputTokens != int64(10*len(f.msgs)+10) || f.full != 1 {
+		t.Errorf("limit ignored: input tokens %d after %d full fetches", s.Usage.InputTokens, f.full)
+	}
+}
+
+func TestFetchSessionMessagesError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	if _, err := fetchSessionMessages(testOpenCodeInstance(srv), "s1", nil); err == nil {
+		t.Error("no error for a failed request")
+	}
+}
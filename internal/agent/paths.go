@@ -0,0 +1,237 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/config"
+	"github.com/Eric-Song-Nop/agentstat/internal/platform"
+)
+
+// conf is the active configuration. Main replaces it via Configure before discovery.
+var conf = config.Default()
+
+// Configure sets the configuration used by all detectors.
+func Configure(c *config.Config) {
+	conf = c
+}
+
+// processRegexp returns the configured process regex for the named agent,
+// compiled when the config was loaded.
+func processRegexp(agent string) *regexp.Regexp {
+	return conf.Agent(agent).Process()
+}
+
+// procEnv is the environment of one agent process. Agents locate their data
+// from their own environment (CLAUDE_CONFIG_DIR, CODEX_HOME, HOME, ...), which
+// may differ from agentstat's, so data directories are resolved per PID.
+//
+// For containerized processes, Home and environment values are paths inside
+// the container; Root is the host prefix through which they are readable.
+type procEnv struct {
+	PID       int
+	UID       int
+	Home      string
+	Root      string            // "" unless the process is in another mount namespace
+	Container string            // container ID, "" if not containerized
+	env       map[string]string // nil when the process environment is unreadable
+	own       bool              // process belongs to the user running agentstat
+}
+
+// newProcEnv reads the environment of pid. The home directory comes from the
+// process's HOME, then the owner's passwd entry. When the environment cannot
+// be read, agentstat's own environment stands in only for its own processes
+// outside containers.
+func newProcEnv(snap *platform.Snapshot, pid int) *procEnv {
+	uid := snap.UID(pid)
+	pe := &procEnv{
+		PID:       pid,
+		UID:       uid,
+		Root:      platform.P.ReadProcessRoot(pid),
+		Container: platform.P.ReadProcessContainer(pid),
+		env:       platform.P.ReadProcessEnviron(pid),
+	}
+	pe.own = pe.Root == "" && (uid < 0 || uid == os.Getuid())
+
+	pe.Home = pe.getenv("HOME")
+	if pe.Home == "" {
+		pe.Home = platform.HomeForUIDIn(pid, pe.Root, uid)
+	}
+	if pe.Home == "" && pe.own {
+		pe.Home, _ = os.UserHomeDir()
+	}
+	return pe
+}
+
+// hostPath translates a path as seen by the process into one agentstat can
+// read, by prefixing the process root for containerized processes.
+func (pe *procEnv) hostPath(path string) string {
+	if pe.Root == "" || path == "" {
+		return path
+	}
+	return filepath.Join(pe.Root, path)
+}
+
+// getenv returns a variable from the process environment, falling back to
+// agentstat's environment when the process environment is unreadable and the
+// process is our own.
+func (pe *procEnv) getenv(key string) string {
+	if pe.env == nil {
+		if pe.own {
+			return os.Getenv(key)
+		}
+		return ""
+	}
+	return pe.env[key]
+}
+
+// claudeDir returns the Claude Code config directory:
+// config data_dir, then $CLAUDE_CONFIG_DIR, then ~/.claude.
+func (pe *procEnv) claudeDir() string {
+	return pe.dataDir("claude", "CLAUDE_CONFIG_DIR", ".claude")
+}
+
+// codexHome returns the Codex home directory:
+// config data_dir, then $CODEX_HOME, then ~/.codex.
+func (pe *procEnv) codexHome() string {
+	return pe.dataDir("codex", "CODEX_HOME", ".codex")
+}
+
+// geminiDir returns the Gemini CLI directory:
+// config data_dir, then $GEMINI_CLI_HOME/.gemini, then ~/.gemini.
+func (pe *procEnv) geminiDir() string {
+	if dir := conf.Agent("gemini").DataDir; dir != "" {
+		return dir
+	}
+	if home := pe.getenv("GEMINI_CLI_HOME"); home != "" {
+		return pe.hostPath(filepath.Join(home, ".gemini"))
+	}
+	return pe.dataDir("gemini", "", ".gemini")
+}
+
+// ampDataDir returns the Amp data directory:
+// config data_dir, then $XDG_DATA_HOME/amp, then ~/.local/share/amp.
+func (pe *procEnv) ampDataDir() string {
+	if dir := conf.Agent("amp").DataDir; dir != "" {
+		return dir
+	}
+	if xdg := pe.getenv("XDG_DATA_HOME"); xdg != "" {
+		return pe.hostPath(filepath.Join(xdg, "amp"))
+	}
+	return pe.dataDir("amp", "", filepath.Join(".local", "share", "amp"))
+}
+
+// openCodeDataDir returns the OpenCode data directory:
+// config data_dir, then $XDG_DATA_HOME/opencode, then ~/.local/share/opencode.
+func (pe *procEnv) openCodeDataDir() string {
+	if dir := conf.Agent("opencode").DataDir; dir != "" {
+		return dir
+	}
+	if xdg := pe.getenv("XDG_DATA_HOME"); xdg != "" {
+		return pe.hostPath(filepath.Join(xdg, "opencode"))
+	}
+	return pe.dataDir("opencode", "", filepath.Join(".local", "share", "opencode"))
+}
+
+// dataDir resolves an agent data directory from the config, an optional
+// variable in the process environment, and finally a path relative to the
+// process's home directory. The result is a host path (see hostPath); a
+// configured data_dir is taken as a host path already. Returns "" when none
+// can be determined.
+func (pe *procEnv) dataDir(agent, envVar, homeRel string) string {
+	if dir := conf.Agent(agent).DataDir; dir != "" {
+		return dir
+	}
+	if envVar != "" {
+		if dir := pe.getenv(envVar); dir != "" {
+			return pe.hostPath(dir)
+		}
+	}
+	if pe.Home == "" {
+		return ""
+	}
+	return pe.hostPath(filepath.Join(pe.Home, homeRel))
+}
+
+// groupByDir groups PIDs by a per-process data directory so that each
+// directory is scanned once. PIDs whose directory is unknown are grouped
+// under "", which callers must not scan but report with status unknown.
+func groupByDir(snap *platform.Snapshot, pids []int, dir func(*procEnv) string) map[string][]int {
+	groups := make(map[string][]int)
+	for _, pid := range pids {
+		d := dir(newProcEnv(snap, pid))
+		groups[d] = append(groups[d], pid)
+	}
+	return groups
+}
+
+// startTime returns the start time of pid, or the zero time if unknown.
+func startTime(snap *platform.Snapshot, pid int) time.Time {
+	if p := snap.Get(pid); p != nil {
+		return p.StartTime
+	}
+	return time.Time{}
+}
+
+// descendantStarts returns the start times of the processes pid has started,
+// directly or through its children.
+func descendantStarts(snap *platform.Snapshot, pid int) []time.Time {
+	var starts []time.Time
+	for _, q := range snap.PIDs() {
+		// Bounded, as a PID table read over time may hold a cycle.
+		for p, depth := snap.PPID(q), 0; p > 1 && depth < 64; p, depth = snap.PPID(p), depth+1 {
+			if p == pid {
+				starts = append(starts, startTime(snap, q))
+				break
+			}
+		}
+	}
+	return starts
+}
+
+// openFiles returns the host paths of the files pids have open.
+func openFiles(snap *platform.Snapshot, pids []int) map[string]bool {
+	open := make(map[string]bool)
+	for _, pid := range pids {
+		pe := newProcEnv(snap, pid)
+		for _, f := range platform.P.ListOpenFiles(pid) {
+			open[pe.hostPath(f)] = true
+		}
+	}
+	return open
+}
+
+// groupCwds returns the distinct known working directories of pids.
+func groupCwds(snap *platform.Snapshot, pids []int) []string {
+	seen := make(map[string]bool)
+	var cwds []string
+	for _, pid := range pids {
+		if cwd := snap.Cwd(pid); cwd != "-" && !seen[cwd] {
+			seen[cwd] = true
+			cwds = append(cwds, cwd)
+		}
+	}
+	return cwds
+}
+
+// earliestStart returns a time before which none of pids can have written
+// anything: the earliest process start, less a minute of slack for clock
+// granularity. Zero if any start time is unknown.
+func earliestStart(snap *platform.Snapshot, pids []int) time.Time {
+	var earliest time.Time
+	for _, pid := range pids {
+		t := startTime(snap, pid)
+		if t.IsZero() {
+			return time.Time{}
+		}
+		if earliest.IsZero() || t.Before(earliest) {
+			earliest = t
+		}
+	}
+	if earliest.IsZero() {
+		return earliest
+	}
+	return earliest.Add(-time.Minute)
+}
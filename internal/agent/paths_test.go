@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/platform"
+)
+
+// fakePlatform stands in for platform.P: processes have the open files given
+// here, live outside containers and have unreadable environments. The other
+// methods are not used by the code under test.
+type fakePlatform struct {
+	platform.Platform
+	open map[int][]string
+}
+
+func (f fakePlatform) ListOpenFiles(pid int) []string         { return f.open[pid] }
+func (fakePlatform) ReadProcessRoot(int) string               { return "" }
+func (fakePlatform) ReadProcessContainer(int) string          { return "" }
+func (fakePlatform) ReadProcessEnviron(int) map[string]string { return nil }
+
+// useFakePlatform replaces platform.P for the rest of the test.
+func useFakePlatform(t *testing.T, f fakePlatform) {
+	t.Helper()
+	old := platform.P
+	platform.P = f
+	t.Cleanup(func() { platform.P = old })
+}
+
+// fakeProcess returns a process of uid -1 (unknown) with the given parent,
+// working directory and start time.
+func fakeProcess(pid, ppid int, cwd string, started time.Time, argv ...string) *platform.Process {
+	return &platform.Process{PID: pid, PPID: ppid, UID: -1, Cwd: cwd, StartTime: started, Argv: argv}
+}
+
+func TestDescendantStarts(t *testing.T) {
+	t0 := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(sec int) time.Time { return t0.Add(time.Duration(sec) * time.Second) }
+	snap := platform.NewSnapshot([]*platform.Process{
+		fakeProcess(1, 0, "/", at(0)),
+		fakeProcess(10, 1, "/src", at(1), "claude"),
+		fakeProcess(11, 10, "/src", at(2), "bash"),
+		fakeProcess(12, 11, "/src", at(3), "go"),
+		fakeProcess(20, 1, "/src", at(4), "bash"),
+		// A cycle, as a table read over time may hold.
+		fakeProcess(30, 31, "/", at(5)),
+		fakeProcess(31, 30, "/", at(6)),
+	})
+
+	got := descendantStarts(snap, 10)
+	slices.SortFunc(got, time.Time.Compare)
+	if want := []time.Time{at(2), at(3)}; !slices.Equal(got, want) {
+		t.Errorf("descendants of 10 started at %v, want %v", got, want)
+	}
+	if got := descendantStarts(snap, 20); len(got) != 0 {
+		t.Errorf("descendants of 20 started at %v, want none", got)
+	}
+}
@@ -0,0 +1,28 @@
+package agent
+
+import "github.com/Eric-Song-Nop/agentstat/internal/model"
+
+// estimateCost prices usage with the configured rate for modelName.
+// Returns 0 when the model has no configured price.
+func estimateCost(modelName string, u model.Usage) float64 {
+	if modelName == "" {
+		return 0
+	}
+	p, ok := conf.PriceFor(modelName)
+	if !ok {
+		return 0
+	}
+	return (float64(u.InputTokens)*p.Input +
+		float64(u.OutputTokens)*p.Output +
+		float64(u.CacheReadTokens)*p.CacheRead +
+		float64(u.CacheWriteTokens)*p.CacheWrite) / 1e6
+}
+
+// contextWindow returns the context window of modelName from the config, or 0
+// if unknown.
+func contextWindow(modelName string) int64 {
+	if modelName == "" {
+		return 0
+	}
+	return conf.ContextWindowFor(modelName)
+}
@@ -0,0 +1,231 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/model"
+	"github.com/Eric-Song-Nop/agentstat/internal/platform"
+)
+
+// WatchTarget is what has to be watched to notice state changes of one
+// agent's sessions: its running processes and the directories they write
+// session data to.
+type WatchTarget struct {
+	PIDs []int    // ascending
+	Dirs []string // host paths; they may not exist yet
+}
+
+// WatchTargets returns the watch target of each named agent in snap. Agents
+// without running processes get an empty target. OpenCode keeps its state
+// behind an HTTP API, so it has no directories.
+func WatchTargets(snap *platform.Snapshot, agents []string) map[string]WatchTarget {
+	targets := make(map[string]WatchTarget, len(agents))
+	for _, name := range agents {
+		var t WatchTarget
+		switch name {
+		case "opencode":
+			t.PIDs = findOpenCodePIDs(snap)
+		case "codex":
+			t.PIDs = findCodexPIDs(snap)
+			t.Dirs = watchDirs(snap, t.PIDs, (*procEnv).codexHome, "sessions")
+		case "claude":
+			t.PIDs = findClaudePIDs(snap)
+			t.Dirs = watchDirs(snap, t.PIDs, (*procEnv).claudeDir, "projects", "debug", "sessions")
+		case "amp":
+			t.PIDs = findAmpPIDs(snap)
+			t.Dirs = watchDirs(snap, t.PIDs, (*procEnv).ampDataDir, "threads")
+		case "gemini":
+			t.PIDs = filterGeminiParents(snap, findGeminiPIDs(snap))
+			t.Dirs = watchDirs(snap, t.PIDs, (*procEnv).geminiDir, "tmp")
+		}
+		targets[name] = t
+	}
+	return targets
+}
+
+// watchDirs returns the subdirectories subs of each distinct data directory
+// of pids.
+func watchDirs(snap *platform.Snapshot, pids []int, dir func(*procEnv) string, subs ...string) []string {
+	var dirs []string
+	for d := range groupByDir(snap, pids, dir) {
+		if d == "" {
+			continue
+		}
+		for _, sub := range subs {
+			dirs = append(dirs, filepath.Join(d, sub))
+		}
+	}
+	slices.Sort(dirs)
+	return dirs
+}
+
+// Refresh recomputes the sessions of agent that were read from one of files,
+// and keeps the others as they are, so that watch mode does not rediscover
+// an agent whenever one of its transcripts is written. files are host paths.
+// It reports false
+// if a file is not known to belong to one of sessions, as it may start a
+// session or change which session a process is mapped to, or if a session
+// can no longer be read: the agent then has to be discovered again.
+func Refresh(snap *platform.Snapshot, agent string, sessions []model.AgentSession, files []string) ([]model.AgentSession, bool) {
+	byPath := make(map[string]int, len(sessions))
+	for i, s := range sessions {
+		if s.Path != "" {
+			byPath[resolvedPath(s.Path)] = i
+		}
+	}
+
+	stale := make(map[int]bool)
+	for _, f := range files {
+		f = resolvedPath(f)
+		i, ok := byPath[f]
+		if !ok && agent == "claude" {
+			i, ok = claudeFileOwner(f, byPath, sessions)
+		}
+		if !ok {
+			return nil, false
+		}
+		if i >= 0 {
+			stale[i] = true
+		}
+	}
+	if len(stale) == 0 {
+		return sessions, true
+	}
+
+	var usage *lineCache[claudeUsageState]
+	var compactions *lineCache[int]
+	switch agent {
+	case "claude":
+		usage = loadClaudeUsageCache()
+		defer usage.flush()
+	case "codex":
+		compactions = loadCodexCompactionsCache()
+		defer compactions.flush()
+	}
+
+	fresh := slices.Clone(sessions)
+	for i := range stale {
+		s := &fresh[i]
+		var ok bool
+		switch agent {
+		case "claude":
+			ok = refreshClaudeSession(snap, s, usage)
+		case "codex":
+			ok = refreshCodexSession(snap, s, compactions)
+		case "amp":
+			ok = refreshAmpSession(snap, s)
+		case "gemini":
+			ok = refreshGeminiSession(s)
+		}
+		if !ok {
+			return nil, false
+		}
+		s.Cost = 0
+		withProcessInfo(snap, fresh[i:i+1])
+	}
+	return fresh, true
+}
+
+// resolvedPath resolves the symlinks in the directory of path, so that paths
+// reported by the watch backend and paths a session was read from compare
+// equal.
+func resolvedPath(path string) string {
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(path)); err == nil {
+		return filepath.Join(dir, filepath.Base(path))
+	}
+	return path
+}
+
+// claudeFileOwner returns the index of the session among sessions that a
+// file of a Claude Code config directory belongs to: the session of its
+// transcript, which byPath indexes, or of a directory {session}/ holding e.g.
+// subagent transcripts. The debug log of a session that is already mapped to
+// its process concerns none of them (-1).
+func claudeFileOwner(path string, byPath map[string]int, sessions []model.AgentSession) (int, bool) {
+	if filepath.Base(filepath.Dir(path)) == "debug" {
+		id := strings.TrimSuffix(filepath.Base(path), ".txt")
+		return -1, slices.ContainsFunc(sessions, func(s model.AgentSession) bool { return s.SessionID == id })
+	}
+	for dir := filepath.Dir(path); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if i, ok := byPath[dir+".jsonl"]; ok {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// refreshClaudeSession probes the process of s again for the session it is
+// mapped to, in the config directory of its transcript.
+func refreshClaudeSession(snap *platform.Snapshot, s *model.AgentSession, usage *lineCache[claudeUsageState]) bool {
+	claudeDir := filepath.Dir(filepath.Dir(filepath.Dir(s.Path)))
+	match := map[int]claudeMatch{s.PID: {SessionID: s.SessionID, Method: s.MatchMethod, Confidence: s.MatchConfidence}}
+	fresh := probeClaudePID(snap, s.PID, claudeDir, match, usage)
+	if fresh == nil {
+		return false
+	}
+	*s = *fresh
+	return true
+}
+
+// refreshCodexSession re-reads the rollout of s. The state database is only
+// consulted while the thread has no title, as one is given after its first
+// turn.
+func refreshCodexSession(snap *platform.Snapshot, s *model.AgentSession, compactions *lineCache[int]) bool {
+	if !readCodexRollout(s, s.Path, compactions) {
+		return false
+	}
+	if s.Title == "-" {
+		db := openCodexStateDB(newProcEnv(snap, s.PID).codexHome())
+		if info := db.lookup(s.SessionID); info != nil && info.Title != "" {
+			s.Title = info.Title
+		}
+		db.close()
+	}
+	return true
+}
+
+// refreshAmpSession re-reads the thread of s. It fails if the thread no
+// longer covers the working directory of the process.
+func refreshAmpSession(snap *platform.Snapshot, s *model.AgentSession) bool {
+	fi, err := os.Stat(s.Path)
+	if err != nil {
+		return false
+	}
+	thread, err := decodeAmpThread(s.Path, []string{snap.Cwd(s.PID)})
+	if err != nil {
+		return false
+	}
+	fresh := probeAmpPID(snap, s.PID, []ampThreadFile{{Path: s.Path, ModTime: fi.ModTime(), Data: *thread}})
+	if fresh == nil || fresh.Path == "" {
+		return false
+	}
+	*s = *fresh
+	return true
+}
+
+// refreshGeminiSession re-reads the session file of s. Its title is only
+// looked up again while it has none.
+func refreshGeminiSession(s *model.AgentSession) bool {
+	fi, err := os.Stat(s.Path)
+	if err != nil {
+		return false
+	}
+	data, err := decodeGeminiSession(s.Path)
+	if err != nil || data.SessionID != s.SessionID {
+		return false
+	}
+	sess := &geminiSessionFile{
+		Path:       s.Path,
+		ModTime:    fi.ModTime(),
+		ProjectDir: filepath.Dir(filepath.Dir(s.Path)),
+		Data:       *data,
+	}
+	setGeminiState(s, sess)
+	if s.Title == "-" {
+		s.Title = geminiTitle(sess, make(map[string][]geminiCheckpoint))
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/model"
+	"github.com/Eric-Song-Nop/agentstat/internal/platform"
+)
+
+func TestRefresh(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	useFakePlatform(t, fakePlatform{})
+	dir := t.TempDir()
+	started := time.Date(2026, 3, 1, 11, 0, 0, 0, time.UTC)
+	snap := platform.NewSnapshot([]*platform.Process{
+		fakeProcess(10, 1, "/src", started, "codex"),
+		fakeProcess(20, 1, "/src", started, "codex"),
+	})
+	rollout := func(name string, lines ...string) string {
+		path := filepath.Join(dir, name)
+		writeClaudeTestFile(t, path, strings.Join(lines, "\n")+"\n", time.Now())
+		return path
+	}
+	meta := rolloutLine(0, "session_meta", `{"id":"s"}`)
+	busy := []string{meta, rolloutLine(1, "event_msg", `{"type":"task_started"}`)}
+	a, b := rollout("a.jsonl", busy...), rollout("b.jsonl", busy...)
+	sessions := []model.AgentSession{
+		{Agent: "codex", PID: 10, SessionID: "a", Title: "first", Path: a, Status: model.StatusBusy},
+		{Agent: "codex", PID: 20, SessionID: "b", Title: "second", Path: b, Status: model.StatusBusy},
+	}
+
+	// Only the session whose rollout was written is read again.
+	rollout("a.jsonl", append(busy, rolloutLine(2, "event_msg", `{"type":"task_complete"}`))...)
+	rollout("b.jsonl", meta)
+	got, ok := Refresh(snap, "codex", sessions, []string{a})
+	if !ok || len(got) != 2 {
+		t.Fatalf("Refresh = %d sessions, %v; want 2, true", len(got), ok)
+	}
+	if got[0].Status != model.StatusIdle || got[0].Title != "first" || !got[0].StartedAt.Equal(started) {
+		t.Errorf("refreshed session %+v, want idle with its title and process start", got[0])
+	}
+	if got[1].Status != model.StatusBusy || sessions[0].Status != model.StatusBusy {
+		t.Errorf("other session %q and input %q changed, want both busy", got[1].Status, sessions[0].Status)
+	}
+
+	// A file no session was read from, or a session that cannot be read
+	// again, needs the agent to be discovered again.
+	if _, ok := Refresh(snap, "codex", sessions, []string{filepath.Join(dir, "new.jsonl")}); ok {
+		t.Error("Refresh succeeded for a new rollout")
+	}
+	os.Remove(b)
+	if _, ok := Refresh(snap, "codex", sessions, []string{a, b}); ok {
+		t.Error("Refresh succeeded for a deleted rollout")
+	}
+
+	// No files: nothing to do.
+	if got, ok := Refresh(snap, "codex", sessions, nil); !ok || &got[0] != &sessions[0] {
+		t.Error("Refresh without files did not keep the sessions")
+	}
+}
+
+func TestClaudeFileOwner(t *testing.T) {
+	project := "/home/u/.claude/projects/-src"
+	sessions := []model.AgentSession{
+		{SessionID: claudeTestID(1), Path: project + "/" + claudeTestID(1) + ".jsonl"},
+		{SessionID: claudeTestID(2), Path: project + "/" + claudeTestID(2) + ".jsonl"},
+	}
+	byPath := map[string]int{sessions[0].Path: 0, sessions[1].Path: 1}
+	tests := []struct {
+		path  string
+		index int
+		ok    bool
+	}{
+		{project + "/" + claudeTestID(2) + "/subagents/agent-a1.jsonl", 1, true},
+		{project + "/" + claudeTestID(1) + "/tool-results/out.txt", 0, true},
+		// The debug log of a mapped session changes none of them.
+		{"/home/u/.claude/debug/" + claudeTestID(1) + ".txt", -1, true},
+		// A debug log of another session may remap a process.
+		{"/home/u/.claude/debug/" + claudeTestID(3) + ".txt", -1, false},
+		{project + "/" + claudeTestID(3) + ".jsonl", 0, false},
+		{"/home/u/.claude/sessions/10.json", 0, false},
+	}
+	for _, tt := range tests {
+		i, ok := claudeFileOwner(tt.path, byPath, sessions)
+		if ok != tt.ok || (ok && i != tt.index) {
+			t.Errorf("claudeFileOwner(%s) = %d, %v; want %d, %v", tt.path, i, ok, tt.index, tt.ok)
+		}
+	}
+}
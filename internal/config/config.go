@@ -0,0 +1,359 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Config is the user configuration loaded from the config file.
+//
+// Precedence, lowest to highest: built-in defaults, config file,
+// AGENTSTAT_* environment variables, command-line flags (applied by main).
+type Config struct {
+	// AllUsers reports processes owned by every user instead of only the
+	// current one. Reading other users' agent data normally requires root.
+	AllUsers bool                   `json:"all_users"`
+	Output   OutputConfig           `json:"output"`
+	Agents   map[string]AgentConfig `json:"agents"`
+	// Pricing maps model names to prices for estimating session cost. A key
+	// also matches any model name it is a prefix of ("claude-sonnet-4"
+	// matches "claude-sonnet-4-5-20250929"); the longest match wins.
+	Pricing map[string]Price `json:"pricing"`
+	// ContextWindows maps model names to context window sizes in tokens,
+	// matched like Pricing. Entries extend and override the built-in table.
+	ContextWindows map[string]int64 `json:"context_windows"`
+}
+
+// Price is the price of a model in USD per million tokens.
+type Price struct {
+	Input      float64 `json:"input"`
+	Output     float64 `json:"output"`
+	CacheRead  float64 `json:"cache_read"`
+	CacheWrite float64 `json:"cache_write"`
+}
+
+// OutputConfig holds defaults for how sessions are rendered.
+type OutputConfig struct {
+	Format  string   `json:"format"`  // "table" | "json"
+	Columns []string `json:"columns"` // table columns, in display order
+	Sort    string   `json:"sort"`    // column key, prefix with "-" for descending
+}
+
+// AgentConfig holds per-agent overrides. Zero values mean "use the default".
+type AgentConfig struct {
+	// Enabled disables the agent when set to false. Ignored when --agents is given.
+	Enabled *bool `json:"enabled,omitempty"`
+	// DataDir overrides the agent's data directory (e.g. ~/.claude, ~/.codex).
+	DataDir string `json:"data_dir,omitempty"`
+	// Timeout bounds each request the detector makes (HTTP, SQLite busy wait).
+	Timeout Duration `json:"timeout,omitempty"`
+	// ProcessRegex overrides the regular expression used to find agent processes.
+	ProcessRegex string `json:"process_regex,omitempty"`
+	// Username and Password are HTTP basic auth credentials for the agent's
+	// server (OpenCode). An empty Password means none are configured.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	processRe *regexp.Regexp // ProcessRegex, compiled by validate
+}
+
+// Duration is a time.Duration that unmarshals from a string such as "500ms".
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON accepts a Go duration string or a number of milliseconds.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		v, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		d.Duration = v
+		return nil
+	}
+	var ms int64
+	if err := json.Unmarshal(b, &ms); err != nil {
+		return fmt.Errorf("invalid duration %s", b)
+	}
+	d.Duration = time.Duration(ms) * time.Millisecond
+	return nil
+}
+
+// MarshalJSON encodes the duration as a Go duration string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Default returns the built-in configuration.
+func Default() *Config {
+	c := &Config{
+		Output: OutputConfig{
+			Format:  "table",
+			Columns: []string{"agent", "status", "session", "title", "directory", "pid"},
+		},
+		Agents: map[string]AgentConfig{
+			"opencode": {ProcessRegex: `(?i)^opencode$`, Timeout: Duration{500 * time.Millisecond}},
+			"codex":    {ProcessRegex: `(^|/)codex$`, Timeout: Duration{time.Second}},
+			"claude":   {ProcessRegex: `(^|/)claude$`},
+			"amp":      {ProcessRegex: `(^|/)amp$`},
+			"gemini":   {ProcessRegex: `(^|/)gemini$`},
+		},
+		ContextWindows: map[string]int64{
+			"claude-": 200_000,
+			"gpt-5":   272_000,
+			"gpt-4.1": 1_047_576,
+			"o3":      200_000,
+			"o4-mini": 200_000,
+			"gemini-": 1_048_576,
+		},
+	}
+	if err := c.validate(); err != nil {
+		panic(err) // the built-in patterns compile
+	}
+	return c
+}
+
+// Path returns the config file location: $AGENTSTAT_CONFIG if set,
+// otherwise $XDG_CONFIG_HOME/agentstat/config.json (~/.config by default).
+func Path() string {
+	if p := os.Getenv("AGENTSTAT_CONFIG"); p != "" {
+		return p
+	}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "agentstat", "config.json")
+}
+
+// CacheDir returns the directory for agentstat's caches:
+// $XDG_CACHE_HOME/agentstat (~/.cache/agentstat by default).
+func CacheDir() string {
+	dir := os.Getenv("XDG_CACHE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".cache")
+	}
+	return filepath.Join(dir, "agentstat")
+}
+
+// Load reads the config file at path and merges it over the defaults, then
+// applies AGENTSTAT_* environment overrides. An empty path means Path().
+// A missing file is only an error when the path was given explicitly.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	explicit := path != "" || os.Getenv("AGENTSTAT_CONFIG") != ""
+	if path == "" {
+		path = Path()
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		switch {
+		case err == nil:
+			if err := cfg.merge(data); err != nil {
+				return nil, fmt.Errorf("config %s: %w", path, err)
+			}
+		case errors.Is(err, os.ErrNotExist) && !explicit:
+			// No config file — defaults only.
+		default:
+			return nil, err
+		}
+	}
+
+	cfg.applyEnv()
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Agent returns the effective settings for the named agent.
+func (c *Config) Agent(name string) AgentConfig {
+	return c.Agents[name]
+}
+
+// PriceFor returns the configured price for a model.
+func (c *Config) PriceFor(model string) (Price, bool) {
+	return lookupModel(c.Pricing, model)
+}
+
+// ContextWindowFor returns the context window of a model in tokens, or 0 if
+// unknown.
+func (c *Config) ContextWindowFor(model string) int64 {
+	n, _ := lookupModel(c.ContextWindows, model)
+	return n
+}
+
+// lookupModel finds a per-model value: an exact (case-insensitive) key, else
+// the longest key that prefixes the model name.
+func lookupModel[V any](m map[string]V, model string) (V, bool) {
+	model = strings.ToLower(model)
+	if v, ok := m[model]; ok {
+		return v, true
+	}
+	var best string
+	for key := range m {
+		if strings.HasPrefix(model, key) && len(key) > len(best) {
+			best = key
+		}
+	}
+	if best == "" {
+		var zero V
+		return zero, false
+	}
+	return m[best], true
+}
+
+// Process returns the compiled ProcessRegex, or nil if there is none.
+func (a AgentConfig) Process() *regexp.Regexp {
+	return a.processRe
+}
+
+// IsEnabled reports whether the agent is enabled (default true).
+func (a AgentConfig) IsEnabled() bool {
+	return a.Enabled == nil || *a.Enabled
+}
+
+// merge overlays the non-zero fields of a JSON config file onto c.
+func (c *Config) merge(data []byte) error {
+	var file Config
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+
+	if file.AllUsers {
+		c.AllUsers = true
+	}
+	if file.Output.Format != "" {
+		c.Output.Format = file.Output.Format
+	}
+	if len(file.Output.Columns) > 0 {
+		c.Output.Columns = file.Output.Columns
+	}
+	if file.Output.Sort != "" {
+		c.Output.Sort = file.Output.Sort
+	}
+
+	for name, override := range file.Agents {
+		name = strings.ToLower(name)
+		base, ok := c.Agents[name]
+		if !ok {
+			return fmt.Errorf("agents: unknown agent %q (known: %s)", name, strings.Join(slices.Sorted(maps.Keys(c.Agents)), ", "))
+		}
+		if override.Enabled != nil {
+			base.Enabled = override.Enabled
+		}
+		if override.DataDir != "" {
+			base.DataDir = expandHome(override.DataDir)
+		}
+		if override.Timeout.Duration > 0 {
+			base.Timeout = override.Timeout
+		}
+		if override.ProcessRegex != "" {
+			base.ProcessRegex = override.ProcessRegex
+		}
+		if override.Username != "" {
+			base.Username = override.Username
+		}
+		if override.Password != "" {
+			base.Password = override.Password
+		}
+		c.Agents[name] = base
+	}
+
+	if len(file.Pricing) > 0 && c.Pricing == nil {
+		c.Pricing = make(map[string]Price, len(file.Pricing))
+	}
+	for name, price := range file.Pricing {
+		c.Pricing[strings.ToLower(name)] = price
+	}
+	for name, n := range file.ContextWindows {
+		c.ContextWindows[strings.ToLower(name)] = n
+	}
+	return nil
+}
+
+// applyEnv applies AGENTSTAT_FORMAT, AGENTSTAT_COLUMNS and AGENTSTAT_SORT.
+func (c *Config) applyEnv() {
+	if v := os.Getenv("AGENTSTAT_FORMAT"); v != "" {
+		c.Output.Format = v
+	}
+	if v := os.Getenv("AGENTSTAT_COLUMNS"); v != "" {
+		c.Output.Columns = SplitList(v)
+	}
+	if v := os.Getenv("AGENTSTAT_SORT"); v != "" {
+		c.Output.Sort = v
+	}
+}
+
+// Validate checks the output settings once every source, flags included,
+// has been applied.
+func (o OutputConfig) Validate() error {
+	switch o.Format {
+	case "table", "json":
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q (want table or json)", o.Format)
+}
+
+// validate checks values that would otherwise fail later at a less helpful
+// point, and compiles the process regexes. The output format is checked by
+// OutputConfig.Validate, as flags can still override it.
+func (c *Config) validate() error {
+	for name, a := range c.Agents {
+		if a.ProcessRegex == "" {
+			continue
+		}
+		re, err := regexp.Compile(a.ProcessRegex)
+		if err != nil {
+			return fmt.Errorf("agents.%s.process_regex: %w", name, err)
+		}
+		a.processRe = re
+		c.Agents[name] = a
+	}
+	return nil
+}
+
+// SplitList splits a comma-separated list, trimming blanks and lowercasing.
+func SplitList(raw string) []string {
+	var out []string
+	for _, s := range strings.Split(raw, ",") {
+		s = strings.TrimSpace(strings.ToLower(s))
+		if s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// expandHome replaces a leading "~/" with the current user's home directory.
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
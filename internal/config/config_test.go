@@ -0,0 +1,167 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file to a temporary directory and returns its
+// path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadMerge(t *testing.T) {
+	t.Setenv("AGENTSTAT_FORMAT", "")
+	t.Setenv("AGENTSTAT_COLUMNS", "")
+	t.Setenv("AGENTSTAT_SORT", "")
+	path := writeConfig(t, `{
+		"output": {"sort": "-pid"},
+		"agents": {
+			"Codex": {"timeout": "2s", "process_regex": "^my-codex$"},
+			"claude": {"enabled": false, "data_dir": "/data/claude"}
+		},
+		"pricing": {"GPT-5": {"input": 1.25}},
+		"context_windows": {"gpt-5": 400000}
+	}`)
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fields the file sets override the defaults; the others keep them.
+	if c.Output.Format != "table" || c.Output.Sort != "-pid" || len(c.Output.Columns) == 0 {
+		t.Errorf("output %+v", c.Output)
+	}
+	codex := c.Agent("codex")
+	if codex.Timeout.Duration != 2*time.Second || codex.ProcessRegex != "^my-codex$" {
+		t.Errorf("codex %+v", codex)
+	}
+	if !codex.Process().MatchString("my-codex") || codex.Process().MatchString("/usr/bin/codex") {
+		t.Errorf("codex process regex %v not the configured one", codex.Process())
+	}
+	if claude := c.Agent("claude"); claude.IsEnabled() || claude.DataDir != "/data/claude" || claude.ProcessRegex != `(^|/)claude$` {
+		t.Errorf("claude %+v", claude)
+	}
+	if opencode := c.Agent("opencode"); !opencode.IsEnabled() || opencode.Timeout.Duration != 500*time.Millisecond {
+		t.Errorf("opencode %+v", opencode)
+	}
+	if p, ok := c.PriceFor("gpt-5-codex"); !ok || p.Input != 1.25 {
+		t.Errorf("price of gpt-5-codex %+v, %v", p, ok)
+	}
+	if n := c.ContextWindowFor("gpt-5"); n != 400_000 {
+		t.Errorf("context window of gpt-5 = %d, want the configured 400000", n)
+	}
+	if n := c.ContextWindowFor("claude-sonnet-4-5"); n != 200_000 {
+		t.Errorf("context window of claude-sonnet-4-5 = %d, want the built-in 200000", n)
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	path := writeConfig(t, `{"output": {"format": "json", "columns": ["agent"], "sort": "agent"}}`)
+	t.Setenv("AGENTSTAT_FORMAT", "table")
+	t.Setenv("AGENTSTAT_COLUMNS", " Status, pid ,")
+	t.Setenv("AGENTSTAT_SORT", "")
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The environment overrides the file; an empty variable does not.
+	if c.Output.Format != "table" || c.Output.Sort != "agent" {
+		t.Errorf("output %+v", c.Output)
+	}
+	if want := []string{"status", "pid"}; !slices.Equal(c.Output.Columns, want) {
+		t.Errorf("columns %v, want %v", c.Output.Columns, want)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{"unknown agent", `{"agents": {"cursor": {}}}`, `unknown agent "cursor"`},
+		{"invalid regex", `{"agents": {"amp": {"process_regex": "("}}}`, "agents.amp.process_regex"},
+		{"invalid duration", `{"agents": {"codex": {"timeout": "soon"}}}`, "soon"},
+		{"invalid JSON", `{`, "unexpected end"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeConfig(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want one mentioning %q", err, tt.want)
+			}
+		})
+	}
+
+	// A missing file is only an error when given explicitly.
+	missing := filepath.Join(t.TempDir(), "missing.json")
+	if _, err := Load(missing); err == nil {
+		t.Error("no error for a missing explicit config file")
+	}
+	t.Setenv("AGENTSTAT_CONFIG", "")
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	if _, err := Load(""); err != nil {
+		t.Errorf("missing default config file: %v", err)
+	}
+}
+
+func TestDurationUnmarshal(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{`"500ms"`, 500 * time.Millisecond, true},
+		{`"1m30s"`, 90 * time.Second, true},
+		{`250`, 250 * time.Millisecond, true},
+		{`"fast"`, 0, false},
+		{`true`, 0, false},
+	}
+	for _, tt := range tests {
+		var d Duration
+		err := json.Unmarshal([]byte(tt.in), &d)
+		if (err == nil) != tt.ok || d.Duration != tt.want {
+			t.Errorf("unmarshal %s: %v, %v; want %v, ok %v", tt.in, d.Duration, err, tt.want, tt.ok)
+		}
+	}
+	if b, _ := json.Marshal(Duration{2 * time.Second}); string(b) != `"2s"` {
+		t.Errorf("marshal 2s: %s", b)
+	}
+}
+
+func TestLookupModel(t *testing.T) {
+	m := map[string]int{
+		"claude-":           1,
+		"claude-sonnet-4":   2,
+		"claude-sonnet-4-5": 3,
+		"gpt-5":             4,
+	}
+	tests := []struct {
+		model string
+		want  int
+		ok    bool
+	}{
+		{"claude-sonnet-4-5-20250929", 3, true},
+		{"claude-sonnet-4-20250514", 2, true},
+		{"Claude-Opus-4-1", 1, true},
+		{"gpt-5", 4, true},
+		{"gpt-4.1", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := lookupModel(m, tt.model); got != tt.want || ok != tt.ok {
+			t.Errorf("lookupModel(%q) = %d, %v; want %d, %v", tt.model, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -1,21 +1,111 @@
 package model
 
+import "time"
+
 // Status constants for agent sessions.
 const (
 	StatusBusy    = "busy"
 	StatusIdle    = "idle"
 	StatusRetry   = "retry"
 	StatusUnknown = "unknown"
+	// StatusError means the last turn failed and the agent awaits a prompt.
+	StatusError = "error"
+	// StatusWaitingApproval means the agent is blocked on a permission or
+	// approval prompt: a human is needed now.
+	StatusWaitingApproval = "waiting"
+)
+
+// Confidence levels of a process-to-session mapping.
+const (
+	ConfidenceHigh   = "high"   // the agent itself records the mapping
+	ConfidenceMedium = "medium" // strong evidence that can be stale
+	ConfidenceLow    = "low"    // a heuristic guess
+)
+
+// Modes of an agent process, from its command line.
+const (
+	ModeTUI       = "tui"        // interactive terminal UI
+	ModeExec      = "exec"       // non-interactive run of a single task
+	ModeAppServer = "app-server" // backend of an IDE extension or desktop app
+	ModeMCPServer = "mcp-server" // tool server of another MCP client
 )
 
 // AgentSession represents a single discovered agent session.
+//
+// Time fields are omitted from JSON when unknown.
 type AgentSession struct {
-	Agent     string `json:"agent"`      // "opencode" | "codex" | "claude" | "amp" | "gemini"
-	Status    string `json:"status"`     // "busy" | "idle" | "retry" | "unknown"
+	Agent     string `json:"agent"`  // "opencode" | "codex" | "claude" | "amp" | "gemini"
+	Status    string `json:"status"` // "busy" | "idle" | "retry" | "waiting" | "error" | "unknown"
 	SessionID string `json:"session_id"`
 	Title     string `json:"title"`
 	Directory string `json:"directory"`
 	PID       int    `json:"pid"`
+	User      string `json:"user,omitempty"`      // owner of the process
+	Container string `json:"container,omitempty"` // container ID when running in a container
+	Address   string `json:"address,omitempty"`   // listening address for server-based agents (OpenCode)
+	Mode      string `json:"mode,omitempty"`      // how the agent runs, where it has several: Mode* (Codex)
+	Branch    string `json:"branch,omitempty"`    // git branch recorded for the session (Codex)
+	Archived  bool   `json:"archived,omitempty"`  // the session has been archived (Codex)
+	Activity  string `json:"activity,omitempty"`  // the tool call in progress or awaiting approval, e.g. "Bash: go test ./..."
+
+	// MatchMethod and MatchConfidence record how the process was mapped to
+	// its session, for agents where the mapping is inferred.
+	MatchMethod     string `json:"match_method,omitempty"`
+	MatchConfidence string `json:"match_confidence,omitempty"` // "high" | "medium" | "low"
+
+	// Path is the host path of the file the session's state was read from,
+	// which tells watch mode what to recompute when that file changes.
+	Path string `json:"-"`
+
+	StartedAt      time.Time `json:"started_at,omitzero"`       // process start time
+	CreatedAt      time.Time `json:"created_at,omitzero"`       // session creation time, where recorded
+	LastActivityAt time.Time `json:"last_activity_at,omitzero"` // last write to the session's transcript
+	StatusSince    time.Time `json:"status_since,omitzero"`     // when the current status began
+
+	Model string  `json:"model,omitempty"` // model used by the latest response
+	Usage Usage   `json:"usage,omitzero"`  // tokens consumed by the session so far
+	Cost  float64 `json:"cost,omitempty"`  // USD; reported by the agent or estimated from the pricing config
+
+	ContextTokens int64 `json:"context_tokens,omitempty"` // context size of the latest response
+	ContextWindow int64 `json:"context_window,omitempty"` // the model's context window, if known
+	Compacting    bool  `json:"compacting,omitempty"`     // the agent is compacting its context right now
+	Compactions   int   `json:"compactions,omitempty"`    // compactions so far in the session
+
+	// SubagentType is set on child sessions: the kind of subagent, e.g.
+	// "general-purpose" for Claude Code Task agents.
+	SubagentType string         `json:"subagent_type,omitempty"`
+	Children     []AgentSession `json:"children,omitempty"` // subagents spawned by this session
+}
+
+// ContextUsed returns the fraction of the context window in use, or 0 if
+// either size is unknown.
+func (s AgentSession) ContextUsed() float64 {
+	if s.ContextTokens <= 0 || s.ContextWindow <= 0 {
+		return 0
+	}
+	return float64(s.ContextTokens) / float64(s.ContextWindow)
+}
+
+// Usage is the token consumption of a session, summed over its responses.
+// InputTokens excludes tokens read from or written to the prompt cache.
+type Usage struct {
+	InputTokens      int64 `json:"input_tokens"`
+	OutputTokens     int64 `json:"output_tokens"`
+	CacheReadTokens  int64 `json:"cache_read_tokens,omitempty"`
+	CacheWriteTokens int64 `json:"cache_write_tokens,omitempty"`
+}
+
+// Total returns the sum of all token counts.
+func (u Usage) Total() int64 {
+	return u.InputTokens + u.OutputTokens + u.CacheReadTokens + u.CacheWriteTokens
+}
+
+// Add accumulates v into u.
+func (u *Usage) Add(v Usage) {
+	u.InputTokens += v.InputTokens
+	u.OutputTokens += v.OutputTokens
+	u.CacheReadTokens += v.CacheReadTokens
+	u.CacheWriteTokens += v.CacheWriteTokens
 }
 
 // AllAgents lists the known agent names for validation.
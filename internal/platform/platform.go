@@ -1,31 +1,166 @@
 package platform
 
-import "regexp"
+import (
+	"bufio"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
 
 // ListenEntry represents a TCP listening socket.
 type ListenEntry struct {
+	Addr string // bind address without brackets, e.g. "127.0.0.1", "::", "0.0.0.0"
 	Port int
 	PID  int
 	Cmd  string
 }
 
+// IsLoopback reports whether the socket only accepts connections from the host.
+func (e ListenEntry) IsLoopback() bool {
+	ip := net.ParseIP(e.Addr)
+	return ip != nil && ip.IsLoopback()
+}
+
+// HostPort returns the address to connect to the socket from this host.
+// Wildcard binds are reached through the loopback address of the same family.
+func (e ListenEntry) HostPort() string {
+	host := e.Addr
+	switch ip := net.ParseIP(host); {
+	case ip == nil:
+		host = "localhost"
+	case ip.IsUnspecified() && ip.To4() == nil:
+		host = "::1"
+	case ip.IsUnspecified():
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(e.Port))
+}
+
+// normalizeAddr strips brackets, zone suffixes and the IPv4-mapped prefix
+// from a socket address as printed by ss or lsof; "*" becomes "0.0.0.0".
+func normalizeAddr(addr string) string {
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if i := strings.IndexByte(addr, '%'); i >= 0 {
+		addr = addr[:i]
+	}
+	if addr == "*" {
+		return "0.0.0.0"
+	}
+	return strings.TrimPrefix(addr, "::ffff:")
+}
+
 // Platform abstracts OS-specific process and network introspection.
 type Platform interface {
-	// FindPIDsByName returns PIDs whose binary path (argv[0]) matches re.
-	FindPIDsByName(re *regexp.Regexp) []int
-	// FindPIDsByArgs returns PIDs where any command-line argument matches re.
-	// Unlike FindPIDsByName which only checks argv[0], this checks all args.
-	FindPIDsByArgs(re *regexp.Regexp) []int
+	// Snapshot reads the whole process table (PID, PPID, UID, argv, exe, cwd,
+	// start time, tty) in a single pass.
+	Snapshot() *Snapshot
+	// ListPIDs returns the PIDs of all running processes without reading
+	// anything else about them.
+	ListPIDs() []int
+	// ReadProcesses reads the given processes as Snapshot does; those that
+	// have exited are left out.
+	ReadProcesses(pids []int) []*Process
 	// ListOpenFiles returns absolute file paths of all open FDs for a process.
 	ListOpenFiles(pid int) []string
-	// ReadProcessCwd returns the current working directory of a process.
-	ReadProcessCwd(pid int) string
-	// ReadProcessPPID returns the parent PID of a process, or 0 on failure.
-	ReadProcessPPID(pid int) int
-	// FindListenTCP returns all TCP LISTEN sockets on the host.
-	FindListenTCP() []ListenEntry
+	// FindListenTCP returns the TCP LISTEN sockets of the given processes
+	// with their bind address.
+	FindListenTCP(pids []int) []ListenEntry
+	// ReadProcessEnviron returns the environment of a process, or nil if it
+	// cannot be read (e.g. the process belongs to another user).
+	ReadProcessEnviron(pid int) map[string]string
+	// ReadProcessContainer returns the ID of the container a process runs in,
+	// or "" when it is not containerized.
+	ReadProcessContainer(pid int) string
+	// ReadProcessRoot returns a path prefix through which the process's
+	// filesystem is readable when it lives in another mount namespace (e.g. a
+	// container), or "" when its paths can be used as-is.
+	ReadProcessRoot(pid int) string
+	// ContainerUID maps a UID as seen by agentstat to the UID it appears as
+	// inside the user namespace of pid, or -1 if it is not mapped there.
+	ContainerUID(pid, uid int) int
 }
 
 // P is the platform-specific implementation, initialised by an init() in
 // the platform_linux.go or platform_darwin.go file.
 var P Platform
+
+// UserNameForUID returns the login name for a UID from the passwd database,
+// or the numeric UID as a string if it has no entry.
+func UserNameForUID(uid int) string {
+	if uid < 0 {
+		return ""
+	}
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return strconv.Itoa(uid)
+	}
+	return u.Username
+}
+
+// HomeForUID returns the home directory of the user with the given UID from
+// the passwd database, or "" if it cannot be resolved.
+func HomeForUID(uid int) string {
+	if uid < 0 {
+		return ""
+	}
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return ""
+	}
+	return u.HomeDir
+}
+
+// HomeForUIDIn is HomeForUID for process pid, whose filesystem is reachable
+// under root (see ReadProcessRoot); it maps uid into the process's user
+// namespace (see ContainerUID) and reads root/etc/passwd directly.
+func HomeForUIDIn(pid int, root string, uid int) string {
+	if root == "" {
+		return HomeForUID(uid)
+	}
+	uid = P.ContainerUID(pid, uid)
+	if uid < 0 {
+		return ""
+	}
+
+	f, err := os.Open(filepath.Join(root, "etc", "passwd"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	// name:password:uid:gid:gecos:home:shell
+	want := strconv.Itoa(uid)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) >= 6 && fields[2] == want {
+			return fields[5]
+		}
+	}
+	return ""
+}
+
+// parseEnviron splits NUL-separated KEY=VALUE pairs into a map.
+func parseEnviron(data []byte) map[string]string {
+	env := make(map[string]string)
+	start := 0
+	for i := 0; i <= len(data); i++ {
+		if i < len(data) && data[i] != 0 {
+			continue
+		}
+		kv := string(data[start:i])
+		start = i + 1
+		for j := 0; j < len(kv); j++ {
+			if kv[j] == '=' {
+				if j > 0 {
+					env[kv[:j]] = kv[j+1:]
+				}
+				break
+			}
+		}
+	}
+	return env
+}
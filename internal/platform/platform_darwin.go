@@ -3,10 +3,14 @@
 package platform
 
 import (
+	"bytes"
+	"encoding/binary"
 	"os/exec"
-	"regexp"
 	"strconv"
 	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 // Compile-time interface check.
@@ -16,71 +20,113 @@ type darwinPlatform struct{}
 
 func init() { P = &darwinPlatform{} }
 
-// FindPIDsByName runs `ps ax -o pid,command` and returns PIDs whose command matches re.
-func (d *darwinPlatform) FindPIDsByName(re *regexp.Regexp) []int {
-	out, err := exec.Command("ps", "ax", "-o", "pid,command").Output()
+// psLstartLayout is the format of the `ps -o lstart` column in the C locale.
+const psLstartLayout = "Mon Jan _2 15:04:05 2006"
+
+// Snapshot runs `ps` once for the process table and `lsof` once for every
+// process's working directory.
+func (d *darwinPlatform) Snapshot() *Snapshot {
+	return NewSnapshot(readPS([]string{"-ax"}, readAllCwds()))
+}
+
+// ListPIDs runs `ps` for the PID column only.
+func (d *darwinPlatform) ListPIDs() []int {
+	out, err := exec.Command("ps", "-ax", "-o", "pid=").Output()
 	if err != nil {
 		return nil
 	}
-
 	var pids []int
-	for _, line := range strings.Split(string(out), "\n") {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-		// Each line: "  PID COMMAND ARGS..."
-		// Split into at most 2 fields: PID and the rest (command + args).
-		fields := strings.SplitN(line, " ", 2)
-		if len(fields) < 2 {
-			continue
-		}
-		pid, err := strconv.Atoi(strings.TrimSpace(fields[0]))
-		if err != nil {
-			continue
-		}
-		cmd := strings.TrimSpace(fields[1])
-		// Match only the first argument (binary path), equivalent to argv[0].
-		argv0 := strings.SplitN(cmd, " ", 2)[0]
-		if re.MatchString(argv0) {
+	for _, f := range strings.Fields(string(out)) {
+		if pid, err := strconv.Atoi(f); err == nil {
 			pids = append(pids, pid)
 		}
 	}
 	return pids
 }
 
-// FindPIDsByArgs runs `ps ax -o pid,command` and returns PIDs where any
-// command-line argument matches re.
-func (d *darwinPlatform) FindPIDsByArgs(re *regexp.Regexp) []int {
-	out, err := exec.Command("ps", "ax", "-o", "pid,command").Output()
-	if err != nil {
+// ReadProcesses runs `ps` and `lsof` once for the given processes.
+func (d *darwinPlatform) ReadProcesses(pids []int) []*Process {
+	if len(pids) == 0 {
 		return nil
 	}
+	list := make([]string, len(pids))
+	for i, pid := range pids {
+		list[i] = strconv.Itoa(pid)
+	}
+	joined := strings.Join(list, ",")
+	return readPS([]string{"-p", joined}, readCwds("-p", joined))
+}
 
-	var pids []int
+// readPS runs `ps` with the process selection args and parses each line into
+// a Process, taking working directories from cwds.
+func readPS(args []string, cwds map[int]string) []*Process {
+	cmd := exec.Command("ps", append(args, "-ww", "-o", "pid=,ppid=,ruid=,tty=,lstart=,command=")...)
+	cmd.Env = append(cmd.Environ(), "LC_ALL=C")
+	out, err := cmd.Output()
+	if len(out) == 0 && err != nil {
+		// ps exits 1 when some of the selected processes are gone.
+		return nil
+	}
+
+	var procs []*Process
 	for _, line := range strings.Split(string(out), "\n") {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-		fields := strings.SplitN(line, " ", 2)
-		if len(fields) < 2 {
+		// Each line: "PID PPID RUID TTY Www Mmm DD HH:MM:SS YYYY COMMAND ARGS..."
+		fields := strings.Fields(line)
+		if len(fields) < 10 {
 			continue
 		}
-		pid, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+		pid, err := strconv.Atoi(fields[0])
 		if err != nil {
 			continue
 		}
-		cmd := strings.TrimSpace(fields[1])
-		// Check each argument individually.
-		for _, arg := range strings.Fields(cmd) {
-			if re.MatchString(arg) {
-				pids = append(pids, pid)
-				break
-			}
+		p := &Process{PID: pid, UID: -1}
+		p.PPID, _ = strconv.Atoi(fields[1])
+		if uid, err := strconv.Atoi(fields[2]); err == nil {
+			p.UID = uid
+		}
+		if fields[3] != "??" {
+			p.TTY = fields[3]
 		}
+		if t, err := time.ParseInLocation(psLstartLayout, strings.Join(fields[4:9], " "), time.Local); err == nil {
+			p.StartTime = t
+		}
+		// ps joins argv with spaces, so arguments containing spaces are split.
+		p.Argv = fields[9:]
+		p.Exe = p.Argv[0]
+		p.Cwd = cwds[pid]
+		procs = append(procs, p)
 	}
-	return pids
+	return procs
+}
+
+// readAllCwds runs `lsof -d cwd -Fpn` and returns each process's working
+// directory keyed by PID.
+func readAllCwds() map[int]string {
+	return readCwds()
+}
+
+// readCwds is readAllCwds for the processes selected by the lsof args.
+func readCwds(args ...string) map[int]string {
+	cwds := make(map[int]string)
+	if len(args) > 0 {
+		args = append([]string{"-a"}, args...)
+	}
+	out, err := exec.Command("lsof", append(args, "-d", "cwd", "-Fpn")...).Output()
+	if len(out) == 0 && err != nil {
+		return cwds
+	}
+
+	// Records: "p<PID>" followed by "n<path>".
+	var pid int
+	for _, line := range strings.Split(string(out), "\n") {
+		switch {
+		case strings.HasPrefix(line, "p"):
+			pid, _ = strconv.Atoi(line[1:])
+		case strings.HasPrefix(line, "n/") && pid > 0:
+			cwds[pid] = line[1:]
+		}
+	}
+	return cwds
 }
 
 // ListOpenFiles runs `lsof -p PID -Fn` and returns absolute file paths
@@ -102,42 +148,20 @@ func (d *darwinPlatform) ListOpenFiles(pid int) []string {
 	return paths
 }
 
-// ReadProcessCwd runs `lsof -a -p PID -d cwd -Fn` and returns the
-// current working directory of the given process.
-func (d *darwinPlatform) ReadProcessCwd(pid int) string {
-	out, err := exec.Command("lsof", "-a", "-p", strconv.Itoa(pid), "-d", "cwd", "-Fn").Output()
-	if err != nil {
-		return "-"
-	}
-
-	for _, line := range strings.Split(string(out), "\n") {
-		if strings.HasPrefix(line, "n/") {
-			return line[1:]
-		}
-	}
-	return "-"
-}
-
-// ReadProcessPPID returns the parent PID by running `ps -o ppid= -p PID`.
-func (d *darwinPlatform) ReadProcessPPID(pid int) int {
-	out, err := exec.Command("ps", "-o", "ppid=", "-p", strconv.Itoa(pid)).Output()
-	if err != nil {
-		return 0
-	}
-	ppid, err := strconv.Atoi(strings.TrimSpace(string(out)))
-	if err != nil {
-		return 0
-	}
-	return ppid
-}
-
-// FindListenTCP runs `lsof -iTCP -sTCP:LISTEN -nP -Fpcn` and returns
-// all TCP LISTEN sockets with their PID, port, and command name.
-func (d *darwinPlatform) FindListenTCP() []ListenEntry {
-	out, err := exec.Command("lsof", "-iTCP", "-sTCP:LISTEN", "-nP", "-Fpcn").Output()
-	if err != nil {
+// FindListenTCP runs `lsof -a -p {pids} -iTCP -sTCP:LISTEN -nP -Fpcn` and
+// returns the TCP LISTEN sockets of pids with their PID, address, port, and
+// command name.
+func (d *darwinPlatform) FindListenTCP(pids []int) []ListenEntry {
+	if len(pids) == 0 {
 		return nil
 	}
+	list := make([]string, len(pids))
+	for i, pid := range pids {
+		list[i] = strconv.Itoa(pid)
+	}
+	// lsof exits with status 1 when one of pids has no listening socket, so
+	// its output is parsed whatever the status.
+	out, _ := exec.Command("lsof", "-a", "-p", strings.Join(list, ","), "-iTCP", "-sTCP:LISTEN", "-nP", "-Fpcn").Output()
 
 	// lsof -Fpcn outputs grouped records:
 	//   p<PID>        — new process group
@@ -161,7 +185,7 @@ func (d *darwinPlatform) FindListenTCP() []ListenEntry {
 		case 'c':
 			curCmd = line[1:]
 		case 'n':
-			// Extract port from "host:port" format.
+			// Split "host:port", e.g. "127.0.0.1:3000", "*:8080", "[::1]:4096".
 			name := line[1:]
 			idx := strings.LastIndex(name, ":")
 			if idx < 0 {
@@ -172,9 +196,63 @@ func (d *darwinPlatform) FindListenTCP() []ListenEntry {
 				continue
 			}
 			if curPID > 0 {
-				entries = append(entries, ListenEntry{Port: port, PID: curPID, Cmd: curCmd})
+				entries = append(entries, ListenEntry{Addr: normalizeAddr(name[:idx]), Port: port, PID: curPID, Cmd: curCmd})
 			}
 		}
 	}
 	return entries
 }
+
+// ReadProcessEnviron reads the kern.procargs2 sysctl for a process and returns
+// the environment that follows its arguments.
+func (d *darwinPlatform) ReadProcessEnviron(pid int) map[string]string {
+	buf, err := unix.SysctlRaw("kern.procargs2", pid)
+	if err != nil || len(buf) < 4 {
+		return nil
+	}
+
+	// Layout: int32 argc, exec path, NUL padding, argc args, env strings.
+	argc := int(binary.LittleEndian.Uint32(buf[:4]))
+	rest := buf[4:]
+
+	// Skip the exec path and its NUL padding.
+	i := bytes.IndexByte(rest, 0)
+	if i < 0 {
+		return nil
+	}
+	for i < len(rest) && rest[i] == 0 {
+		i++
+	}
+	rest = rest[i:]
+
+	// Skip argv.
+	for n := 0; n < argc; n++ {
+		i := bytes.IndexByte(rest, 0)
+		if i < 0 {
+			return nil
+		}
+		rest = rest[i+1:]
+	}
+
+	// The environment ends at the first empty string.
+	if end := bytes.Index(rest, []byte{0, 0}); end >= 0 {
+		rest = rest[:end]
+	}
+	return parseEnviron(rest)
+}
+
+// ReadProcessContainer always returns "": containers on macOS run inside a
+// Linux VM whose processes are not visible to the host.
+func (d *darwinPlatform) ReadProcessContainer(pid int) string {
+	return ""
+}
+
+// ContainerUID returns uid unchanged: macOS has no user namespaces.
+func (d *darwinPlatform) ContainerUID(pid, uid int) int {
+	return uid
+}
+
+// ReadProcessRoot always returns "": macOS has no per-process mount namespaces.
+func (d *darwinPlatform) ReadProcessRoot(pid int) string {
+	return ""
+}
@@ -3,13 +3,18 @@
 package platform
 
 import (
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Compile-time interface check.
@@ -19,69 +24,126 @@ type linuxPlatform struct{}
 
 func init() { P = &linuxPlatform{} }
 
-// FindPIDsByName scans /proc/*/cmdline and returns PIDs whose argv[0] matches re.
-func (l *linuxPlatform) FindPIDsByName(re *regexp.Regexp) []int {
-	entries, err := filepath.Glob("/proc/[0-9]*/cmdline")
+// Snapshot reads every /proc/{pid} entry once: cmdline, stat, status, and the
+// exe and cwd links. Processes that exit while scanning are skipped.
+func (l *linuxPlatform) Snapshot() *Snapshot {
+	dirs, err := filepath.Glob("/proc/[0-9]*")
 	if err != nil {
-		return nil
+		return NewSnapshot(nil)
 	}
 
-	var pids []int
-	for _, entry := range entries {
-		data, err := os.ReadFile(entry)
+	boot := bootTime()
+	var procs []*Process
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(filepath.Base(dir))
 		if err != nil {
 			continue
 		}
-		// cmdline is null-delimited; take the first arg (the binary path).
-		args := strings.Split(string(data), "\x00")
-		if len(args) == 0 {
-			continue
+		if p := readProc(pid, boot); p != nil {
+			procs = append(procs, p)
 		}
-		if re.MatchString(args[0]) {
-			parts := strings.Split(entry, "/")
-			if len(parts) >= 3 {
-				pid, err := strconv.Atoi(parts[2])
-				if err == nil {
-					pids = append(pids, pid)
-				}
-			}
+	}
+	return NewSnapshot(procs)
+}
+
+// ListPIDs lists the numeric entries of /proc.
+func (l *linuxPlatform) ListPIDs() []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	var pids []int
+	for _, e := range entries {
+		if pid, err := strconv.Atoi(e.Name()); err == nil {
+			pids = append(pids, pid)
 		}
 	}
 	return pids
 }
 
-// FindPIDsByArgs scans /proc/*/cmdline and returns PIDs where any argument matches re.
-func (l *linuxPlatform) FindPIDsByArgs(re *regexp.Regexp) []int {
-	entries, err := filepath.Glob("/proc/[0-9]*/cmdline")
+// ReadProcesses reads /proc/{pid} of each of pids.
+func (l *linuxPlatform) ReadProcesses(pids []int) []*Process {
+	boot := bootTime()
+	var procs []*Process
+	for _, pid := range pids {
+		if p := readProc(pid, boot); p != nil {
+			procs = append(procs, p)
+		}
+	}
+	return procs
+}
+
+// clockTicks is USER_HZ, the unit of /proc/{pid}/stat times. It is 100 on
+// every mainstream Linux architecture.
+const clockTicks = 100
+
+// readProc reads one process from /proc. Returns nil if it has exited.
+func readProc(pid int, boot time.Time) *Process {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
 	if err != nil {
 		return nil
 	}
+	p := &Process{PID: pid, UID: -1}
 
-	var pids []int
-	for _, entry := range entries {
-		data, err := os.ReadFile(entry)
-		if err != nil || len(data) == 0 {
-			continue
-		}
-		args := strings.Split(string(data), "\x00")
-		matched := false
-		for _, arg := range args {
-			if arg != "" && re.MatchString(arg) {
-				matched = true
-				break
+	// /proc/PID/stat format: "pid (comm) state ppid pgrp session tty_nr ..."
+	// The comm field may contain spaces and parentheses, so find the last ')'.
+	s := string(stat)
+	if idx := strings.LastIndex(s, ")"); idx >= 0 && idx+2 < len(s) {
+		// After ") " fields are numbered from 3 (state); starttime is field 22.
+		fields := strings.Fields(s[idx+2:])
+		if len(fields) > 19 {
+			p.PPID, _ = strconv.Atoi(fields[1])
+			if tty, err := strconv.ParseUint(fields[4], 10, 32); err == nil {
+				p.TTY = ttyName(tty)
+			}
+			if ticks, err := strconv.ParseInt(fields[19], 10, 64); err == nil && !boot.IsZero() {
+				p.StartTime = boot.Add(time.Duration(ticks) * time.Second / clockTicks)
 			}
 		}
-		if matched {
-			parts := strings.Split(entry, "/")
-			if len(parts) >= 3 {
-				pid, err := strconv.Atoi(parts[2])
-				if err == nil {
-					pids = append(pids, pid)
-				}
+	}
+
+	if data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil && len(data) > 0 {
+		// cmdline is null-delimited with a trailing NUL.
+		p.Argv = strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00")
+	}
+	p.UID, p.NSPID = readStatus(pid)
+	p.Exe, _ = os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	p.Cwd, _ = os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
+	return p
+}
+
+// bootTime returns the system boot time from the "btime" line of /proc/stat.
+func bootTime() time.Time {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if v, ok := strings.CutPrefix(line, "btime "); ok {
+			sec, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err == nil {
+				return time.Unix(sec, 0)
 			}
 		}
 	}
-	return pids
+	return time.Time{}
+}
+
+// ttyName converts a tty_nr device number from /proc/{pid}/stat to a name.
+func ttyName(dev uint64) string {
+	if dev == 0 {
+		return ""
+	}
+	major := (dev >> 8) & 0xfff
+	minor := (dev & 0xff) | ((dev >> 12) & 0xfff00)
+	switch {
+	case major == 4:
+		return fmt.Sprintf("tty%d", minor)
+	case major >= 136 && major <= 143:
+		return fmt.Sprintf("pts/%d", (major-136)*256+minor)
+	default:
+		return fmt.Sprintf("%d:%d", major, minor)
+	}
 }
 
 // ListOpenFiles returns absolute file paths of all open FDs for a process
@@ -104,43 +166,126 @@ func (l *linuxPlatform) ListOpenFiles(pid int) []string {
 	return paths
 }
 
-// ReadProcessCwd returns the current working directory of a process
-// by reading /proc/{pid}/cwd symlink.
-func (l *linuxPlatform) ReadProcessCwd(pid int) string {
-	link, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
+// FindListenTCP returns the TCP LISTEN sockets of pids by parsing
+// /proc/net/tcp{,6} and joining socket inodes against /proc/{pid}/fd. Falls
+// back to `ss -tlnp` when /proc/net is unavailable.
+func (l *linuxPlatform) FindListenTCP(pids []int) []ListenEntry {
+	if len(pids) == 0 {
+		return nil
+	}
+	entries, err := listenTCPFromProc(pids)
 	if err != nil {
-		return "-"
+		return listenTCPFromSS(pids)
 	}
-	return link
+	return entries
 }
 
-// ReadProcessPPID returns the parent PID by reading field 4 from /proc/{pid}/stat.
-func (l *linuxPlatform) ReadProcessPPID(pid int) int {
-	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
-	if err != nil {
-		return 0
+// tcpListenState is the TCP_LISTEN value of the "st" column in /proc/net/tcp.
+const tcpListenState = "0A"
+
+// listenTCPFromProc reads LISTEN sockets from /proc/net/tcp and /proc/net/tcp6,
+// then resolves which of pids owns each socket inode. Only the descriptors of
+// pids are looked at, so sockets of other processes are omitted.
+func listenTCPFromProc(pids []int) ([]ListenEntry, error) {
+	byInode := make(map[string]ListenEntry)
+	found := false
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		found = true
+		parseProcNetTCP(data, byInode)
 	}
-	// /proc/PID/stat format: "pid (comm) state ppid ..."
-	// The comm field may contain spaces and parentheses, so find the last ')'.
-	s := string(data)
-	idx := strings.LastIndex(s, ")")
-	if idx < 0 || idx+2 >= len(s) {
-		return 0
+	if !found {
+		return nil, fmt.Errorf("/proc/net/tcp unavailable")
 	}
-	// After ") " we have: state ppid ...
-	fields := strings.Fields(s[idx+2:])
-	if len(fields) < 2 {
-		return 0
+	if len(byInode) == 0 {
+		return nil, nil
 	}
-	ppid, err := strconv.Atoi(fields[1])
-	if err != nil {
-		return 0
+
+	var entries []ListenEntry
+	remaining := len(byInode)
+	for _, pid := range pids {
+		if remaining == 0 {
+			break
+		}
+		fdDir := fmt.Sprintf("/proc/%d/fd", pid)
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		var cmd string
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode := strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")
+			e, ok := byInode[inode]
+			if !ok || e.PID != 0 {
+				continue
+			}
+			if cmd == "" {
+				data, _ := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+				cmd = strings.TrimSpace(string(data))
+			}
+
+			e.PID = pid
+			e.Cmd = cmd
+			byInode[inode] = e
+			entries = append(entries, e)
+			remaining--
+		}
+	}
+	return entries, nil
+}
+
+// parseProcNetTCP adds the LISTEN sockets of a /proc/net/tcp{,6} table to
+// byInode. Lines look like:
+//
+//	sl  local_address rem_address   st ... uid  timeout inode
+//	0: 0100007F:1F90 00000000:0000 0A ... 1000        0 12345 ...
+func parseProcNetTCP(data []byte, byInode map[string]ListenEntry) {
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 10 || fields[3] != tcpListenState {
+			continue
+		}
+		host, portHex, ok := strings.Cut(fields[1], ":")
+		if !ok {
+			continue
+		}
+		port, err := strconv.ParseUint(portHex, 16, 16)
+		if err != nil || port == 0 {
+			continue
+		}
+		addr := decodeProcNetAddr(host, binary.NativeEndian)
+		if addr == "" {
+			continue
+		}
+		byInode[fields[9]] = ListenEntry{Addr: addr, Port: int(port)}
+	}
+}
+
+// decodeProcNetAddr decodes the hex address of /proc/net/tcp{,6}: the kernel
+// prints the address as 32-bit words in host byte order, given as order, so
+// on little-endian machines the bytes of each word are reversed.
+func decodeProcNetAddr(h string, order binary.ByteOrder) string {
+	raw, err := hex.DecodeString(h)
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return ""
 	}
-	return ppid
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		order.PutUint32(ip[i:], binary.BigEndian.Uint32(raw[i:]))
+	}
+	return normalizeAddr(ip.String())
 }
 
-// FindListenTCP parses `ss -tlnp` output and returns all TCP LISTEN sockets.
-func (l *linuxPlatform) FindListenTCP() []ListenEntry {
+// listenTCPFromSS parses `ss -tlnp` output and returns the TCP LISTEN sockets
+// of pids.
+func listenTCPFromSS(pids []int) []ListenEntry {
 	out, err := exec.Command("ss", "-tlnp").Output()
 	if err != nil {
 		return nil
@@ -148,20 +293,123 @@ func (l *linuxPlatform) FindListenTCP() []ListenEntry {
 
 	// Example line:
 	// LISTEN  0  4096  0.0.0.0:38129  0.0.0.0:*  users:(("opencode",pid=1059916,fd=30))
-	re := regexp.MustCompile(`:(\d+)\s+\S+\s+users:\(\("([^"]+)",pid=(\d+),`)
+	re := regexp.MustCompile(`(\S+):(\d+)\s+\S+\s+users:\(\("([^"]+)",pid=(\d+),`)
 
 	var entries []ListenEntry
 	for _, line := range strings.Split(string(out), "\n") {
 		matches := re.FindStringSubmatch(line)
-		if len(matches) < 4 {
+		if len(matches) < 5 {
 			continue
 		}
-		port, _ := strconv.Atoi(matches[1])
-		pid, _ := strconv.Atoi(matches[3])
-		cmd := matches[2]
-		if port > 0 && pid > 0 {
-			entries = append(entries, ListenEntry{Port: port, PID: pid, Cmd: cmd})
+		port, _ := strconv.Atoi(matches[2])
+		pid, _ := strconv.Atoi(matches[4])
+		cmd := matches[3]
+		if port > 0 && pid > 0 && slices.Contains(pids, pid) {
+			entries = append(entries, ListenEntry{Addr: normalizeAddr(matches[1]), Port: port, PID: pid, Cmd: cmd})
 		}
 	}
 	return entries
 }
+
+// ReadProcessEnviron parses /proc/{pid}/environ into a map.
+func (l *linuxPlatform) ReadProcessEnviron(pid int) map[string]string {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil {
+		return nil
+	}
+	return parseEnviron(data)
+}
+
+// readStatus returns the real UID from the "Uid:" line of /proc/{pid}/status
+// and the PID in the innermost PID namespace from the "NSpid:" line, or -1
+// and 0 for either if unknown.
+func readStatus(pid int) (uid, nspid int) {
+	uid = -1
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return uid, 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if v, ok := strings.CutPrefix(line, "Uid:"); ok {
+			// Uid:	real	effective	saved	filesystem
+			if fields := strings.Fields(v); len(fields) > 0 {
+				if n, err := strconv.Atoi(fields[0]); err == nil {
+					uid = n
+				}
+			}
+		} else if v, ok := strings.CutPrefix(line, "NSpid:"); ok {
+			// NSpid:	outermost	...	innermost (one PID per nested namespace)
+			if fields := strings.Fields(v); len(fields) > 0 {
+				nspid, _ = strconv.Atoi(fields[len(fields)-1])
+			}
+		}
+	}
+	return uid, nspid
+}
+
+// ContainerUID maps uid through /proc/{pid}/uid_map, whose lines read
+// "inside outside count". A process whose map cannot be read is taken to
+// share agentstat's user namespace.
+func (l *linuxPlatform) ContainerUID(pid, uid int) int {
+	if uid < 0 {
+		return -1
+	}
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/uid_map", pid))
+	if err != nil {
+		return uid
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		inside, err1 := strconv.Atoi(fields[0])
+		outside, err2 := strconv.Atoi(fields[1])
+		count, err3 := strconv.Atoi(fields[2])
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		if uid >= outside && uid-outside < count {
+			return inside + uid - outside
+		}
+	}
+	return -1
+}
+
+// containerIDRe matches container IDs in cgroup paths written by Docker,
+// Podman, containerd and CRI-O, e.g. "/docker/<id>", "libpod-<id>.scope".
+var containerIDRe = regexp.MustCompile(`(?:docker|libpod|crio|cri-containerd|containerd)[-/:]([0-9a-f]{64})|/([0-9a-f]{64})(?:\.scope)?(?:/|$)`)
+
+// ReadProcessContainer extracts a container ID from /proc/{pid}/cgroup.
+func (l *linuxPlatform) ReadProcessContainer(pid int) string {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return ""
+	}
+	// Each line: "hierarchy-ID:controllers:path" (cgroup v2 has a single "0::path").
+	for _, line := range strings.Split(string(data), "\n") {
+		m := containerIDRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if m[1] != "" {
+			return m[1]
+		}
+		return m[2]
+	}
+	return ""
+}
+
+// ReadProcessRoot returns /proc/{pid}/root when the process is in a different
+// mount namespace from agentstat, so its files are read through that link.
+func (l *linuxPlatform) ReadProcessRoot(pid int) string {
+	self, err := os.Readlink("/proc/self/ns/mnt")
+	if err != nil {
+		return ""
+	}
+	other, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/mnt", pid))
+	if err != nil || other == self {
+		return ""
+	}
+	return fmt.Sprintf("/proc/%d/root", pid)
+}
@@ -0,0 +1,103 @@
+package platform
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestDecodeProcNetAddr(t *testing.T) {
+	tests := []struct {
+		hex   string
+		order binary.ByteOrder
+		want  string
+	}{
+		{"0100007F", binary.LittleEndian, "127.0.0.1"},
+		{"7F000001", binary.BigEndian, "127.0.0.1"},
+		{"00000000", binary.LittleEndian, "0.0.0.0"},
+		{"0101A8C0", binary.LittleEndian, "192.168.1.1"},
+		{"00000000000000000000000001000000", binary.LittleEndian, "::1"},
+		{"00000000000000000000000000000001", binary.BigEndian, "::1"},
+		{"000080FE000000000000000001000000", binary.LittleEndian, "fe80::1"},
+		{"FE800000000000000000000000000001", binary.BigEndian, "fe80::1"},
+		// An IPv4-mapped address is reported as plain IPv4.
+		{"0000000000000000FFFF00000100007F", binary.LittleEndian, "127.0.0.1"},
+		{"0100", binary.LittleEndian, ""},
+		{"not hex!", binary.LittleEndian, ""},
+	}
+	for _, tt := range tests {
+		if got := decodeProcNetAddr(tt.hex, tt.order); got != tt.want {
+			t.Errorf("decodeProcNetAddr(%q, %v) = %q, want %q", tt.hex, tt.order, got, tt.want)
+		}
+	}
+}
+
+// procNetAddr encodes ip as /proc/net/tcp{,6} prints it on this machine.
+func procNetAddr(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	raw := make([]byte, len(ip))
+	for i := 0; i < len(ip); i += 4 {
+		binary.BigEndian.PutUint32(raw[i:], binary.NativeEndian.Uint32(ip[i:]))
+	}
+	return hex.EncodeToString(raw)
+}
+
+func TestParseProcNetTCP(t *testing.T) {
+	loopback := procNetAddr(net.ParseIP("127.0.0.1"))
+	any6 := procNetAddr(net.IPv6unspecified)
+	data := "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n" +
+		"   0: " + loopback + ":1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 12345 1 0000000000000000 100 0 0 10 0\n" +
+		// Connected sockets and ports being bound are skipped.
+		"   1: " + loopback + ":9C40 " + loopback + ":1F90 01 00000000:00000000 00:00000000 00000000  1000        0 12346 1 0000000000000000 20 4 30 10 -1\n" +
+		"   2: " + loopback + ":0000 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 12347 1 0000000000000000 100 0 0 10 0\n" +
+		"   3: " + any6 + ":0FA0 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 12348 1 0000000000000000 100 0 0 10 0\n"
+
+	byInode := make(map[string]ListenEntry)
+	parseProcNetTCP([]byte(data), byInode)
+
+	want := map[string]ListenEntry{
+		"12345": {Addr: "127.0.0.1", Port: 8080},
+		"12348": {Addr: "::", Port: 4000},
+	}
+	if len(byInode) != len(want) {
+		t.Errorf("got %d sockets %v, want %d", len(byInode), byInode, len(want))
+	}
+	for inode, w := range want {
+		if got := byInode[inode]; got != w {
+			t.Errorf("socket %s = %+v, want %+v", inode, got, w)
+		}
+	}
+}
+
+func TestListenTCPFromProc(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	find := func(pids []int) *ListenEntry {
+		entries, err := listenTCPFromProc(pids)
+		if err != nil {
+			t.Skip(err)
+		}
+		for _, e := range entries {
+			if e.Port == port {
+				return &e
+			}
+		}
+		return nil
+	}
+	pid := os.Getpid()
+	if e := find([]int{pid}); e == nil || e.PID != pid || e.Addr != "127.0.0.1" {
+		t.Errorf("own socket: got %+v, want PID %d on 127.0.0.1", e, pid)
+	}
+	if e := find([]int{os.Getppid()}); e != nil {
+		t.Errorf("socket found through another process: %+v", e)
+	}
+}
@@ -0,0 +1,117 @@
+package platform
+
+import (
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Process is one entry of a process table snapshot.
+type Process struct {
+	PID       int
+	PPID      int
+	UID       int // real UID, -1 if unknown
+	NSPID     int // PID in the innermost PID namespace, 0 if unknown
+	Argv      []string
+	Exe       string // resolved executable path, "" if unreadable
+	Cwd       string // "" if unreadable
+	StartTime time.Time
+	TTY       string // controlling terminal, e.g. "pts/3"; "" if none
+}
+
+// Snapshot is the process table taken once per discovery run and shared by
+// all detectors, so they query memory instead of rescanning the system and
+// see a consistent view of it.
+type Snapshot struct {
+	Taken time.Time
+	procs map[int]*Process
+	pids  []int // ascending
+}
+
+// NewSnapshot indexes procs by PID. Platforms build snapshots from the
+// process table; tests build them from fake processes.
+func NewSnapshot(procs []*Process) *Snapshot {
+	s := &Snapshot{
+		Taken: time.Now(),
+		procs: make(map[int]*Process, len(procs)),
+		pids:  make([]int, 0, len(procs)),
+	}
+	for _, p := range procs {
+		s.procs[p.PID] = p
+		s.pids = append(s.pids, p.PID)
+	}
+	sort.Ints(s.pids)
+	return s
+}
+
+// Get returns the process with the given PID, or nil if it was not running
+// when the snapshot was taken.
+func (s *Snapshot) Get(pid int) *Process {
+	return s.procs[pid]
+}
+
+// PIDs returns the PIDs of all processes in the snapshot, ascending.
+func (s *Snapshot) PIDs() []int {
+	return s.pids
+}
+
+// FindByName returns PIDs whose binary path (argv[0]) matches re.
+func (s *Snapshot) FindByName(re *regexp.Regexp) []int {
+	var pids []int
+	for _, pid := range s.pids {
+		argv := s.procs[pid].Argv
+		if len(argv) > 0 && re.MatchString(argv[0]) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// FindByArgs returns PIDs where any command-line argument matches re.
+// Unlike FindByName which only checks argv[0], this checks all args.
+func (s *Snapshot) FindByArgs(re *regexp.Regexp) []int {
+	var pids []int
+	for _, pid := range s.pids {
+		for _, arg := range s.procs[pid].Argv {
+			if arg != "" && re.MatchString(arg) {
+				pids = append(pids, pid)
+				break
+			}
+		}
+	}
+	return pids
+}
+
+// Cwd returns the working directory of a process, or "-" if unknown.
+func (s *Snapshot) Cwd(pid int) string {
+	if p := s.procs[pid]; p != nil && p.Cwd != "" {
+		return p.Cwd
+	}
+	return "-"
+}
+
+// PPID returns the parent PID of a process, or 0 if unknown.
+func (s *Snapshot) PPID(pid int) int {
+	if p := s.procs[pid]; p != nil {
+		return p.PPID
+	}
+	return 0
+}
+
+// UID returns the real UID owning a process, or -1 if unknown.
+func (s *Snapshot) UID(pid int) int {
+	if p := s.procs[pid]; p != nil {
+		return p.UID
+	}
+	return -1
+}
+
+// NSPID returns the PID of a process as seen inside its own (innermost) PID
+// namespace, which differs from pid for containerized processes. Falls back
+// to pid if unknown.
+func (s *Snapshot) NSPID(pid int) int {
+	if p := s.procs[pid]; p != nil && p.NSPID > 0 {
+		return p.NSPID
+	}
+	return pid
+}
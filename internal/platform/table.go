@@ -0,0 +1,74 @@
+package platform
+
+import (
+	"maps"
+	"slices"
+)
+
+// ProcessTable is a process table that is kept up to date by re-reading only
+// the processes that may have changed, for callers that need a Snapshot over
+// and over (watch mode) and cannot afford to read every process each time.
+type ProcessTable struct {
+	procs map[int]*Process
+	young map[int]bool // first read by the latest Rescan
+}
+
+// NewProcessTable reads the whole process table once.
+func NewProcessTable() *ProcessTable {
+	snap := P.Snapshot()
+	return &ProcessTable{procs: maps.Clone(snap.procs), young: make(map[int]bool)}
+}
+
+// Rescan lists the running processes, forgets those that exited and reads
+// those that started since the previous call. A process that had just started
+// is read once more, as it may not have exec'd its program yet. It reports
+// whether any process started or exited, or changed its command line.
+func (t *ProcessTable) Rescan() bool {
+	running := P.ListPIDs()
+	live := make(map[int]bool, len(running))
+	var read []int
+	for _, pid := range running {
+		live[pid] = true
+		if t.procs[pid] == nil || t.young[pid] {
+			read = append(read, pid)
+		}
+	}
+
+	changed := false
+	for pid := range t.procs {
+		if !live[pid] {
+			delete(t.procs, pid)
+			changed = true
+		}
+	}
+	young := make(map[int]bool)
+	for _, p := range P.ReadProcesses(read) {
+		old := t.procs[p.PID]
+		if old == nil {
+			young[p.PID] = true
+		}
+		if old == nil || !slices.Equal(old.Argv, p.Argv) {
+			changed = true
+		}
+		t.procs[p.PID] = p
+	}
+	t.young = young
+	return changed
+}
+
+// Refresh re-reads the given processes, e.g. for their working directory,
+// and forgets those that exited.
+func (t *ProcessTable) Refresh(pids []int) {
+	for _, pid := range pids {
+		delete(t.procs, pid)
+	}
+	for _, p := range P.ReadProcesses(pids) {
+		t.procs[p.PID] = p
+	}
+}
+
+// Snapshot returns the table as it is now. Later updates of the table do not
+// change it.
+func (t *ProcessTable) Snapshot() *Snapshot {
+	return NewSnapshot(slices.Collect(maps.Values(t.procs)))
+}
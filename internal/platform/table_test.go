@@ -0,0 +1,82 @@
+package platform
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+// fakeTable stands in for P with a process table that tests change between
+// rescans. It records which processes were read.
+type fakeTable struct {
+	Platform
+	procs map[int][]string // PID -> argv
+	read  []int
+}
+
+func (f *fakeTable) Snapshot() *Snapshot {
+	return NewSnapshot(f.ReadProcesses(slices.Collect(maps.Keys(f.procs))))
+}
+
+func (f *fakeTable) ListPIDs() []int { return slices.Sorted(maps.Keys(f.procs)) }
+
+func (f *fakeTable) ReadProcesses(pids []int) []*Process {
+	var procs []*Process
+	for _, pid := range pids {
+		f.read = append(f.read, pid)
+		if argv, ok := f.procs[pid]; ok {
+			procs = append(procs, &Process{PID: pid, Argv: argv})
+		}
+	}
+	return procs
+}
+
+func TestProcessTableRescan(t *testing.T) {
+	f := &fakeTable{procs: map[int][]string{1: {"init"}, 10: {"claude"}}}
+	old := P
+	P = f
+	t.Cleanup(func() { P = old })
+
+	table := NewProcessTable()
+	pids := func() []int { return slices.Sorted(maps.Keys(table.procs)) }
+	rescan := func(wantChanged bool, wantRead ...int) {
+		t.Helper()
+		f.read = nil
+		if changed := table.Rescan(); changed != wantChanged {
+			t.Errorf("Rescan() = %v, want %v", changed, wantChanged)
+		}
+		slices.Sort(f.read)
+		if !slices.Equal(f.read, wantRead) {
+			t.Errorf("read %v, want %v", f.read, wantRead)
+		}
+	}
+
+	// Nothing started or exited: nothing is read.
+	rescan(false)
+
+	// A new process is read, and once more on the next rescan in case it
+	// had not exec'd its program yet.
+	f.procs[20] = []string{"bash"}
+	rescan(true, 20)
+	f.procs[20] = []string{"codex"}
+	rescan(true, 20)
+	if p := table.Snapshot().Get(20); p == nil || p.Argv[0] != "codex" {
+		t.Errorf("process 20 is %+v, want codex", p)
+	}
+	rescan(false)
+
+	// Exited processes are forgotten.
+	delete(f.procs, 10)
+	rescan(true)
+	if want := []int{1, 20}; !slices.Equal(pids(), want) {
+		t.Errorf("table holds %v, want %v", pids(), want)
+	}
+
+	// Refresh re-reads the given processes and drops those that exited.
+	delete(f.procs, 20)
+	f.read = nil
+	table.Refresh([]int{1, 20})
+	if want := []int{1}; !slices.Equal(pids(), want) || len(f.read) != 2 {
+		t.Errorf("after Refresh the table holds %v and %v were read, want %v", pids(), f.read, want)
+	}
+}
@@ -0,0 +1,235 @@
+// Package watch reports when the state of agent sessions may have changed,
+// so that a long-running agentstat only recomputes the affected agents.
+//
+// On Linux, agent data directories are watched with inotify and agent
+// processes with pidfds, so changes are noticed as they happen. Elsewhere the
+// watcher falls back to polling every agent on each rescan tick.
+package watch
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned by Next once the watcher has been closed.
+var ErrClosed = errors.New("watcher closed")
+
+// debounce is how long Next waits after the first change for more to arrive,
+// so that a burst of writes to one transcript is handled once.
+const debounce = 50 * time.Millisecond
+
+// Change is the set of changes accumulated since the previous call to Next.
+type Change struct {
+	// Agents are the agents whose data directories or processes changed in
+	// ways that may concern any of their sessions.
+	Agents map[string]bool
+	// Files are the files written, created or deleted in the data
+	// directories of agents not in Agents, by agent, so that only the
+	// sessions they belong to need to be recomputed.
+	Files map[string][]string
+	// Rescan is set when the rescan interval elapsed: the process table
+	// should be checked for agents that started since.
+	Rescan bool
+}
+
+// backend is the platform-specific source of change notifications. It
+// reports through Watcher.notify.
+type backend interface {
+	setDirs(agent string, dirs []string)
+	setPIDs(agent string, pids []int)
+	close() error
+}
+
+// Watcher collects change notifications for agent data directories and
+// processes.
+type Watcher struct {
+	be     backend // nil when polling
+	ticker *time.Ticker
+
+	mu      sync.Mutex
+	poll    bool // every tick reports all agents as changed
+	pending Change
+	agents  map[string]bool // every agent given to SetDirs or SetPIDs
+	signal  chan struct{}   // has a value when pending is non-empty
+	done    chan struct{}
+	closed  bool
+}
+
+// New returns a watcher that uses the platform's notification mechanism and
+// requests a rescan every interval. On platforms without one it returns a
+// polling watcher. It fails if the mechanism exists but cannot be set up
+// (e.g. the inotify instance limit is reached); NewPolling is the fallback.
+func New(interval time.Duration) (*Watcher, error) {
+	w := newWatcher(interval)
+	be, err := newBackend(w)
+	if err != nil {
+		w.ticker.Stop()
+		return nil, err
+	}
+	w.be = be
+	w.poll = be == nil
+	go w.tick()
+	return w, nil
+}
+
+// NewPolling returns a watcher without change notifications: every interval
+// it requests a rescan and reports all known agents as changed.
+func NewPolling(interval time.Duration) *Watcher {
+	w := newWatcher(interval)
+	w.poll = true
+	go w.tick()
+	return w
+}
+
+func newWatcher(interval time.Duration) *Watcher {
+	return &Watcher{
+		ticker: time.NewTicker(interval),
+		agents: make(map[string]bool),
+		signal: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// tick requests a rescan on every ticker tick until the watcher is closed.
+func (w *Watcher) tick() {
+	for {
+		select {
+		case <-w.ticker.C:
+			w.mu.Lock()
+			w.pending.Rescan = true
+			if w.poll {
+				for a := range w.agents {
+					w.markLocked(a)
+				}
+			}
+			w.signalLocked()
+			w.mu.Unlock()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// SetDirs replaces the directories watched for agent. Directories are
+// watched recursively; ones that do not exist yet are picked up by a later
+// call once they do.
+func (w *Watcher) SetDirs(agent string, dirs []string) {
+	w.mu.Lock()
+	w.agents[agent] = true
+	w.mu.Unlock()
+	if w.be != nil {
+		w.be.setDirs(agent, dirs)
+	}
+}
+
+// SetPIDs replaces the processes watched for agent. Their exit is reported
+// as a change of agent.
+func (w *Watcher) SetPIDs(agent string, pids []int) {
+	w.mu.Lock()
+	w.agents[agent] = true
+	w.mu.Unlock()
+	if w.be != nil {
+		w.be.setPIDs(agent, pids)
+	}
+}
+
+// Notify reports a change of agent noticed by other means, such as an event
+// stream of the agent itself. It is safe to call from any goroutine.
+func (w *Watcher) Notify(agent string) {
+	w.notify(agent)
+}
+
+// notify records a change of agent; backends call it from their goroutines.
+func (w *Watcher) notify(agent string) {
+	w.mu.Lock()
+	w.markLocked(agent)
+	w.signalLocked()
+	w.mu.Unlock()
+}
+
+// notifyFile records a change of a file in a data directory of agent;
+// backends call it from their goroutines.
+func (w *Watcher) notifyFile(agent, path string) {
+	w.mu.Lock()
+	if !w.pending.Agents[agent] {
+		if w.pending.Files == nil {
+			w.pending.Files = make(map[string][]string)
+		}
+		if !slices.Contains(w.pending.Files[agent], path) {
+			w.pending.Files[agent] = append(w.pending.Files[agent], path)
+		}
+	}
+	w.signalLocked()
+	w.mu.Unlock()
+}
+
+// degrade switches to polling all agents on each tick; backends call it when
+// they can no longer notice every change.
+func (w *Watcher) degrade() {
+	w.mu.Lock()
+	w.poll = true
+	w.mu.Unlock()
+}
+
+func (w *Watcher) markLocked(agent string) {
+	if w.pending.Agents == nil {
+		w.pending.Agents = make(map[string]bool)
+	}
+	w.pending.Agents[agent] = true
+	delete(w.pending.Files, agent)
+}
+
+func (w *Watcher) signalLocked() {
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Next blocks until something changes, then returns everything that changed
+// since the previous call. It returns ErrClosed once the watcher is closed.
+func (w *Watcher) Next() (Change, error) {
+	select {
+	case <-w.signal:
+	case <-w.done:
+		return Change{}, ErrClosed
+	}
+
+	// Let a burst of changes settle.
+	select {
+	case <-time.After(debounce):
+	case <-w.done:
+		return Change{}, ErrClosed
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	c := w.pending
+	w.pending = Change{}
+	// Drain a signal for changes that are being returned now.
+	select {
+	case <-w.signal:
+	default:
+	}
+	return c, nil
+}
+
+// Close stops the watcher and releases its resources.
+func (w *Watcher) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.done)
+	w.mu.Unlock()
+
+	w.ticker.Stop()
+	if w.be != nil {
+		return w.be.close()
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+package watch
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// inotifyMask selects the events that can signal a session state change:
+// transcript appends, new or replaced files and removed files.
+const inotifyMask = unix.IN_MODIFY | unix.IN_CREATE | unix.IN_DELETE |
+	unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_ONLYDIR | unix.IN_EXCL_UNLINK
+
+// linuxBackend watches directories with one inotify instance and processes
+// with pidfds, which become readable when the process exits.
+type linuxBackend struct {
+	w   *Watcher
+	fd  int      // inotify instance
+	ino *os.File // fd, read through the runtime poller so close unblocks it
+
+	mu     sync.Mutex
+	roots  map[string][]string // agent -> directories given to setDirs
+	wds    map[int]dirWatch    // inotify watch descriptor -> directory
+	paths  map[string]int      // directory -> watch descriptor
+	pids   map[int]pidWatch    // watched process -> its pidfd
+	stale  []int               // pidfds to close once pollPIDs is out of poll
+	wake   int                 // eventfd interrupting pollPIDs; -1 once closed
+	closed bool
+	full   bool // the inotify watch limit was reached
+}
+
+// dirWatch is one directory watched with inotify.
+type dirWatch struct {
+	agent string
+	path  string
+}
+
+// pidWatch is one process watched with a pidfd.
+type pidWatch struct {
+	agent string
+	fd    int
+}
+
+func newBackend(w *Watcher) (backend, error) {
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("inotify: %w", err)
+	}
+	wake, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("eventfd: %w", err)
+	}
+	b := &linuxBackend{
+		w:     w,
+		fd:    fd,
+		ino:   os.NewFile(uintptr(fd), "inotify"),
+		roots: make(map[string][]string),
+		wds:   make(map[int]dirWatch),
+		paths: make(map[string]int),
+		pids:  make(map[int]pidWatch),
+		wake:  wake,
+	}
+	go b.readEvents()
+	go b.pollPIDs()
+	return b, nil
+}
+
+// setDirs watches dirs recursively for agent and stops watching the
+// directories it had before that are no longer listed.
+func (b *linuxBackend) setDirs(agent string, dirs []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+
+	want := make(map[string]bool, len(dirs))
+	for _, d := range dirs {
+		want[d] = true
+	}
+	for _, old := range b.roots[agent] {
+		if !want[old] {
+			b.removeTreeLocked(old)
+		}
+	}
+	for _, d := range dirs {
+		if root, err := filepath.EvalSymlinks(d); err == nil {
+			if _, ok := b.paths[root]; !ok {
+				b.addTreeLocked(agent, root)
+			}
+		}
+	}
+	b.roots[agent] = dirs
+}
+
+// addTreeLocked watches root and every directory below it.
+func (b *linuxBackend) addTreeLocked(agent, root string) {
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		wd, err := unix.InotifyAddWatch(b.fd, path, inotifyMask)
+		if errors.Is(err, unix.ENOSPC) {
+			b.limitReachedLocked()
+			return filepath.SkipAll
+		}
+		if err == nil {
+			b.wds[wd] = dirWatch{agent: agent, path: path}
+			b.paths[path] = wd
+		}
+		return nil
+	})
+}
+
+// removeTreeLocked stops watching root and every directory below it.
+func (b *linuxBackend) removeTreeLocked(root string) {
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	for path, wd := range b.paths {
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			unix.InotifyRmWatch(b.fd, uint32(wd))
+			delete(b.paths, path)
+			delete(b.wds, wd)
+		}
+	}
+}
+
+// limitReachedLocked falls back to polling once the per-user inotify watch
+// limit is reached, since changes below unwatched directories go unnoticed.
+func (b *linuxBackend) limitReachedLocked() {
+	if b.full {
+		return
+	}
+	b.full = true
+	b.w.degrade()
+	fmt.Fprintln(os.Stderr, "warning: inotify watch limit reached (fs.inotify.max_user_watches); falling back to polling")
+}
+
+// readEvents reads inotify events until the instance is closed, reporting
+// each as a change of the file it names, or else of the agent owning the
+// directory.
+func (b *linuxBackend) readEvents() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := b.ino.Read(buf)
+		if err != nil {
+			return
+		}
+		b.handleEvents(buf[:n])
+	}
+}
+
+// handleEvents decodes a buffer of struct inotify_event records.
+func (b *linuxBackend) handleEvents(buf []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+
+	for len(buf) >= unix.SizeofInotifyEvent {
+		wd := int(int32(binary.NativeEndian.Uint32(buf[0:])))
+		mask := binary.NativeEndian.Uint32(buf[4:])
+		nameLen := int(binary.NativeEndian.Uint32(buf[12:]))
+		end := min(unix.SizeofInotifyEvent+nameLen, len(buf))
+		name := strings.TrimRight(string(buf[unix.SizeofInotifyEvent:end]), "\x00")
+		buf = buf[end:]
+
+		if mask&unix.IN_Q_OVERFLOW != 0 {
+			// Events were dropped: anything may have changed.
+			for agent := range b.roots {
+				b.w.notify(agent)
+			}
+			continue
+		}
+		d, ok := b.wds[wd]
+		if !ok {
+			continue
+		}
+		switch {
+		case mask&unix.IN_IGNORED != 0:
+			// The directory was deleted or unmounted.
+			delete(b.wds, wd)
+			if b.paths[d.path] == wd {
+				delete(b.paths, d.path)
+			}
+			continue
+		case mask&unix.IN_ISDIR != 0 && mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+			// Files may have been written before the watch was added; the
+			// change reported below covers them.
+			b.addTreeLocked(d.agent, filepath.Join(d.path, name))
+		case mask&unix.IN_ISDIR == 0 && name != "":
+			b.w.notifyFile(d.agent, filepath.Join(d.path, name))
+			continue
+		}
+		b.w.notify(d.agent)
+	}
+}
+
+// setPIDs watches pids for agent and stops watching the processes it had
+// before that are no longer listed. A process that is already gone is
+// reported right away.
+func (b *linuxBackend) setPIDs(agent string, pids []int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+
+	want := make(map[int]bool, len(pids))
+	for _, pid := range pids {
+		want[pid] = true
+	}
+	changed := false
+	for pid, pw := range b.pids {
+		if pw.agent == agent && !want[pid] {
+			b.stale = append(b.stale, pw.fd)
+			delete(b.pids, pid)
+			changed = true
+		}
+	}
+	for _, pid := range pids {
+		if _, ok := b.pids[pid]; ok {
+			continue
+		}
+		fd, err := unix.PidfdOpen(pid, 0)
+		switch {
+		case err == nil:
+			b.pids[pid] = pidWatch{agent: agent, fd: fd}
+			changed = true
+		case errors.Is(err, unix.ESRCH):
+			b.w.notify(agent)
+		}
+		// Other errors (kernels before 5.3) leave exits to the rescan.
+	}
+	if changed {
+		b.wakeLocked()
+	}
+}
+
+// pollPIDs waits for watched processes to exit until the backend is closed.
+// It owns the pidfds while they are being polled: others only queue them in
+// stale, and it closes them between polls.
+func (b *linuxBackend) pollPIDs() {
+	for {
+		b.mu.Lock()
+		for _, fd := range b.stale {
+			unix.Close(fd)
+		}
+		b.stale = nil
+		if b.closed {
+			for _, pw := range b.pids {
+				unix.Close(pw.fd)
+			}
+			clear(b.pids)
+			unix.Close(b.wake)
+			b.wake = -1
+			b.mu.Unlock()
+			return
+		}
+		fds := []unix.PollFd{{Fd: int32(b.wake), Events: unix.POLLIN}}
+		owners := []int{0}
+		for pid, pw := range b.pids {
+			fds = append(fds, unix.PollFd{Fd: int32(pw.fd), Events: unix.POLLIN})
+			owners = append(owners, pid)
+		}
+		b.mu.Unlock()
+
+		if _, err := unix.Poll(fds, -1); err != nil && !errors.Is(err, unix.EINTR) {
+			return
+		}
+		if fds[0].Revents != 0 {
+			var buf [8]byte
+			unix.Read(int(fds[0].Fd), buf[:])
+		}
+
+		b.mu.Lock()
+		for i := 1; i < len(fds); i++ {
+			if fds[i].Revents == 0 {
+				continue
+			}
+			if pw, ok := b.pids[owners[i]]; ok && pw.fd == int(fds[i].Fd) {
+				unix.Close(pw.fd)
+				delete(b.pids, owners[i])
+				b.w.notify(pw.agent)
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+// wakeLocked interrupts pollPIDs so it picks up new and stale pidfds.
+func (b *linuxBackend) wakeLocked() {
+	if b.wake < 0 {
+		return
+	}
+	var one [8]byte
+	binary.NativeEndian.PutUint64(one[:], 1)
+	unix.Write(b.wake, one[:])
+}
+
+func (b *linuxBackend) close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.wakeLocked()
+	b.mu.Unlock()
+	return b.ino.Close()
+}
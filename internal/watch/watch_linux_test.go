@@ -0,0 +1,77 @@
+package watch
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newLinuxWatcher returns a watcher using inotify and pidfds, with rescans
+// too rare to interfere.
+func newLinuxWatcher(t *testing.T) *Watcher {
+	t.Helper()
+	w, err := New(time.Hour)
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+func TestInotify(t *testing.T) {
+	w := newLinuxWatcher(t)
+	dir := t.TempDir()
+	w.SetDirs("claude", []string{dir, filepath.Join(dir, "missing")})
+
+	// A written file is reported as such.
+	path := filepath.Join(dir, "a.jsonl")
+	os.WriteFile(path, []byte("{}\n"), 0o644)
+	if c := next(t, w); !slices.Equal(c.Files["claude"], []string{path}) || c.Agents != nil {
+		t.Errorf("got %+v, want only %s", c, path)
+	}
+
+	// A new directory changes the agent, and is watched from then on.
+	sub := filepath.Join(dir, "session", "subagents")
+	os.MkdirAll(sub, 0o755)
+	if c := next(t, w); !c.Agents["claude"] {
+		t.Errorf("got %+v, want claude changed", c)
+	}
+	path = filepath.Join(sub, "agent-a.jsonl")
+	os.WriteFile(path, []byte("{}\n"), 0o644)
+	if c := next(t, w); !slices.Contains(c.Files["claude"], path) {
+		t.Errorf("got %+v, want %s", c, path)
+	}
+
+	// Directories no longer listed are not watched.
+	w.SetDirs("claude", nil)
+	os.WriteFile(filepath.Join(dir, "b.jsonl"), []byte("{}\n"), 0o644)
+	w.Notify("opencode")
+	if c := next(t, w); c.Files != nil || c.Agents["claude"] {
+		t.Errorf("got %+v, want nothing from an unwatched directory", c)
+	}
+}
+
+func TestPidfd(t *testing.T) {
+	w := newLinuxWatcher(t)
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	w.SetPIDs("codex", []int{cmd.Process.Pid})
+
+	// An exit is reported as a change of the agent.
+	cmd.Process.Kill()
+	cmd.Wait()
+	if c := next(t, w); !c.Agents["codex"] {
+		t.Errorf("got %+v, want codex changed", c)
+	}
+
+	// A process already gone is reported right away.
+	w.SetPIDs("gemini", []int{cmd.Process.Pid})
+	if c := next(t, w); !c.Agents["gemini"] {
+		t.Errorf("got %+v, want gemini changed", c)
+	}
+}
@@ -0,0 +1,97 @@
+package watch
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// next calls w.Next, failing the test if nothing arrives in time.
+func next(t *testing.T, w *Watcher) Change {
+	t.Helper()
+	type result struct {
+		c   Change
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		c, err := w.Next()
+		ch <- result{c, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.c
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change reported")
+	}
+	return Change{}
+}
+
+func TestChangeRouting(t *testing.T) {
+	// No ticker goroutine runs: only the changes below are reported.
+	w := newWatcher(time.Hour)
+	defer w.Close()
+
+	w.notifyFile("claude", "/c/a.jsonl")
+	w.notifyFile("claude", "/c/a.jsonl")
+	w.notifyFile("claude", "/c/b.jsonl")
+	w.notifyFile("codex", "/x/r.jsonl")
+	w.notify("codex")
+	w.notifyFile("codex", "/x/s.jsonl")
+	c := next(t, w)
+	if want := []string{"/c/a.jsonl", "/c/b.jsonl"}; !slices.Equal(c.Files["claude"], want) {
+		t.Errorf("claude files %v, want %v", c.Files["claude"], want)
+	}
+	// Files of an agent that changed as a whole are not listed.
+	if !c.Agents["codex"] || c.Files["codex"] != nil {
+		t.Errorf("codex: changed %v, files %v; want changed without files", c.Agents["codex"], c.Files["codex"])
+	}
+	if c.Agents["claude"] || c.Rescan {
+		t.Errorf("got %+v, want only codex changed", c)
+	}
+
+	// Changes are reported once.
+	w.Notify("opencode")
+	if c := next(t, w); len(c.Agents) != 1 || !c.Agents["opencode"] || c.Files != nil {
+		t.Errorf("got %+v, want only opencode changed", c)
+	}
+
+	w.Close()
+	if _, err := w.Next(); err != ErrClosed {
+		t.Errorf("Next after Close: %v, want ErrClosed", err)
+	}
+}
+
+func TestPolling(t *testing.T) {
+	w := NewPolling(10 * time.Millisecond)
+	defer w.Close()
+	w.SetDirs("claude", []string{"/c"})
+	w.SetPIDs("codex", []int{1})
+
+	// Every tick requests a rescan and reports every known agent.
+	for range 2 {
+		c := next(t, w)
+		if !c.Rescan || !c.Agents["claude"] || !c.Agents["codex"] || len(c.Agents) != 2 {
+			t.Errorf("got %+v, want a rescan with claude and codex changed", c)
+		}
+	}
+}
+
+func TestDegrade(t *testing.T) {
+	w := newWatcher(10 * time.Millisecond)
+	defer w.Close()
+	go w.tick()
+	w.SetDirs("claude", nil)
+
+	// Until degraded, a tick only requests a rescan.
+	if c := next(t, w); !c.Rescan || c.Agents != nil {
+		t.Errorf("got %+v, want only a rescan", c)
+	}
+	w.degrade()
+	if c := next(t, w); !c.Rescan || !c.Agents["claude"] {
+		t.Errorf("got %+v after degrading, want a rescan with claude changed", c)
+	}
+}
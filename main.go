@@ -5,11 +5,15 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"slices"
 	"strings"
-	"text/tabwriter"
+	"time"
+	"unicode/utf8"
 
 	"github.com/Eric-Song-Nop/agentstat/internal/agent"
+	"github.com/Eric-Song-Nop/agentstat/internal/config"
 	"github.com/Eric-Song-Nop/agentstat/internal/model"
+	"github.com/Eric-Song-Nop/agentstat/internal/platform"
 )
 
 // parseAgents parses a comma-separated agent list and validates names.
@@ -26,11 +30,7 @@ func parseAgents(raw string) map[string]bool {
 	}
 
 	selected := make(map[string]bool)
-	for _, name := range strings.Split(raw, ",") {
-		name = strings.TrimSpace(strings.ToLower(name))
-		if name == "" {
-			continue
-		}
+	for _, name := range config.SplitList(raw) {
 		if !known[name] {
 			fmt.Fprintf(os.Stderr, "warning: unknown agent %q (known: %s)\n", name, strings.Join(model.AllAgents, ", "))
 			continue
@@ -41,41 +41,100 @@ func parseAgents(raw string) map[string]bool {
 }
 
 // agentEnabled reports whether the named agent should be discovered.
-// A nil selected map means all agents are enabled.
-func agentEnabled(selected map[string]bool, name string) bool {
+// A nil selected map defers to the per-agent "enabled" setting in the config.
+func agentEnabled(selected map[string]bool, cfg *config.Config, name string) bool {
 	if selected == nil {
-		return true
+		return cfg.Agent(name).IsEnabled()
 	}
 	return selected[name]
 }
 
+// fatalf prints an error to stderr and exits with status 2.
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "error: "+format+"\n", args...)
+	os.Exit(2)
+}
+
 func main() {
-	jsonFlag := flag.Bool("json", false, "output in JSON format")
+	configFlag := flag.String("config", "", "path to config file (default: $AGENTSTAT_CONFIG or $XDG_CONFIG_HOME/agentstat/config.json)")
+	jsonFlag := flag.Bool("json", false, "output in JSON format (shorthand for --format json)")
+	formatFlag := flag.String("format", "", "output format: table or json")
+	columnsFlag := flag.String("columns", "", "comma-separated table columns ("+strings.Join(columnKeys(), ",")+")")
+	sortFlag := flag.String("sort", "", "sort by column key; prefix with - for descending")
+	allUsersFlag := flag.Bool("all-users", false, "report agents of all users (requires root to read other users' data)")
 	agentsFlag := flag.String("agents", "", "comma-separated list of agents to discover (opencode,codex,claude,amp,gemini); default: all")
+	watchFlag := flag.Bool("watch", false, "keep running and report sessions whenever their state changes")
+	intervalFlag := flag.Duration("interval", 2*time.Second, "with --watch, how often to look for new agent processes")
 	flag.Parse()
 
-	agents := parseAgents(*agentsFlag)
-
-	var sessions []model.AgentSession
+	cfg, err := config.Load(*configFlag)
+	if err != nil {
+		fatalf("%v", err)
+	}
 
-	if agentEnabled(agents, "opencode") {
-		sessions = append(sessions, agent.DiscoverOpenCode()...)
+	// Flags take precedence over the config file and environment.
+	if *formatFlag != "" {
+		cfg.Output.Format = *formatFlag
 	}
-	if agentEnabled(agents, "codex") {
-		sessions = append(sessions, agent.DiscoverCodex()...)
+	if *jsonFlag {
+		cfg.Output.Format = "json"
+	}
+	if *columnsFlag != "" {
+		cfg.Output.Columns = config.SplitList(*columnsFlag)
+	}
+	if *sortFlag != "" {
+		cfg.Output.Sort = *sortFlag
 	}
-	if agentEnabled(agents, "claude") {
-		sessions = append(sessions, agent.DiscoverClaude()...)
+	if *allUsersFlag {
+		cfg.AllUsers = true
 	}
-	if agentEnabled(agents, "amp") {
-		sessions = append(sessions, agent.DiscoverAmp()...)
+	if cfg.AllUsers {
+		if os.Geteuid() != 0 {
+			fmt.Fprintln(os.Stderr, "warning: --all-users without root; other users' agent data may be unreadable")
+		}
+		// Show who owns each session unless the user already chose the column.
+		if !slices.Contains(cfg.Output.Columns, "user") {
+			cfg.Output.Columns = append([]string{"user"}, cfg.Output.Columns...)
+		}
 	}
-	if agentEnabled(agents, "gemini") {
-		sessions = append(sessions, agent.DiscoverGemini()...)
+	if err := cfg.Output.Validate(); err != nil {
+		fatalf("%v", err)
+	}
+	cols, err := lookupColumns(cfg.Output.Columns)
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	agent.Configure(cfg)
+	agents := parseAgents(*agentsFlag)
+	var enabled []string
+	for _, name := range model.AllAgents {
+		if agentEnabled(agents, cfg, name) {
+			enabled = append(enabled, name)
+		}
+	}
+	jsonOut := cfg.Output.Format == "json"
+
+	if *watchFlag {
+		if *intervalFlag <= 0 {
+			fatalf("--interval must be positive")
+		}
+		if err := sortSessions(nil, cfg.Output.Sort); err != nil {
+			fatalf("%v", err)
+		}
+		runWatch(enabled, cols, cfg.Output.Sort, jsonOut, *intervalFlag)
+		return
+	}
+
+	// One process table snapshot is shared by all detectors.
+	sessions := discover(platform.P.Snapshot(), enabled)
+
+	if err := sortSessions(sessions, cfg.Output.Sort); err != nil {
+		fatalf("%v", err)
 	}
 
 	if len(sessions) == 0 {
-		if *jsonFlag {
+		if jsonOut {
 			fmt.Println("[]")
 		} else {
 			fmt.Println("No agent sessions found.")
@@ -83,7 +142,7 @@ func main() {
 		os.Exit(0)
 	}
 
-	if *jsonFlag {
+	if jsonOut {
 		enc := json.NewEncoder(os.Stdout)
 		enc.SetIndent("", "  ")
 		_ = enc.Encode(sessions)
@@ -91,24 +150,35 @@ func main() {
 	}
 
 	// Aligned table output
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-	fmt.Fprintln(w, "AGENT\tSTATUS\tSESSION\tTITLE\tDIRECTORY\tPID")
-	for _, s := range sessions {
-		title := truncate(s.Title, 28)
-		sessionID := truncate(s.SessionID, 38)
-		dir := shortenHome(s.Directory)
-		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\n",
-			s.Agent, s.Status, sessionID, title, dir, s.PID)
-	}
-	w.Flush()
+	writeTable(os.Stdout, sessions, cols)
+}
+
+// detectors maps each agent name to its discovery function.
+var detectors = map[string]func(*platform.Snapshot) []model.AgentSession{
+	"opencode": agent.DiscoverOpenCode,
+	"codex":    agent.DiscoverCodex,
+	"claude":   agent.DiscoverClaude,
+	"amp":      agent.DiscoverAmp,
+	"gemini":   agent.DiscoverGemini,
+}
+
+// discover runs the detectors of the named agents, in order, on snap.
+func discover(snap *platform.Snapshot, names []string) []model.AgentSession {
+	var sessions []model.AgentSession
+	for _, name := range names {
+		sessions = append(sessions, detectors[name](snap)...)
+	}
+	return sessions
 }
 
-// truncate shortens a string to maxLen, appending "..." if truncated.
+// truncate shortens a string to maxLen runes, appending "..." if truncated.
+// It counts runes rather than bytes so that a multi-byte character is never
+// split.
 func truncate(s string, maxLen int) string {
-	if len(s) <= maxLen {
+	if utf8.RuneCountInString(s) <= maxLen {
 		return s
 	}
-	return s[:maxLen-3] + "..."
+	return string([]rune(s)[:maxLen-3]) + "..."
 }
 
 // shortenHome replaces the user's home directory prefix with "~".
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/model"
+)
+
+// column describes one table column selectable via --columns.
+type column struct {
+	Key    string // name used in --columns, --sort and the config file
+	Header string
+	Value  func(s model.AgentSession) string
+}
+
+// columns lists all available table columns in their default order.
+var columns = []column{
+	{"agent", "AGENT", func(s model.AgentSession) string { return s.Agent }},
+	{"status", "STATUS", func(s model.AgentSession) string { return s.Status }},
+	{"activity", "ACTIVITY", func(s model.AgentSession) string { return orDash(truncate(s.Activity, 40)) }},
+	{"session", "SESSION", func(s model.AgentSession) string { return truncate(s.SessionID, 38) }},
+	{"title", "TITLE", func(s model.AgentSession) string { return truncate(s.Title, 28) }},
+	{"directory", "DIRECTORY", func(s model.AgentSession) string { return shortenHome(s.Directory) }},
+	{"pid", "PID", func(s model.AgentSession) string { return strconv.Itoa(s.PID) }},
+	{"user", "USER", func(s model.AgentSession) string { return s.User }},
+	{"container", "CONTAINER", func(s model.AgentSession) string { return shortID(s.Container) }},
+	{"address", "ADDRESS", func(s model.AgentSession) string { return s.Address }},
+	{"mode", "MODE", func(s model.AgentSession) string { return orDash(s.Mode) }},
+	{"branch", "BRANCH", func(s model.AgentSession) string { return orDash(s.Branch) }},
+	{"age", "AGE", func(s model.AgentSession) string { return since(s.StartedAt) }},
+	{"last", "LAST", func(s model.AgentSession) string { return since(s.LastActivityAt) }},
+	{"since", "SINCE", func(s model.AgentSession) string { return since(s.StatusSince) }},
+	{"model", "MODEL", func(s model.AgentSession) string { return orDash(s.Model) }},
+	{"tokens", "TOKENS", func(s model.AgentSession) string { return tokenCount(s.Usage.Total()) }},
+	{"cost", "COST", func(s model.AgentSession) string { return dollars(s.Cost) }},
+	{"context", "CONTEXT", contextUsage},
+	{"match", "MATCH", matchInfo},
+}
+
+// lookupColumns resolves column keys, returning an error for unknown names.
+func lookupColumns(keys []string) ([]column, error) {
+	byKey := make(map[string]column, len(columns))
+	for _, c := range columns {
+		byKey[c.Key] = c
+	}
+
+	var selected []column
+	for _, k := range keys {
+		c, ok := byKey[k]
+		if !ok {
+			return nil, fmt.Errorf("unknown column %q (known: %s)", k, strings.Join(columnKeys(), ", "))
+		}
+		selected = append(selected, c)
+	}
+	return selected, nil
+}
+
+// columnKeys returns the keys of all available columns.
+func columnKeys() []string {
+	keys := make([]string, len(columns))
+	for i, c := range columns {
+		keys[i] = c.Key
+	}
+	return keys
+}
+
+// sortSessions orders sessions by a column key; a "-" prefix sorts descending.
+// An empty key keeps discovery order.
+func sortSessions(sessions []model.AgentSession, key string) error {
+	if key == "" {
+		return nil
+	}
+	desc := strings.HasPrefix(key, "-")
+	key = strings.TrimPrefix(key, "-")
+
+	less, ok := sortKeys[key]
+	if !ok {
+		return fmt.Errorf("unknown sort key %q (known: %s)", key, strings.Join(columnKeys(), ", "))
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		if desc {
+			return less(sessions[j], sessions[i])
+		}
+		return less(sessions[i], sessions[j])
+	})
+	return nil
+}
+
+// sortKeys maps each sortable column key to its ordering.
+var sortKeys = map[string]func(a, b model.AgentSession) bool{
+	"agent":     func(a, b model.AgentSession) bool { return a.Agent < b.Agent },
+	"status":    func(a, b model.AgentSession) bool { return a.Status < b.Status },
+	"activity":  func(a, b model.AgentSession) bool { return a.Activity < b.Activity },
+	"session":   func(a, b model.AgentSession) bool { return a.SessionID < b.SessionID },
+	"title":     func(a, b model.AgentSession) bool { return a.Title < b.Title },
+	"directory": func(a, b model.AgentSession) bool { return a.Directory < b.Directory },
+	"pid":       func(a, b model.AgentSession) bool { return a.PID < b.PID },
+	"user":      func(a, b model.AgentSession) bool { return a.User < b.User },
+	"container": func(a, b model.AgentSession) bool { return a.Container < b.Container },
+	"address":   func(a, b model.AgentSession) bool { return a.Address < b.Address },
+	"mode":      func(a, b model.AgentSession) bool { return a.Mode < b.Mode },
+	"branch":    func(a, b model.AgentSession) bool { return a.Branch < b.Branch },
+	// Durations sort youngest first, i.e. by descending timestamp.
+	"age":   func(a, b model.AgentSession) bool { return a.StartedAt.After(b.StartedAt) },
+	"last":  func(a, b model.AgentSession) bool { return a.LastActivityAt.After(b.LastActivityAt) },
+	"since": func(a, b model.AgentSession) bool { return a.StatusSince.After(b.StatusSince) },
+	"model": func(a, b model.AgentSession) bool { return a.Model < b.Model },
+	// Consumption sorts largest first.
+	"tokens": func(a, b model.AgentSession) bool { return a.Usage.Total() > b.Usage.Total() },
+	"cost":   func(a, b model.AgentSession) bool { return a.Cost > b.Cost },
+	"match": func(a, b model.AgentSession) bool {
+		return confidenceRank[a.MatchConfidence] > confidenceRank[b.MatchConfidence]
+	},
+	"context": func(a, b model.AgentSession) bool {
+		return a.ContextUsed() > b.ContextUsed()
+	},
+}
+
+// since formats the time elapsed since t compactly ("42s", "7m", "3h", "2d"),
+// or "-" if t is zero.
+func since(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", max(int(d.Seconds()), 0))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+}
+
+// tokenCount formats a token count compactly ("850", "12.3k", "1.2M"), or "-"
+// if it is zero.
+func tokenCount(n int64) string {
+	switch {
+	case n <= 0:
+		return "-"
+	case n < 1000:
+		return strconv.FormatInt(n, 10)
+	case n < 1000000:
+		return fmt.Sprintf("%.1fk", float64(n)/1e3)
+	default:
+		return fmt.Sprintf("%.1fM", float64(n)/1e6)
+	}
+}
+
+// contextUsage formats the context in use as a share of the window ("46%"),
+// or as a token count when the window is unknown, flagging compaction.
+func contextUsage(s model.AgentSession) string {
+	v := "-"
+	switch {
+	case s.ContextUsed() > 0:
+		v = fmt.Sprintf("%.0f%%", s.ContextUsed()*100)
+	case s.ContextTokens > 0:
+		v = tokenCount(s.ContextTokens)
+	}
+	if s.Compacting {
+		v += " compacting"
+	}
+	return v
+}
+
+// matchInfo formats how a session was mapped to its process ("cwd/low"),
+// or "-" if the agent reports the mapping directly.
+func matchInfo(s model.AgentSession) string {
+	if s.MatchMethod == "" {
+		return "-"
+	}
+	return s.MatchMethod + "/" + s.MatchConfidence
+}
+
+// confidenceRank orders match confidences for sorting.
+var confidenceRank = map[string]int{
+	model.ConfidenceLow:    1,
+	model.ConfidenceMedium: 2,
+	model.ConfidenceHigh:   3,
+}
+
+// dollars formats a USD amount, or "-" if it is zero.
+func dollars(v float64) string {
+	if v <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("$%.2f", v)
+}
+
+// orDash returns s, or "-" if it is empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// shortID abbreviates a container ID to the 12 characters Docker displays.
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// writeTable renders sessions as an aligned table with the given columns.
+// Child sessions (subagents) follow their parent, indented in the first column.
+func writeTable(out io.Writer, sessions []model.AgentSession, cols []column) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	headers := make([]string, len(cols))
+	for i, c := range cols {
+		headers[i] = c.Header
+	}
+	fmt.Fprintln(w, strings.Join(headers, "\t"))
+
+	for _, s := range sessions {
+		writeRow(w, s, cols, "")
+		for _, child := range s.Children {
+			writeRow(w, child, cols, "└ ")
+		}
+	}
+	w.Flush()
+}
+
+// writeRow writes one table row, prefixing the first column with indent.
+func writeRow(w io.Writer, s model.AgentSession, cols []column, indent string) {
+	values := make([]string, len(cols))
+	for i, c := range cols {
+		values[i] = c.Value(s)
+	}
+	if len(values) > 0 {
+		values[0] = indent + values[0]
+	}
+	fmt.Fprintln(w, strings.Join(values, "\t"))
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/Eric-Song-Nop/agentstat/internal/agent"
+	"github.com/Eric-Song-Nop/agentstat/internal/model"
+	"github.com/Eric-Song-Nop/agentstat/internal/platform"
+	"github.com/Eric-Song-Nop/agentstat/internal/watch"
+)
+
+// clearScreen moves the cursor home and clears the terminal.
+const clearScreen = "\x1b[H\x1b[2J"
+
+// runWatch reports sessions until interrupted. Every enabled agent is
+// discovered once; after that an agent is only rediscovered when its data
+// directories or processes change, or when a rescan finds that processes of
+// it started or exited. A change of a single transcript only recomputes the
+// session read from it (see agent.Refresh). OpenCode is followed through the
+// event stream of each instance (see agent.OpenCodeMonitor), and only
+// rediscovered on every rescan while one of its streams is not connected.
+//
+// The process table is read once; afterwards only the processes of the
+// agents that changed are re-read, and a rescan lists the running processes
+// and reads those that started (see platform.ProcessTable).
+//
+// The table is redrawn after every change and rescan, so its ages keep
+// moving. JSON output is one line per report, written only when it differs
+// from the previous one.
+func runWatch(enabled []string, cols []column, sortKey string, jsonOut bool, interval time.Duration) {
+	w, err := watch.New(interval)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v; polling every %s instead\n", err, interval)
+		w = watch.NewPolling(interval)
+	}
+	defer w.Close()
+
+	oc := agent.NewOpenCodeMonitor(func() { w.Notify("opencode") })
+	defer oc.Close()
+	discoverers := maps.Clone(detectors)
+	discoverers["opencode"] = oc.Discover
+
+	table := platform.NewProcessTable()
+	snap := table.Snapshot()
+	targets := agent.WatchTargets(snap, enabled)
+	results := make(map[string][]model.AgentSession, len(enabled))
+	for _, name := range enabled {
+		results[name] = discoverers[name](snap)
+	}
+
+	var last []byte
+	for {
+		// Watch what the latest discovery of each agent saw.
+		for name, t := range targets {
+			w.SetPIDs(name, t.PIDs)
+			w.SetDirs(name, t.Dirs)
+		}
+		last = report(enabled, results, cols, sortKey, jsonOut, last)
+
+		change, err := w.Next()
+		if err != nil {
+			return
+		}
+
+		changed := maps.Clone(change.Agents)
+		if changed == nil {
+			changed = make(map[string]bool)
+		}
+		files := maps.Clone(change.Files)
+		if files == nil {
+			files = make(map[string][]string)
+		}
+		for _, name := range enabled {
+			if changed[name] || len(files[name]) > 0 {
+				table.Refresh(targets[name].PIDs)
+			}
+		}
+
+		var rescanned map[string]agent.WatchTarget
+		if change.Rescan {
+			if table.Rescan() {
+				rescanned = agent.WatchTargets(table.Snapshot(), enabled)
+				for name, t := range rescanned {
+					if !slices.Equal(t.PIDs, targets[name].PIDs) {
+						changed[name] = true
+					}
+				}
+			}
+			if oc.Polling() {
+				changed["opencode"] = true
+			}
+			// A Claude Code tool call turns into waiting for approval after
+			// a delay, without anything being written.
+			for _, s := range results["claude"] {
+				if pendingToolCall(s) {
+					files["claude"] = append(files["claude"], s.Path)
+				}
+			}
+		}
+		snap = table.Snapshot()
+
+		for _, name := range enabled {
+			if !changed[name] && len(files[name]) > 0 {
+				if sessions, ok := agent.Refresh(snap, name, results[name], files[name]); ok {
+					results[name] = sessions
+					continue
+				}
+				changed[name] = true
+			}
+			if !changed[name] {
+				continue
+			}
+			results[name] = discoverers[name](snap)
+			if t, ok := rescanned[name]; ok {
+				targets[name] = t
+			} else {
+				targets[name] = agent.WatchTargets(snap, []string{name})[name]
+			}
+		}
+	}
+}
+
+// pendingToolCall reports whether a session is busy with a tool call.
+func pendingToolCall(s model.AgentSession) bool {
+	return s.Status == model.StatusBusy && s.Activity != ""
+}
+
+// report writes the sessions in results for one watch iteration and returns
+// what was written as JSON, to be passed back as prev next time.
+func report(enabled []string, results map[string][]model.AgentSession, cols []column, sortKey string, jsonOut bool, prev []byte) []byte {
+	sessions := []model.AgentSession{}
+	for _, name := range enabled {
+		sessions = append(sessions, results[name]...)
+	}
+	// The sort key was validated before watching started.
+	_ = sortSessions(sessions, sortKey)
+
+	if jsonOut {
+		data, err := json.Marshal(sessions)
+		if err != nil || bytes.Equal(data, prev) {
+			return prev
+		}
+		os.Stdout.Write(append(data, '\n'))
+		return data
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(clearScreen)
+	if len(sessions) == 0 {
+		buf.WriteString("No agent sessions found.\n")
+	} else {
+		writeTable(&buf, sessions, cols)
+	}
+	os.Stdout.Write(buf.Bytes())
+	return nil
+}